@@ -8,8 +8,7 @@ import (
 	"net/http"
 	"os"
 	"io"
-	"errors"
-	"fmt"
+	"strconv"
 	"encoding/json"
 	steno "github.com/cloudfoundry/gosteno"
 )
@@ -26,18 +25,28 @@ type PackageMgm struct{
 	ticker 		       		*time.Ticker
 	logger               	*steno.Logger
 	jssUtil					*util.JssUtil
+	//guid->摘要 引用及引用计数(相同内容的package只保存一份)
+	index					*util.DigestIndex
+	//jss 删除日志,删除失败时后台重试
+	deletions				*util.DeleteJournal
+	//应用文件缓存池(按 sha1 缓存应用包中的文件)
+	resources				*ResourcePool
+	//缓存数据压缩/加密
+	codec					*util.ArtifactCodec
 	lock 					sync.Mutex
 }
 
 type Package struct{
 	AppGuid					string
+	Digest					string
 	CachePath				string
 	TimeOfLastUpdate		time.Time
 }
 
 //创建一个package 管理对象
 func NewPackageMgm(c *config.Config) *PackageMgm{
-	return &PackageMgm{
+	jssUtil := util.NewJssUtil(c, false)
+	p := &PackageMgm{
 		cache_base_dir: c.Package.CacheBaseDir,
 		cache_directory: c.Package.CacheDirecotry,
 		cache_time_out: c.Package.CacheTimeOut,
@@ -45,8 +54,16 @@ func NewPackageMgm(c *config.Config) *PackageMgm{
 		cache_interval: c.Package.CacheInterval,
 		disk_mak_free_space: c.Package.DiskMaxUsedSpace,
 		logger:steno.NewLogger("cc_helper"),
-		jssUtil: util.NewJssUtil(c, false),
+		jssUtil: jssUtil,
+		index: util.NewDigestIndex(c.Package.CacheBaseDir+"/"+c.Package.CacheDirecotry+"/index.json"),
+		deletions: util.NewDeleteJournal(c, c.Package.CacheBaseDir+"/"+c.Package.CacheDirecotry+"/deletions.json", jssUtil),
+		resources: NewResourcePool(c, util.NewArtifactCodec(c)),
+		codec: util.NewArtifactCodec(c),
 	}
+	p.deletions.Protect(func(digest string) bool {
+		return p.index.RefCount(digest) > 0
+	})
+	return p
 }
 
 //返回当前内存中的所有droplets 格式化成 json
@@ -59,18 +76,135 @@ func (p *PackageMgm) CachePackages() []byte{
 	return a
 }
 
-//根据guid删除本地缓存数据
+//返回应用包缓存目录的磁盘使用情况
+func (p *PackageMgm) CacheUsage() *util.CacheUsage {
+	return util.DirCacheUsage("packages", p.cache_base_dir+"/"+p.cache_directory)
+}
+
+//定时检测缓存,清理应用文件缓存池
+func (p *PackageMgm) CheckCachePackage() {
+	p.logger.Infof("process CheckCachePackage............")
+	p.resources.Prune()
+}
+
+/**
+	根据guid删除package
+	1:释放guid对摘要的引用,删除jss中guid的引用对象
+	2:摘要在本地没有任何引用时删除本地缓存,jss 中的数据在删除日志中确认没有其他 guid 引用后才删除
+	3:兼容旧版本按guid保存的本地缓存和jss数据
+**/
 func (p *PackageMgm) DestoryPackage(guid string) {
 
 	p.logger.Infof("delete app package,guid:%v,from cache ",guid)
-	packagePath,cache := p.getCacheAppPackage(guid)
-	if !cache {
-		packagePath = p.getCachePath(guid)+"/"+guid
-		os.Remove(packagePath)
-	}else{
-		os.Remove(packagePath)
-	}
 	p.unRegisterCache(guid)
+	os.Remove(p.getCachePath(guid)+"/"+guid)
+	
+	digest, orphan := p.index.Release(guid)
+	if digest == "" {
+		//本地索引中不存在,可能是其他scheduler上传的,只删除引用对象,数据由引用它的scheduler负责删除
+		if _, found := p.jssUtil.GetRef(guid); found {
+			p.deletions.Delete(util.DeleteRef, guid, guid)
+			return
+		}
+		p.deletions.Delete(util.DeleteObject, guid, guid)
+		return
+	}
+	
+	p.deletions.Delete(util.DeleteRef, guid, guid)
+	if orphan {
+		p.removeDigest(guid, digest)
+	} else {
+		p.logger.Infof("delete app package,guid:%v,digest:%v still referenced, keep data",guid, digest)
+	}
+}
+
+//返回应用包的存储信息,本地缓存存在时返回本地缓存文件信息,否则查询jss
+func (p *PackageMgm) StatPackage(guid string) (*util.ArtifactInfo, error) {
+
+	info := &util.ArtifactInfo{Guid: guid}
+	digest, found := p.resolveDigest(guid)
+	if found {
+		info.Digest = digest
+		info.Path = p.getDigestPath(digest)
+	}else {
+		//兼容旧版本按guid保存的数据
+		info.Path = p.getCachePath(guid)+"/"+guid
+	}
+	
+	if fi, err := os.Stat(info.Path); err == nil {
+		info.Size = fi.Size()
+		info.Location = util.LocationLocal
+		return info, nil
+	}
+	
+	info.Path = ""
+	var err error
+	if found {
+		info.Size, err = p.jssUtil.StatDigest(digest)
+	}else {
+		info.Size, err = p.jssUtil.Stat(guid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Location = util.LocationBackend
+	return info, nil
+}
+
+//删除摘要对应的本地缓存和jss数据
+func (p *PackageMgm) removeDigest(guid string, digest string) {
+
+	p.logger.Infof("delete app package data,digest:%v, no reference remains",digest)
+	if path := p.getDigestPath(digest); path != "" {
+		os.Remove(path)
+	}
+	p.deletions.Delete(util.DeleteDigest, digest, guid)
+}
+
+//增加guid对摘要的引用,guid 之前引用的摘要没有任何引用时删除旧数据
+func (p *PackageMgm) addRef(guid string, digest string) {
+
+	old, orphan := p.index.AddRef(guid, digest)
+	if orphan {
+		p.removeDigest(guid, old)
+	}
+}
+
+//返回guid对应的摘要,本地索引中不存在时从jss的引用对象中解析
+func (p *PackageMgm) resolveDigest(guid string) (string, bool) {
+
+	if digest, found := p.index.Digest(guid); found {
+		return digest, true
+	}
+	
+	//只读取,不加入本地索引:本地索引只记录本节点上传的 guid,否则会增加不属于本节点的引用计数
+	return p.jssUtil.GetRef(guid)
+}
+
+/**
+	匹配客户端的文件指纹,返回缓存池中已经存在的文件
+	参数格式: [{"sha1":"...","size":1024,"fn":"app/app.rb"}]
+	客户端上传应用包时只需要上传没有匹配的文件,并在 resources 字段中带上已匹配的文件指纹
+*/
+func (p *PackageMgm) MatchResources(rw http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	logger := util.RequestLogger(req, p.logger)
+	
+	var resources []Resource
+	if err := json.NewDecoder(req.Body).Decode(&resources); err != nil {
+		logger.Errorf("match resources, decode request fail: %v", err)
+		return util.NewInvalidArgumentError("match resources, decode request fail: %v", err)
+	}
+	
+	matched := p.resources.Match(resources)
+	logger.Infof("match resources, request count:%v, matched count:%v", len(resources), len(matched))
+	
+	a, err := json.Marshal(matched)
+	if err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type","application/json")
+	rw.Write(a)
+	return nil
 }
 
 /**
@@ -79,31 +213,38 @@ func (p *PackageMgm) DestoryPackage(guid string) {
  2:如果缓存中不存在就从JSS 下载到本地缓存,然后再返回到dea
 */
 func (p *PackageMgm) DownloadPackage(rw http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	logger := util.RequestLogger(req, p.logger)
+	jss := p.jssUtil.ForRequest(req)
 	
 	start := time.Now()
 	method := req.Method
-	params := req.URL.Query()
-	guid := params.Get(":guid")
+	guid := util.RouteGuid(req, vars)
 	
 	if guid == "" {
-		p.logger.Error("download app package,guid is empty")
-		rw.WriteHeader(400);
-		return errors.New("download app package,guid is empty")
+		logger.Error("download app package,guid is empty")
+		return util.NewInvalidArgumentError("download app package,guid is empty")
 	}
 	
 	var packagePath string
-	p.logger.Infof("download app package,guid:%v, method:%v",guid,method)
+	logger.Infof("download app package,guid:%v, method:%v",guid,method)
 	
 	 //从jss中下载
-	packagePath = p.getCachePath(guid)+"/"+guid
-	jssdownload := p.jssUtil.Download(guid, packagePath, rw)
-	if !jssdownload {
-		p.logger.Errorf("download app package fail, cache not found and downlaod from jss fail,guid:%v,dropletpath:%v",guid, packagePath)
-		rw.WriteHeader(400);
-		return errors.New(fmt.Sprintf("download app package fail, cache not found and downlaod from jss fail,guid:%v,dropletpath:%v",guid, packagePath) )
+	var err error
+	digest, found := p.resolveDigest(guid)
+	if found {
+		packagePath = p.getDigestPath(digest)
+		err = jss.DownloadDigest(digest, packagePath, rw)
+	}else {
+		//兼容旧版本按guid保存的数据
+		packagePath = p.getCachePath(guid)+"/"+guid
+		err = jss.Download(guid, packagePath, rw)
+	}
+	if err != nil {
+		logger.Errorf("download app package fail, cache not found and downlaod from jss fail,guid:%v,dropletpath:%v,err:%v",guid, packagePath, err)
+		return err
 	}
 	end := time.Now()
-	p.logger.Infof("download app package,guid:%v, method:%v, success, 耗时:%v",guid, method,  end.Sub(start))
+	logger.Infof("download app package,guid:%v, method:%v, success, 耗时:%v",guid, method,  end.Sub(start))
 	return nil
 }
 
@@ -134,27 +275,26 @@ func (p *PackageMgm) getCacheAppPackage(guid string) (string, bool){
 	3:上传到jss
 */
 func (p *PackageMgm) UploadPackage(rw http.ResponseWriter, req *http.Request, vars map[string]string) error{
+	logger := util.RequestLogger(req, p.logger)
+	jss := p.jssUtil.ForRequest(req)
 
 	start := time.Now()
 	method := req.Method
-	params := req.URL.Query()
-	guid := params.Get(":guid")
+	guid := util.RouteGuid(req, vars)
 	
 	if guid == "" {
-		p.logger.Error("upload app package,guid is empty")
-		rw.WriteHeader(400);
-		return errors.New("upload app package,guid is empty")
+		logger.Error("upload app package,guid is empty")
+		return util.NewInvalidArgumentError("upload app package,guid is empty")
 	}
 	
-	p.logger.Infof("upload app package,guid:%v, method:%v",guid,method)
+	logger.Infof("upload app package,guid:%v, method:%v",guid,method)
 	
 	//解析上传文件
 	reader,err := req.MultipartReader()
 	
 	if err != nil {
-		p.logger.Errorf("upload app package,guid:%v, method:%v,fail: %v",guid,method,err)
-		rw.WriteHeader(400);
-		return errors.New(fmt.Sprintf("upload app package,guid:%v, method:%v,fail: %v",guid,method,err) )
+		logger.Errorf("upload app package,guid:%v, method:%v,fail: %v",guid,method,err)
+		return util.NewInvalidArgumentError("upload app package,guid:%v, method:%v,fail: %v",guid,method,err)
 	}
 	
 	//检测缓存目录是否存在
@@ -162,26 +302,29 @@ func (p *PackageMgm) UploadPackage(rw http.ResponseWriter, req *http.Request, va
 	dir ,err := os.Stat(cachePath)
 	
 	if err != nil || !dir.IsDir() {//目录不存在需要创建
-		err := os.MkdirAll(cachePath , 0777)
+		err := os.MkdirAll(cachePath , util.CacheDirMode)
 		if err != nil {
-			p.logger.Errorf("upload app package,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
-			rw.WriteHeader(400);
-			return errors.New(fmt.Sprintf("upload app package,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err) )
+			logger.Errorf("upload app package,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
+			return util.NewInternalError("upload app package,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
 		}
 	}
 	
-	//保存droplet 到 cache
-	filePath := cachePath+"/"+guid
-	p.checkCacheFileAndRemove(filePath)
+	//保存package 到 cache(先写入临时文件,同时计算摘要)
+	p.checkCacheFileAndRemove(cachePath+"/"+guid)
+	tmpPath := cachePath+"/"+guid+".uploading"
+	p.checkCacheFileAndRemove(tmpPath)
 	
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.CacheFileMode)
 	
 	if err !=nil {
-		p.logger.Errorf("upload app package,guid:%v, method:%v,create package file fail,file: %v, err:%v", guid, method, filePath, err)
-		rw.WriteHeader(400);
-		return errors.New(fmt.Sprintf("upload app package,guid:%v, method:%v,create package file fail,file: %v, err:%v", guid, method, filePath, err) )
+		logger.Errorf("upload app package,guid:%v, method:%v,create package file fail,file: %v, err:%v", guid, method, tmpPath, err)
+		return util.NewInternalError("upload app package,guid:%v, method:%v,create package file fail,file: %v, err:%v", guid, method, tmpPath, err)
 	}
 	
+	h := util.NewDigestHash()
+	w := io.MultiWriter(f, h)
+	resources := []Resource{}
+	
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
@@ -190,39 +333,117 @@ func (p *PackageMgm) UploadPackage(rw http.ResponseWriter, req *http.Request, va
 		if part == nil {
 			break
 		}
+		//resources 为客户端已经匹配过的文件指纹,不写入应用包
+		if part.FormName() == "resources" {
+			if err := json.NewDecoder(part).Decode(&resources); err != nil {
+				f.Close()
+				os.Remove(tmpPath)
+				logger.Errorf("upload app package,guid:%v, method:%v,decode resources fail: %v",guid,method,err)
+				return util.NewInvalidArgumentError("upload app package,guid:%v, method:%v,decode resources fail: %v",guid,method,err)
+			}
+			continue
+		}
 		for {
 			buffer := make([]byte,100000)
 			cBytes,err := part.Read(buffer)
 			
+			//最后一次读取可能同时返回数据和 io.EOF
+			w.Write(buffer[0:cBytes])
+			
 			if err == io.EOF {
 				break
 			}
-			
-			f.Write(buffer[0:cBytes])
+			if err != nil {
+				f.Close()
+				os.Remove(tmpPath)
+				logger.Errorf("upload app package,guid:%v, method:%v,read request body fail: %v",guid,method,err)
+				return util.NewInvalidArgumentError("upload app package,guid:%v, method:%v,read request body fail: %v",guid,method,err)
+			}
 		}
 	}
 	
 	err = f.Close()
 	if err != nil {
-		p.logger.Errorf("upload package,guid:%v, fail: %v", guid, err)
-		return errors.New(fmt.Sprintf("upload package,guid:%v, fail: %v", guid, err) )
+		os.Remove(tmpPath)
+		logger.Errorf("upload package,guid:%v, fail: %v", guid, err)
+		return util.NewInternalError("upload package,guid:%v, fail: %v", guid, err)
 	}
 	
+	//缓存上传的文件,客户端有已匹配的文件时从缓存池补齐,组装完整的应用包
+	p.resources.AddZip(tmpPath)
+	digest := util.DigestString(h)
+	if len(resources) > 0 {
+		assembledPath := tmpPath+".assembled"
+		digest, err = p.resources.Assemble(tmpPath, resources, assembledPath)
+		os.Remove(tmpPath)
+		if err != nil {
+			logger.Errorf("upload app package,guid:%v, method:%v,assemble package fail: %v", guid, method, err)
+			//缓存池中缺少客户端声明的文件时返回 409,客户端需要重新上传完整的应用包
+			if _, ok := err.(*util.ApiError); ok {
+				return err
+			}
+			return util.NewInternalError("upload app package,guid:%v, method:%v,assemble package fail: %v", guid, method, err)
+		}
+		tmpPath = assembledPath
+	}
+	
+	//按摘要保存到缓存,相同内容的package已经缓存时直接使用已有文件
+	filePath := p.getDigestPath(digest)
+	if filePath == "" {
+		os.Remove(tmpPath)
+		logger.Errorf("upload app package,guid:%v, method:%v,create digest cache dir fail, digest: %v", guid, method, digest)
+		return util.NewInternalError("upload app package,guid:%v, method:%v,create digest cache dir fail, digest: %v", guid, method, digest)
+	}
+	
+	//上传内容的大小,用于响应头和上传事件
+	var size int64
+	if fi, err := os.Stat(tmpPath); err == nil {
+		size = fi.Size()
+	}
+	
+	if _, err := os.Stat(filePath); err == nil {
+		logger.Infof("upload app package,guid:%v, digest:%v already cached",guid, digest)
+		os.Remove(tmpPath)
+	}else if err := p.codec.StoreFile(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		logger.Errorf("upload app package,guid:%v, method:%v,move package file fail,file: %v, err:%v", guid, method, filePath, err)
+		return util.NewInternalError("upload app package,guid:%v, method:%v,move package file fail,file: %v, err:%v", guid, method, filePath, err)
+	}
+	
+	//与相同数据的删除互斥:正在执行的删除完成后再上传,取消等待中的删除,避免删除新上传的数据
+	unlockDigest := p.deletions.Guard(util.DeleteDigest, digest)
+	unlockRef := p.deletions.Guard(util.DeleteRef, guid)
+	p.deletions.Cancel(util.DeleteDigest, digest)
+	p.deletions.Cancel(util.DeleteRef, guid)
+	
 	//上传文件到jss(如果上传失败 清空本地缓存,通知dea上传失败)
-	jssupload := p.jssUtil.Upload(guid, filePath)
-	if !jssupload {
-	 os.Remove(filePath)
-	 p.logger.Errorf("upload app package,guid:%v, method:%v,upload to jss fail,clean cache file,file: %v", guid, method, filePath)
-	 rw.WriteHeader(400);
-	 return errors.New(fmt.Sprintf("upload app package,guid:%v, method:%v,upload to jss fail,clean cache file,file: %v", guid, method, filePath) )
+	err = jss.UploadDigest(digest, filePath)
+	if err == nil && !jss.PutRef(guid, digest) {
+		err = util.NewBackendUnavailableError("put app package ref to jss fail, guid:%v", guid)
+	}
+	unlockRef()
+	unlockDigest()
+	if err != nil {
+	 if p.index.RefCount(digest) == 0 {
+	 	os.Remove(filePath)
+	 }
+	 logger.Errorf("upload app package,guid:%v, method:%v,upload to jss fail,clean cache file,file: %v, err:%v", guid, method, filePath, err)
+	 //jss 并发数超过限制时返回 503,dea 稍后重试
+	 if util.ToApiError(err).Kind == util.ErrorTooBusy {
+	 	return err
+	 }
+	 return util.NewBackendUnavailableError("upload app package,guid:%v, method:%v,upload to jss fail,clean cache file,file: %v", guid, method, filePath)
 	}
 	
-	//注册缓存信息
-	p.registerCache(guid, filePath)
+	//注册引用和缓存信息
+	p.addRef(guid, digest)
+	p.registerCache(guid, digest, filePath)
 	
 	end := time.Now()
-	p.logger.Infof("upload app package,guid:%v, method:%v, success, 耗时:%v",guid, method,  end.Sub(start))
+	logger.Infof("upload app package,guid:%v, digest:%v, method:%v, success, 耗时:%v",guid, digest, method,  end.Sub(start))
 	
+	rw.Header().Set("X-Artifact-Digest", digest)
+	rw.Header().Set("X-Artifact-Size", strconv.FormatInt(size, 10))
 	rw.WriteHeader(200);
 	
 	return nil
@@ -243,7 +464,7 @@ func (p *PackageMgm) unRegisterCache(guid string){
 	
 }
 //注册缓存的 app package 到内存缓存
-func (p *PackageMgm) registerCache(guid string, path string) {
+func (p *PackageMgm) registerCache(guid string, digest string, path string) {
 
 	p.logger.Infof("register droplet cache ,guid:%v,path:%v",guid, path)
 	
@@ -256,7 +477,7 @@ func (p *PackageMgm) registerCache(guid string, path string) {
 		delete(p.cache_packages, guid)
 	}
 	
-	cachePackage := &Package{AppGuid:guid,CachePath:path,TimeOfLastUpdate:time.Now(),}
+	cachePackage := &Package{AppGuid:guid,Digest:digest,CachePath:path,TimeOfLastUpdate:time.Now(),}
 	p.cache_packages[guid] = cachePackage
 }
 
@@ -282,7 +503,7 @@ func (p *PackageMgm) getCachePath(guid string) string {
 	//检测目录是否存在
 	dir ,err := os.Stat(path)
 	if err != nil || !dir.IsDir() {//目录不存在需要创建
-		err := os.MkdirAll(path , 0777)
+		err := os.MkdirAll(path , util.CacheDirMode)
 		if err != nil {
 			p.logger.Errorf("mkdir path:%v fail,%v", path, err)
 			return ""
@@ -290,4 +511,37 @@ func (p *PackageMgm) getCachePath(guid string) string {
 	}
 	
 	return path
-}
\ No newline at end of file
+}
+
+//根据摘要返回缓存文件在本地磁盘的路径
+func (p *PackageMgm) getDigestPath(digest string) string {
+	
+	rs := [] rune(digest)
+	
+	if len(rs) < 4{
+		return ""
+	}
+	
+	path := p.cache_base_dir+"/"+p.cache_directory+"/sha256/"+string(rs[0:2])+"/"+string(rs[2:4])
+	//检测目录是否存在
+	dir ,err := os.Stat(path)
+	if err != nil || !dir.IsDir() {//目录不存在需要创建
+		err := os.MkdirAll(path , util.CacheDirMode)
+		if err != nil {
+			p.logger.Errorf("mkdir path:%v fail,%v", path, err)
+			return ""
+		}
+	}
+	
+	return path+"/"+digest
+}
+
+//返回 jss 删除日志
+func (p *PackageMgm) Deletions() *util.DeleteJournal {
+	return p.deletions
+}
+
+//返回 app package 的 jss 存储
+func (p *PackageMgm) Backend() *util.JssUtil {
+	return p.jssUtil
+}
@@ -0,0 +1,355 @@
+package apppackage
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"scheduler/config"
+	"scheduler/util"
+	steno "github.com/cloudfoundry/gosteno"
+)
+
+//应用文件缓存池
+//按 sha1 缓存应用包中的文件,客户端上传前先匹配已有的文件,只上传缺少的文件
+type ResourcePool struct {
+	base_dir				string
+	codec					*util.ArtifactCodec
+	//超过该时间未使用的文件定时删除,0 不按时间删除
+	time_out				time.Duration
+	//缓存池最大字节数,0 不限制
+	max_bytes				int64
+	//每个 zip 包最多加入缓存池的解压后字节数,0 不限制
+	max_unzip_bytes			int64
+	logger					*steno.Logger
+}
+
+//文件指纹
+type Resource struct {
+	Sha1					string				`json:"sha1"`
+	Size					int64				`json:"size"`
+	Fn						string				`json:"fn"`
+	Mode					string				`json:"mode,omitempty"`
+}
+
+//zip 包中的文件超过 resource_max_unzip_bytes,不再继续加入缓存池
+var errResourceLimit = util.NewInvalidArgumentError("resources exceed resource_max_unzip_bytes")
+
+//创建文件缓存池
+func NewResourcePool(c *config.Config, codec *util.ArtifactCodec) *ResourcePool {
+	return &ResourcePool{
+		base_dir:			c.Package.CacheBaseDir+"/"+c.Package.CacheDirecotry+"/resources",
+		codec:				codec,
+		time_out:			time.Duration(c.Package.ResourceTimeOut) * time.Second,
+		max_bytes:			c.Package.ResourceMaxBytes,
+		max_unzip_bytes:	c.Package.ResourceMaxUnzipBytes,
+		logger:				steno.NewLogger("cc_helper"),
+	}
+}
+
+//返回缓存池中已经存在的文件指纹(sha1 和大小都一致)
+func (r *ResourcePool) Match(resources []Resource) []Resource {
+	matched := []Resource{}
+
+	for _, res := range resources {
+		if !validSha1(res.Sha1) {
+			continue
+		}
+
+		path := r.resourcePath(strings.ToLower(res.Sha1), res.Size)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		//更新修改时间,清理缓存池时优先保留最近使用的文件
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		matched = append(matched, res)
+	}
+
+	return matched
+}
+
+//将上传的zip包中的文件加入缓存池
+func (r *ResourcePool) AddZip(zipPath string) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		r.logger.Infof("add resources from zip:%v skip,%v", zipPath, err)
+		return
+	}
+	defer zr.Close()
+
+	count := 0
+	remaining := r.max_unzip_bytes
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		size, err := r.addFile(f, remaining)
+		if err == errResourceLimit {
+			r.logger.Warnf("add resources from zip:%v stopped, exceed resource_max_unzip_bytes:%v", zipPath, r.max_unzip_bytes)
+			break
+		}
+		if err != nil {
+			r.logger.Errorf("add resource:%v from zip:%v fail,%v", f.Name, zipPath, err)
+			continue
+		}
+		if r.max_unzip_bytes > 0 {
+			remaining -= size
+		}
+		count++
+	}
+	r.logger.Infof("add resources from zip:%v, count:%v", zipPath, count)
+}
+
+//缓存zip包中的一个文件,先写临时文件,计算sha1后再编码保存到最终位置
+//limit > 0 时解压后超过 limit 字节返回 errResourceLimit,返回解压后的大小
+func (r *ResourcePool) addFile(f *zip.File, limit int64) (int64, error) {
+	if limit > 0 && f.UncompressedSize64 > uint64(limit) {
+		return 0, errResourceLimit
+	}
+	if err := os.MkdirAll(r.base_dir, util.CacheDirMode); err != nil {
+		return 0, err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile(r.base_dir, "resource-")
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := tmp.Name()
+
+	//zip 头中的大小可以伪造,按实际解压的字节数限制
+	var src io.Reader = rc
+	if limit > 0 {
+		src = io.LimitReader(rc, limit+1)
+	}
+	h := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), src)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && limit > 0 && size > limit {
+		err = errResourceLimit
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return size, err
+	}
+
+	dest := r.resourcePath(hex.EncodeToString(h.Sum(nil)), size)
+	if _, err := os.Stat(dest); err == nil {
+		os.Remove(tmpPath)
+		return size, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), util.CacheDirMode); err != nil {
+		os.Remove(tmpPath)
+		return size, err
+	}
+	if err := r.codec.StoreFile(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return size, err
+	}
+	return size, nil
+}
+
+/**
+	清理缓存池,由定时检测缓存调用
+	1:删除超过 resource_time_out_second 未使用的文件
+	2:剩余文件超过 resource_max_bytes 时从最久未使用的文件开始删除
+**/
+func (r *ResourcePool) Prune() {
+	type resourceFile struct {
+		path		string
+		size		int64
+		modTime		time.Time
+	}
+
+	pruneTime := time.Now().Add(-r.time_out)
+	files := []resourceFile{}
+	var total int64
+	filepath.Walk(r.base_dir, func(path string, fi os.FileInfo, err error) error {
+		if fi == nil || fi.IsDir() {
+			return nil
+		}
+		if r.time_out > 0 && fi.ModTime().Before(pruneTime) {
+			r.logger.Infof("prune resource pool remove timeout resource ,path:%v", path)
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, resourceFile{path: path, size: fi.Size(), modTime: fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+
+	if r.max_bytes <= 0 || total <= r.max_bytes {
+		return
+	}
+	r.logger.Infof("prune resource pool, size:%v exceeds resource_max_bytes:%v", total, r.max_bytes)
+	sort.Slice(files, func(i, k int) bool { return files[i].modTime.Before(files[k].modTime) })
+	for _, f := range files {
+		if total <= r.max_bytes {
+			break
+		}
+		if err := os.Remove(f.path); err == nil {
+			total -= f.size
+		}
+	}
+}
+
+/**
+	组装完整的应用包
+	1:复制上传的部分zip包中的所有文件
+	2:从缓存池中补齐客户端没有上传的文件
+	返回组装后应用包的摘要
+**/
+func (r *ResourcePool) Assemble(zipPath string, resources []Resource, destPath string) (string, error) {
+	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.CacheFileMode)
+	if err != nil {
+		return "", err
+	}
+
+	h := util.NewDigestHash()
+	zw := zip.NewWriter(io.MultiWriter(out, h))
+
+	err = r.assemble(zw, zipPath, resources)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destPath)
+		return "", err
+	}
+
+	return util.DigestString(h), nil
+}
+
+func (r *ResourcePool) assemble(zw *zip.Writer, zipPath string, resources []Resource) error {
+	written := make(map[string]bool)
+
+	//上传的文件为空时表示客户端所有文件都已经匹配,不需要复制
+	if fi, err := os.Stat(zipPath); err == nil && fi.Size() > 0 {
+		zr, err := zip.OpenReader(zipPath)
+		if err != nil {
+			return util.NewInvalidArgumentError("open uploaded zip fail,%v", err)
+		}
+		defer zr.Close()
+
+		for _, f := range zr.File {
+			if err := copyZipFile(zw, f); err != nil {
+				return err
+			}
+			written[f.Name] = true
+		}
+	}
+
+	for _, res := range resources {
+		if written[res.Fn] {
+			continue
+		}
+		if err := r.writeResource(zw, res); err != nil {
+			return err
+		}
+		written[res.Fn] = true
+	}
+
+	return nil
+}
+
+//复制zip包中的一个文件到新的zip包
+func copyZipFile(zw *zip.Writer, f *zip.File) error {
+	header := f.FileHeader
+	w, err := zw.CreateHeader(&header)
+	if err != nil {
+		return err
+	}
+	if f.FileInfo().IsDir() {
+		return nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+//从缓存池中读取文件写入zip包
+func (r *ResourcePool) writeResource(zw *zip.Writer, res Resource) error {
+	if !validSha1(res.Sha1) {
+		return util.NewInvalidArgumentError("invalid resource sha1:%v", res.Sha1)
+	}
+	if !validFileName(res.Fn) {
+		return util.NewInvalidArgumentError("invalid resource fn:%v", res.Fn)
+	}
+
+	f, err := r.codec.OpenFile(r.resourcePath(strings.ToLower(res.Sha1), res.Size))
+	if err != nil {
+		return util.NewConflictError("resource sha1:%v, fn:%v not found in cache", res.Sha1, res.Fn)
+	}
+	defer f.Close()
+
+	header := &zip.FileHeader{Name: res.Fn, Method: zip.Deflate}
+	//只使用客户端传入的权限位,不允许设置文件类型和 setuid 等特殊位
+	mode := os.FileMode(0644)
+	if res.Mode != "" {
+		if m, err := strconv.ParseUint(res.Mode, 8, 32); err == nil && os.FileMode(m)&0777 != 0 {
+			mode = os.FileMode(m) & 0777
+		}
+	}
+	header.SetMode(mode)
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+//根据 sha1 和文件大小返回缓存文件路径(文件可能被压缩/加密,大小保存在文件名中)
+func (r *ResourcePool) resourcePath(sha string, size int64) string {
+	return r.base_dir + "/" + sha[0:2] + "/" + sha[2:4] + "/" + sha + "_" + strconv.FormatInt(size, 10)
+}
+
+//检测 sha1 是否合法(40位十六进制),防止拼接出非法路径
+func validSha1(sha string) bool {
+	if len(sha) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(sha)
+	return err == nil
+}
+
+//检测文件名是否合法,不允许绝对路径和跳出应用目录
+func validFileName(fn string) bool {
+	if fn == "" || strings.HasPrefix(fn, "/") {
+		return false
+	}
+	for _, part := range strings.Split(fn, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
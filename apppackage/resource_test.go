@@ -0,0 +1,138 @@
+package apppackage
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"scheduler/config"
+	"scheduler/util"
+)
+
+func newTestPool(t *testing.T) (*ResourcePool, string) {
+	dir, err := ioutil.TempDir("", "resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.DefaultConfig()
+	c.Package.CacheBaseDir = dir
+	return NewResourcePool(c, util.NewArtifactCodec(c)), dir
+}
+
+func writeZip(t *testing.T, path string, files map[string]string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, _ := zw.Create(name)
+		w.Write([]byte(data))
+	}
+	zw.Close()
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countResources(dir string) int {
+	count := 0
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if fi != nil && !fi.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+//解压后超过 resource_max_unzip_bytes 的文件不加入缓存池
+func TestResourcePoolUnzipLimit(t *testing.T) {
+	r, dir := newTestPool(t)
+	defer os.RemoveAll(dir)
+	r.max_unzip_bytes = 10
+
+	zipPath := filepath.Join(dir, "upload.zip")
+	writeZip(t, zipPath, map[string]string{"big": "0123456789abcdef"})
+	r.AddZip(zipPath)
+	if n := countResources(r.base_dir); n != 0 {
+		t.Fatalf("%v resources cached beyond limit", n)
+	}
+
+	writeZip(t, zipPath, map[string]string{"small": "0123"})
+	r.AddZip(zipPath)
+	if n := countResources(r.base_dir); n != 1 {
+		t.Fatalf("%v resources cached, expected 1", n)
+	}
+}
+
+//按时间和总大小清理缓存池,保留最近使用的文件
+func TestResourcePoolPrune(t *testing.T) {
+	r, dir := newTestPool(t)
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "upload.zip")
+	writeZip(t, zipPath, map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc"})
+	r.AddZip(zipPath)
+
+	paths := []string{}
+	filepath.Walk(r.base_dir, func(path string, fi os.FileInfo, err error) error {
+		if fi != nil && !fi.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if len(paths) != 3 {
+		t.Fatalf("%v resources cached", len(paths))
+	}
+	//paths[0] 超时,paths[1] 比 paths[2] 更久未使用
+	now := time.Now()
+	os.Chtimes(paths[0], now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	os.Chtimes(paths[1], now.Add(-time.Minute), now.Add(-time.Minute))
+
+	r.time_out = time.Hour
+	fi, _ := os.Stat(paths[2])
+	r.max_bytes = fi.Size()
+	r.Prune()
+	for i, exists := range []bool{false, false, true} {
+		if _, err := os.Stat(paths[i]); (err == nil) != exists {
+			t.Fatalf("resource %v exists:%v, expected %v", i, err == nil, exists)
+		}
+	}
+}
+
+//客户端传入的 mode 只保留权限位
+func TestResourcePoolMode(t *testing.T) {
+	r, dir := newTestPool(t)
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "upload.zip")
+	writeZip(t, zipPath, map[string]string{"a": "aaaa"})
+	r.AddZip(zipPath)
+
+	resources := []Resource{
+		{Sha1: "70c881d4a26984ddce795f6f71817c9cf4480e79", Size: 4, Fn: "suid", Mode: "104755"},
+		{Sha1: "70c881d4a26984ddce795f6f71817c9cf4480e79", Size: 4, Fn: "zero", Mode: "0"},
+	}
+	if len(r.Match(resources)) != 2 {
+		t.Fatal("resource not matched")
+	}
+	empty := filepath.Join(dir, "empty.zip")
+	ioutil.WriteFile(empty, nil, 0644)
+	assembled := filepath.Join(dir, "assembled.zip")
+	if _, err := r.Assemble(empty, resources, assembled); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(assembled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	expected := map[string]os.FileMode{"suid": 0755, "zero": 0644}
+	for _, f := range zr.File {
+		if f.Mode() != expected[f.Name] {
+			t.Fatalf("%v mode = %v", f.Name, f.Mode())
+		}
+	}
+}
@@ -2,14 +2,13 @@ package buildpackcache
 
 import (
 	"scheduler/config"
+	"scheduler/util"
 	"time"
 	"sync"
 	"net/http"
 	"encoding/json"
 	"os"
 	"io"
-	"errors"
-	"fmt"
 	"syscall"
 	"path/filepath"
 	steno "github.com/cloudfoundry/gosteno"
@@ -59,6 +58,11 @@ func (b *BuildpackMgm) CacheBuildpacks() []byte{
 	return a
 }
 
+//返回buildpackCache缓存目录的磁盘使用情况
+func (b *BuildpackMgm) CacheUsage() *util.CacheUsage {
+	return util.DirCacheUsage("buildpackCache", b.cache_base_dir+"/"+b.cache_directory)
+}
+
 /**
 	检测缓存使用情况,清空过期的数据
 	缓存清理规则
@@ -154,6 +158,23 @@ func (b *BuildpackMgm) DestoryBuildpack(guid string) {
 	b.unRegisterCache(guid)
 }
 
+//返回buildpackCache的存储信息,buildpackCache 只保存在本地缓存
+func (b *BuildpackMgm) StatBuildpack(guid string) (*util.ArtifactInfo, error) {
+
+	path := b.getCachePath(guid)+"/"+guid
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, util.NewNotFoundError("buildpackCache not found, guid:%v", guid)
+	}
+	
+	return &util.ArtifactInfo{
+		Guid:		guid,
+		Size:		fi.Size(),
+		Location:	util.LocationLocal,
+		Path:		path,
+	}, nil
+}
+
 /**
 	上传buildpack
 	dea在打包过程中会针对不同的应用缓存一些包的依赖项
@@ -161,27 +182,25 @@ func (b *BuildpackMgm) DestoryBuildpack(guid string) {
 	2:注册cache
 */
 func (b *BuildpackMgm) UploadBuildpack(rw http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	logger := util.RequestLogger(req, b.logger)
 
 	start := time.Now()
 	method := req.Method
-	params := req.URL.Query()
-	guid := params.Get(":guid")
+	guid := util.RouteGuid(req, vars)
 	
 	if guid == "" {
-		b.logger.Error("upload buildpackCache,guid is empty")
-		rw.WriteHeader(400);
-		return errors.New("upload buildpackCache,guid is empty")
+		logger.Error("upload buildpackCache,guid is empty")
+		return util.NewInvalidArgumentError("upload buildpackCache,guid is empty")
 	}
 	
-	b.logger.Infof("upload buildpackCache,guid:%v, method:%v",guid,method)
+	logger.Infof("upload buildpackCache,guid:%v, method:%v",guid,method)
 	
 	//解析上传文件
 	reader,err := req.MultipartReader()
 	
 	if err != nil {
-		b.logger.Errorf("upload buildpackCache,guid:%v, method:%v,fail: %v",guid,method,err)
-		rw.WriteHeader(400);
-		return errors.New(fmt.Sprintf("upload buildpackCache,guid:%v, method:%v,fail: %v",guid,method,err) )
+		logger.Errorf("upload buildpackCache,guid:%v, method:%v,fail: %v",guid,method,err)
+		return util.NewInvalidArgumentError("upload buildpackCache,guid:%v, method:%v,fail: %v",guid,method,err)
 	}
 	
 	//检测缓存目录是否存在
@@ -189,11 +208,10 @@ func (b *BuildpackMgm) UploadBuildpack(rw http.ResponseWriter, req *http.Request
 	dir ,err := os.Stat(cachePath)
 	
 	if err != nil || !dir.IsDir() {//目录不存在需要创建
-		err := os.MkdirAll(cachePath , 0777)
+		err := os.MkdirAll(cachePath , util.CacheDirMode)
 		if err != nil {
-			b.logger.Errorf("upload buildpackCache,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
-			rw.WriteHeader(400);
-			return errors.New(fmt.Sprintf("upload buildpackCache,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err))
+			logger.Errorf("upload buildpackCache,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
+			return util.NewInternalError("upload buildpackCache,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
 		}
 	}
 	
@@ -201,12 +219,11 @@ func (b *BuildpackMgm) UploadBuildpack(rw http.ResponseWriter, req *http.Request
 	filePath := cachePath+"/"+guid
 	b.checkCacheFileAndRemove(filePath)
 	
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.CacheFileMode)
 	
 	if err !=nil {
-		b.logger.Errorf("upload buildpackCache,guid:%v, method:%v,create droplet file fail,file: %v, err:%v", guid, method, filePath, err)
-		rw.WriteHeader(400);
-		return errors.New(fmt.Sprintf("upload buildpackCache,guid:%v, method:%v,create droplet file fail,file: %v, err:%v", guid, method, filePath, err) )
+		logger.Errorf("upload buildpackCache,guid:%v, method:%v,create droplet file fail,file: %v, err:%v", guid, method, filePath, err)
+		return util.NewInternalError("upload buildpackCache,guid:%v, method:%v,create droplet file fail,file: %v, err:%v", guid, method, filePath, err)
 	}
 	
 	defer f.Close()
@@ -223,11 +240,18 @@ func (b *BuildpackMgm) UploadBuildpack(rw http.ResponseWriter, req *http.Request
 			buffer := make([]byte,100000)
 			cBytes,err := part.Read(buffer)
 			
+			//最后一次读取可能同时返回数据和 io.EOF
+			f.Write(buffer[0:cBytes])
+			
 			if err == io.EOF {
 				break
 			}
-			
-			f.Write(buffer[0:cBytes])
+			if err != nil {
+				f.Close()
+				os.Remove(filePath)
+				logger.Errorf("upload buildpackCache,guid:%v, method:%v,read request body fail: %v",guid,method,err)
+				return util.NewInvalidArgumentError("upload buildpackCache,guid:%v, method:%v,read request body fail: %v",guid,method,err)
+			}
 		}
 	}
 	
@@ -235,7 +259,7 @@ func (b *BuildpackMgm) UploadBuildpack(rw http.ResponseWriter, req *http.Request
 	b.registerCache(guid, filePath)
 	
 	end := time.Now()
-	b.logger.Infof("upload buildpackCache,guid:%v, method:%v, success, 耗时:%v",guid, method,  end.Sub(start))
+	logger.Infof("upload buildpackCache,guid:%v, method:%v, success, 耗时:%v",guid, method,  end.Sub(start))
 	
 	rw.WriteHeader(200);
 	
@@ -247,43 +271,42 @@ func (b *BuildpackMgm) UploadBuildpack(rw http.ResponseWriter, req *http.Request
  1：首先检测本地缓存中是否存在,如果存在则从缓存中获取直接返回
 */
 func (b *BuildpackMgm) DownloadBuildpack(rw http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	logger := util.RequestLogger(req, b.logger)
 	
 	start := time.Now()
 	method := req.Method
-	params := req.URL.Query()
-	guid := params.Get(":guid")
+	guid := util.RouteGuid(req, vars)
 	
 	if guid == "" {
-		b.logger.Error("download buildpackCache,guid is empty")
-		rw.WriteHeader(400)
-		return errors.New("download buildpackCache,guid is empty")
+		logger.Error("download buildpackCache,guid is empty")
+		return util.NewInvalidArgumentError("download buildpackCache,guid is empty")
 	}
 	
 	var buildpackCachePath string
-	b.logger.Infof("download buildpackCache,guid:%v, method:%v",guid,method)
+	logger.Infof("download buildpackCache,guid:%v, method:%v",guid,method)
 	
 	buildpackCachePath,cache := b.getCacheBuildpack(guid)
 	if !cache {
-		b.logger.Infof("download buildpackCache,guid:%v, method:%v,not found from cache ",guid,method)
-		buildpackCachePath := b.getCachePath(guid)+"/"+guid
+		logger.Infof("download buildpackCache,guid:%v, method:%v,not found from cache ",guid,method)
+		path := b.getCachePath(guid)+"/"+guid
 		
 		//判断path在cache中是否存在(内存中的数据可能不准确,比如服务重启等情况)
-		if _, err := os.Stat(buildpackCachePath); err == nil {
-	        b.logger.Infof("found file:%v, from cache disk ",buildpackCachePath)
-	        b.registerCache(guid, buildpackCachePath)
+		if _, err := os.Stat(path); err == nil {
+	        logger.Infof("found file:%v, from cache disk ",path)
+	        b.registerCache(guid, path)
+	        buildpackCachePath = path
 	    }
 	}
 	
 	if buildpackCachePath == "" {
-		b.logger.Infof("download buildpackCache,guid:%v, method:%v,not found from cache ",guid,method)
-		rw.WriteHeader(400);
-		return errors.New(fmt.Sprintf("download buildpackCache,guid:%v, method:%v,not found from cache ",guid,method) )
+		logger.Infof("download buildpackCache,guid:%v, method:%v,not found from cache ",guid,method)
+		return util.NewNotFoundError("download buildpackCache,guid:%v, method:%v,not found from cache ",guid,method)
 	}
 	
 	//send file
 	http.ServeFile(rw,req,buildpackCachePath)
     end := time.Now()
-    b.logger.Infof("download buildpackCache,guid:%v, method:%v, success, 耗时:%v",guid, method,  end.Sub(start))
+    logger.Infof("download buildpackCache,guid:%v, method:%v, success, 耗时:%v",guid, method,  end.Sub(start))
     return nil
 }
 
@@ -327,7 +350,7 @@ func (b *BuildpackMgm) getCachePath(guid string) string {
 	//检测目录是否存在
 	dir ,err := os.Stat(path)
 	if err != nil || !dir.IsDir() {//目录不存在需要创建
-		err := os.MkdirAll(path , 0777)
+		err := os.MkdirAll(path , util.CacheDirMode)
 		if err != nil {
 			b.logger.Errorf("mkdir path:%v fail,%v", path, err)
 			return ""
@@ -0,0 +1,77 @@
+package bus
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+//request 等待应答超时
+var ErrTimeout = errors.New("bus request timeout")
+
+//bus 已经断开
+var ErrClosed = errors.New("bus closed")
+
+//消息
+type Message struct {
+	Subject				string
+	ReplyTo				string
+	Payload				[]byte
+}
+
+//消息回调
+type Callback func(*Message)
+
+/**
+	消息总线接口,deapool/listener 只依赖该接口
+	NatsBus:基于 yagnats 的实现
+	MemoryBus:进程内实现,用于单元测试和不依赖 nats 的单机开发模式
+**/
+type MessageBus interface {
+	Subscribe(subject string, callback Callback) (int64, error)
+	//同一个 queue 中只有一个订阅者收到消息
+	SubscribeWithQueue(subject string, queue string, callback Callback) (int64, error)
+	Unsubscribe(sid int64) error
+	Publish(subject string, payload []byte) error
+	PublishWithReplyTo(subject string, reply string, payload []byte) error
+	//发送请求并等待第一个应答
+	Request(subject string, payload []byte, timeout time.Duration) (*Message, error)
+	Disconnect()
+}
+
+//消息总线连接状态
+type Status struct {
+	Connected			bool				`json:"connected"`
+	//当前连接的 server
+	Server				string				`json:"server"`
+	Servers				[]string			`json:"servers"`
+	//最近一次连接或断开的时间
+	Since				time.Time			`json:"since"`
+	Reconnects			int					`json:"reconnects"`
+	LastError			string				`json:"last_error,omitempty"`
+	Subscriptions		int					`json:"subscriptions"`
+}
+
+//可以查询连接状态的消息总线
+type StatusReporter interface {
+	Status() *Status
+}
+
+//判断 subject 是否匹配订阅的 pattern,支持 nats 通配符 "*"(一级) 和 ">"(剩余所有级)
+func MatchSubject(pattern string, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+
+	for i, token := range p {
+		if token == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) {
+			return false
+		}
+		if token != "*" && token != s[i] {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
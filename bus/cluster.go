@@ -0,0 +1,398 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	steno "github.com/cloudfoundry/gosteno"
+	"github.com/cloudfoundry/yagnats"
+	"scheduler/config"
+)
+
+//nats 连接断开,消息无法发送
+var ErrDisconnected = errors.New("nats disconnected")
+
+/**
+	支持多个 nats server 的消息总线
+	1:按顺序尝试 server 列表,连接失败时切换到下一个 server,一轮都失败后指数退避重试
+	2:定时 ping 检测连接,断开后重新连接并恢复所有订阅
+	3:nats.host 为 zk:// 地址时从 zk 读取 server 列表,列表变化且当前 server 被移除时重新连接
+	4:订阅 id 由 NatsClusterBus 分配,重连后保持不变
+**/
+type NatsClusterBus struct {
+	lock				sync.Mutex
+	servers				[]string
+	user				string
+	pass				string
+	pingInterval		time.Duration
+	minBackoff			time.Duration
+	maxBackoff			time.Duration
+
+	//创建 nats 客户端,测试时替换
+	newClient			func() yagnats.NATSClient
+	//当前连接,断开时为 nil
+	client				yagnats.NATSClient
+	server				string
+	//下次连接优先尝试的 server
+	next				int
+	//server 列表变化通知
+	changed				chan struct{}
+	discovery			*ZkDiscovery
+
+	seq					int64
+	subscriptions		map[int64]*natsSubscription
+
+	reconnects			int
+	lastError			string
+	since				time.Time
+
+	stop				chan struct{}
+	stopped				bool
+	logger				*steno.Logger
+}
+
+type natsSubscription struct {
+	subject				string
+	queue				string
+	callback			Callback
+	//当前连接上的订阅 id
+	sid					int64
+}
+
+func NewNatsClusterBus(c *config.Config) (*NatsClusterBus, error) {
+	b := &NatsClusterBus{
+		servers:		NatsServers(c),
+		user:			c.Nats.User,
+		pass:			c.Nats.Pass,
+		pingInterval:	time.Duration(c.Nats.PingIntervalSecond) * time.Second,
+		minBackoff:		time.Duration(c.Nats.BackoffMinMs) * time.Millisecond,
+		maxBackoff:		time.Duration(c.Nats.BackoffMaxSecond) * time.Second,
+		newClient:		func() yagnats.NATSClient { return yagnats.NewClient() },
+		subscriptions:	make(map[int64]*natsSubscription),
+		since:			time.Now(),
+		changed:		make(chan struct{}, 1),
+		stop:			make(chan struct{}),
+		logger:			steno.NewLogger("cc_helper"),
+	}
+
+	if len(c.Nats.Servers) == 0 && IsZkAddr(c.Nats.Host) {
+		discovery, err := NewZkDiscovery(c.Nats.Host, time.Duration(c.Nats.ZkSessionTimeoutSecond) * time.Second, b.minBackoff, b.maxBackoff)
+		if err != nil {
+			return nil, err
+		}
+		b.discovery = discovery
+	}
+	return b, nil
+}
+
+//nats server 列表,未配置 servers 时使用 host:port,zk 地址时返回 nil,由 zk 发现
+func NatsServers(c *config.Config) []string {
+	if len(c.Nats.Servers) > 0 {
+		return c.Nats.Servers
+	}
+	if IsZkAddr(c.Nats.Host) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s:%d", c.Nats.Host, c.Nats.Port)}
+}
+
+//连接 nats,失败时退避重试直到成功或者 Disconnect,连接成功后开始检测连接状态
+func (b *NatsClusterBus) Connect() error {
+	if b.discovery != nil {
+		go b.discovery.Watch(b.SetServers)
+	}
+	if err := b.reconnect(); err != nil {
+		return err
+	}
+	go b.monitor()
+	return nil
+}
+
+//依次尝试所有 server,全部失败后退避重试
+func (b *NatsClusterBus) reconnect() error {
+	backoff := b.minBackoff
+	for {
+		if b.connectOnce() {
+			return nil
+		}
+
+		b.lock.Lock()
+		b.logger.Warnf("could not connect to any nats server:%v, retry after %v", b.servers, backoff)
+		b.lock.Unlock()
+		select {
+		case <-b.stop:
+			return ErrClosed
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > b.maxBackoff {
+			backoff = b.maxBackoff
+		}
+	}
+}
+
+func (b *NatsClusterBus) connectOnce() bool {
+	b.lock.Lock()
+	start := b.next
+	servers := b.servers
+	b.lock.Unlock()
+
+	for i := 0; i < len(servers); i++ {
+		index := (start + i) % len(servers)
+		addr := servers[index]
+
+		client := b.newClient()
+		err := client.Connect(&yagnats.ConnectionInfo{
+			Addr:		addr,
+			Username:	b.user,
+			Password:	b.pass,
+		})
+		if err != nil {
+			b.logger.Errorf("could not connect to nats:%v, err:%v", addr, err)
+			b.lock.Lock()
+			b.lastError = err.Error()
+			b.lock.Unlock()
+			continue
+		}
+
+		b.lock.Lock()
+		if b.stopped {
+			b.lock.Unlock()
+			client.Disconnect()
+			return true
+		}
+		b.client = client
+		b.server = addr
+		b.next = index
+		b.since = time.Now()
+		b.resubscribe()
+		b.lock.Unlock()
+
+		b.logger.Infof("connected to nats:%v", addr)
+		return true
+	}
+	return false
+}
+
+//在新连接上恢复所有订阅,调用方持有锁
+func (b *NatsClusterBus) resubscribe() {
+	for id, s := range b.subscriptions {
+		sid, err := b.subscribe(s)
+		if err != nil {
+			b.logger.Errorf("resubscribe %v fail, id:%v, err:%v", s.subject, id, err)
+			continue
+		}
+		s.sid = sid
+	}
+}
+
+func (b *NatsClusterBus) subscribe(s *natsSubscription) (int64, error) {
+	if s.queue == "" {
+		return b.client.Subscribe(s.subject, wrapCallback(s.callback))
+	}
+	return b.client.SubscribeWithQueue(s.subject, s.queue, wrapCallback(s.callback))
+}
+
+//定时 ping,连接断开或当前 server 被移除后切换 server 重新连接
+func (b *NatsClusterBus) monitor() {
+	ticker := time.NewTicker(b.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		changed := false
+		select {
+		case <-b.stop:
+			return
+		case <-b.changed:
+			changed = true
+		case <-ticker.C:
+		}
+
+		b.lock.Lock()
+		client := b.client
+		server := b.server
+		servers := b.servers
+		b.lock.Unlock()
+
+		if client == nil {
+			continue
+		}
+
+		reason := ""
+		if changed {
+			if containsServer(servers, server) {
+				continue
+			}
+			reason = server + " removed from server list"
+		}else {
+			if client.Ping() {
+				continue
+			}
+			reason = "ping " + server + " fail"
+		}
+
+		b.lock.Lock()
+		b.logger.Warnf("nats connection to %v lost(%v), reconnecting", server, reason)
+		b.client = nil
+		b.lastError = reason
+		if !changed && len(b.servers) > 0 {
+			b.next = (b.next + 1) % len(b.servers)
+		}
+		b.since = time.Now()
+		b.lock.Unlock()
+		client.Disconnect()
+
+		if b.reconnect() != nil {
+			return
+		}
+		b.lock.Lock()
+		b.reconnects++
+		b.lock.Unlock()
+	}
+}
+
+//更新 server 列表,当前 server 不在新列表中时重新连接,空列表忽略
+func (b *NatsClusterBus) SetServers(servers []string) {
+	if len(servers) == 0 {
+		b.logger.Warn("nats server list is empty, keep the current list")
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if strings.Join(servers, ",") == strings.Join(b.servers, ",") {
+		return
+	}
+	b.logger.Infof("nats server list changed:%v -> %v", b.servers, servers)
+	b.servers = servers
+	b.next = 0
+
+	if b.client != nil && !containsServer(servers, b.server) {
+		select {
+		case b.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func containsServer(servers []string, server string) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+//断开时记录订阅,重连后生效
+func (b *NatsClusterBus) Subscribe(subject string, callback Callback) (int64, error) {
+	return b.SubscribeWithQueue(subject, "", callback)
+}
+
+func (b *NatsClusterBus) SubscribeWithQueue(subject string, queue string, callback Callback) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.stopped {
+		return 0, ErrClosed
+	}
+
+	s := &natsSubscription{subject: subject, queue: queue, callback: callback}
+	if b.client != nil {
+		sid, err := b.subscribe(s)
+		if err != nil {
+			return 0, err
+		}
+		s.sid = sid
+	}
+
+	b.seq++
+	b.subscriptions[b.seq] = s
+	return b.seq, nil
+}
+
+func (b *NatsClusterBus) Unsubscribe(sid int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s, ok := b.subscriptions[sid]
+	if !ok {
+		return nil
+	}
+	delete(b.subscriptions, sid)
+	if b.client != nil {
+		return b.client.Unsubscribe(s.sid)
+	}
+	return nil
+}
+
+func (b *NatsClusterBus) Publish(subject string, payload []byte) error {
+	client, err := b.current()
+	if err != nil {
+		return err
+	}
+	return client.Publish(subject, payload)
+}
+
+func (b *NatsClusterBus) PublishWithReplyTo(subject string, reply string, payload []byte) error {
+	client, err := b.current()
+	if err != nil {
+		return err
+	}
+	return client.PublishWithReplyTo(subject, reply, payload)
+}
+
+func (b *NatsClusterBus) Request(subject string, payload []byte, timeout time.Duration) (*Message, error) {
+	return request(b, subject, payload, timeout)
+}
+
+func (b *NatsClusterBus) current() (yagnats.NATSClient, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.stopped {
+		return nil, ErrClosed
+	}
+	if b.client == nil {
+		return nil, ErrDisconnected
+	}
+	return b.client, nil
+}
+
+//停止重连并断开连接
+func (b *NatsClusterBus) Disconnect() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.stopped {
+		return
+	}
+	b.stopped = true
+	close(b.stop)
+	if b.discovery != nil {
+		b.discovery.Close()
+	}
+	if b.client != nil {
+		b.client.Disconnect()
+		b.client = nil
+	}
+}
+
+//连接状态
+func (b *NatsClusterBus) Status() *Status {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return &Status{
+		Connected:		b.client != nil,
+		Server:			b.server,
+		Servers:		b.servers,
+		Since:			b.since,
+		Reconnects:		b.reconnects,
+		LastError:		b.lastError,
+		Subscriptions:	len(b.subscriptions),
+	}
+}
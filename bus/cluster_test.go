@@ -0,0 +1,221 @@
+package bus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"scheduler/config"
+)
+
+//等待条件成立,超时返回 false
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func newTestDiscovery(t *testing.T, f *fakeZk) *ZkDiscovery {
+	d, err := NewZkDiscovery("zk://zk1:2181,zk2:2181/nats/servers", time.Second, 10*time.Millisecond, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.dial = f.dial
+	return d
+}
+
+func TestParseZkAddr(t *testing.T) {
+	servers, path, err := ParseZkAddr("zk://zk1:2181,zk2:2181/nats/servers/")
+	if err != nil || !reflect.DeepEqual(servers, []string{"zk1:2181", "zk2:2181"}) || path != "/nats/servers" {
+		t.Fatalf("ParseZkAddr = %v, %q, %v", servers, path, err)
+	}
+	for _, addr := range []string{"nats://h:4222", "zk://h:2181", "zk://h:2181/", "zk:///path"} {
+		if _, _, err := ParseZkAddr(addr); err == nil {
+			t.Errorf("ParseZkAddr(%q) accepted", addr)
+		}
+	}
+}
+
+func TestZkDiscoveryWatch(t *testing.T) {
+	f := newFakeZk()
+	f.set("/nats/servers/n2", "10.0.0.2:4222")
+	f.set("/nats/servers/10.0.0.1:4222", "")
+	d := newTestDiscovery(t, f)
+
+	changes := make(chan []string, 10)
+	done := make(chan struct{})
+	go func() {
+		d.Watch(func(servers []string) { changes <- servers })
+		close(done)
+	}()
+
+	expect := func(servers ...string) {
+		select {
+		case got := <-changes:
+			if !reflect.DeepEqual(got, servers) {
+				t.Fatalf("servers = %v, expected %v", got, servers)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no server list, expected %v", servers)
+		}
+	}
+
+	//节点数据为空时使用节点名,结果排序
+	expect("10.0.0.1:4222", "10.0.0.2:4222")
+	f.set("/nats/servers/n3", "10.0.0.3:4222")
+	expect("10.0.0.1:4222", "10.0.0.2:4222", "10.0.0.3:4222")
+	f.remove("/nats/servers/n2")
+	expect("10.0.0.1:4222", "10.0.0.3:4222")
+
+	d.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return after Close")
+	}
+	if !f.closed {
+		t.Fatal("zk connection not closed")
+	}
+}
+
+func TestZkDiscoveryRetry(t *testing.T) {
+	f := newFakeZk()
+	f.failDials = 3
+	f.set("/nats/servers/n1", "10.0.0.1:4222")
+	d := newTestDiscovery(t, f)
+	defer d.Close()
+
+	changes := make(chan []string, 10)
+	go d.Watch(func(servers []string) { changes <- servers })
+
+	select {
+	case got := <-changes:
+		if !reflect.DeepEqual(got, []string{"10.0.0.1:4222"}) {
+			t.Fatalf("servers = %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("discovery did not recover from zk connection failures")
+	}
+	if f.dials != 4 {
+		t.Fatalf("dials = %v, expected 4", f.dials)
+	}
+}
+
+func newTestClusterBus(t *testing.T, f *fakeZk, n *fakeNats) *NatsClusterBus {
+	c := config.DefaultConfig()
+	c.Nats.Host = "zk://zk1:2181/nats/servers"
+	c.Nats.Servers = nil
+	c.Nats.PingIntervalSecond = 1
+	c.Nats.BackoffMinMs = 10
+	c.Nats.BackoffMaxSecond = 1
+	b, err := NewNatsClusterBus(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.discovery == nil {
+		t.Fatal("zk discovery not enabled for zk host")
+	}
+	b.discovery.dial = f.dial
+	b.newClient = n.newClient
+	return b
+}
+
+//zk 中 server 列表变化后切换到新的 server,并在新连接上恢复订阅
+func TestClusterBusFollowsZk(t *testing.T) {
+	f := newFakeZk()
+	n := newFakeNats()
+	f.set("/nats/servers/n1", "10.0.0.1:4222")
+	b := newTestClusterBus(t, f, n)
+	defer b.Disconnect()
+
+	received := make(chan string, 10)
+	if _, err := b.Subscribe("dea.advertise", func(m *Message) { received <- string(m.Payload) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Status(); !s.Connected || s.Server != "10.0.0.1:4222" {
+		t.Fatalf("status = %+v", s)
+	}
+
+	f.set("/nats/servers/n2", "10.0.0.2:4222")
+	f.remove("/nats/servers/n1")
+	if !waitFor(func() bool { s := b.Status(); return s.Connected && s.Server == "10.0.0.2:4222" }) {
+		t.Fatalf("bus did not move to the new server, status = %+v", b.Status())
+	}
+	if s := b.Status(); s.Reconnects != 1 || !reflect.DeepEqual(s.Servers, []string{"10.0.0.2:4222"}) {
+		t.Fatalf("status = %+v", s)
+	}
+
+	if err := b.Publish("dea.advertise", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-received:
+		if payload != "hello" {
+			t.Fatalf("payload = %q", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not restored after reconnect")
+	}
+}
+
+//当前 server 仍在列表中时不重新连接
+func TestClusterBusKeepsServer(t *testing.T) {
+	f := newFakeZk()
+	n := newFakeNats()
+	f.set("/nats/servers/n1", "10.0.0.1:4222")
+	b := newTestClusterBus(t, f, n)
+	defer b.Disconnect()
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.set("/nats/servers/n2", "10.0.0.2:4222")
+	if !waitFor(func() bool { return len(b.Status().Servers) == 2 }) {
+		t.Fatalf("server list not updated, status = %+v", b.Status())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := b.Status(); s.Server != "10.0.0.1:4222" || s.Reconnects != 0 {
+		t.Fatalf("status = %+v", s)
+	}
+
+	f.remove("/nats/servers/n1")
+	if !waitFor(func() bool { s := b.Status(); return len(s.Servers) == 1 && s.Server == "10.0.0.2:4222" }) {
+		t.Fatalf("bus did not move to the remaining server, status = %+v", b.Status())
+	}
+
+	//空列表不覆盖已有列表
+	f.remove("/nats/servers/n2")
+	time.Sleep(50 * time.Millisecond)
+	if s := b.Status(); len(s.Servers) != 1 || s.Servers[0] != "10.0.0.2:4222" {
+		t.Fatalf("status = %+v", s)
+	}
+}
+
+//ping 失败后切换到下一个 server
+func TestClusterBusFailover(t *testing.T) {
+	f := newFakeZk()
+	n := newFakeNats()
+	f.set("/nats/servers/n1", "10.0.0.1:4222")
+	f.set("/nats/servers/n2", "10.0.0.2:4222")
+	b := newTestClusterBus(t, f, n)
+	defer b.Disconnect()
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	first := b.Status().Server
+
+	n.setDown(first, true)
+	if !waitFor(func() bool { s := b.Status(); return s.Connected && s.Server != first }) {
+		t.Fatalf("bus did not fail over, status = %+v", b.Status())
+	}
+	if s := b.Status(); s.Reconnects != 1 || s.LastError == "" {
+		t.Fatalf("status = %+v", s)
+	}
+}
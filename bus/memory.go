@@ -0,0 +1,116 @@
+package bus
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//进程内消息总线,消息在 Publish 调用中同步投递给订阅者
+type MemoryBus struct {
+	lock				sync.Mutex
+	seq					int64
+	subscriptions		map[int64]*memorySubscription
+	closed				bool
+	since				time.Time
+}
+
+type memorySubscription struct {
+	subject				string
+	queue				string
+	callback			Callback
+}
+
+//创建进程内消息总线
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subscriptions: make(map[int64]*memorySubscription), since: time.Now()}
+}
+
+func (b *MemoryBus) Subscribe(subject string, callback Callback) (int64, error) {
+	return b.SubscribeWithQueue(subject, "", callback)
+}
+
+func (b *MemoryBus) SubscribeWithQueue(subject string, queue string, callback Callback) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return 0, ErrClosed
+	}
+	b.seq++
+	b.subscriptions[b.seq] = &memorySubscription{subject: subject, queue: queue, callback: callback}
+	return b.seq, nil
+}
+
+func (b *MemoryBus) Unsubscribe(sid int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.subscriptions, sid)
+	return nil
+}
+
+func (b *MemoryBus) Publish(subject string, payload []byte) error {
+	return b.PublishWithReplyTo(subject, "", payload)
+}
+
+//同一个 queue 的订阅者随机选择一个投递,其他订阅者全部投递
+func (b *MemoryBus) PublishWithReplyTo(subject string, reply string, payload []byte) error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return ErrClosed
+	}
+
+	callbacks := []Callback{}
+	queues := make(map[string][]Callback)
+	for _, s := range b.subscriptions {
+		if !MatchSubject(s.subject, subject) {
+			continue
+		}
+		if s.queue == "" {
+			callbacks = append(callbacks, s.callback)
+		}else {
+			queues[s.queue] = append(queues[s.queue], s.callback)
+		}
+	}
+	b.lock.Unlock()
+
+	for _, members := range queues {
+		callbacks = append(callbacks, members[rand.Intn(len(members))])
+	}
+
+	//回调中可能再次发布消息,不能持有锁
+	for _, callback := range callbacks {
+		data := make([]byte, len(payload))
+		copy(data, payload)
+		callback(&Message{Subject: subject, ReplyTo: reply, Payload: data})
+	}
+	return nil
+}
+
+func (b *MemoryBus) Request(subject string, payload []byte, timeout time.Duration) (*Message, error) {
+	return request(b, subject, payload, timeout)
+}
+
+func (b *MemoryBus) Disconnect() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	b.subscriptions = make(map[int64]*memorySubscription)
+}
+
+//连接状态
+func (b *MemoryBus) Status() *Status {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return &Status{
+		Connected:		!b.closed,
+		Server:			"memory",
+		Servers:		[]string{"memory"},
+		Since:			b.since,
+		Subscriptions:	len(b.subscriptions),
+	}
+}
@@ -0,0 +1,139 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBusSubscribe(t *testing.T) {
+	b := NewMemoryBus()
+	var got []*Message
+	if _, err := b.Subscribe("dea.advertise", func(m *Message) { got = append(got, m) }); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	b.Publish("dea.advertise", []byte("a"))
+	b.Publish("dea.heartbeat", []byte("b"))
+	if len(got) != 1 || got[0].Subject != "dea.advertise" || string(got[0].Payload) != "a" {
+		t.Fatalf("unexpected messages: %v", got)
+	}
+}
+
+func TestMemoryBusPayloadCopied(t *testing.T) {
+	b := NewMemoryBus()
+	var got []byte
+	b.Subscribe("x", func(m *Message) { got = m.Payload })
+
+	payload := []byte("abc")
+	b.Publish("x", payload)
+	payload[0] = 'z'
+	if string(got) != "abc" {
+		t.Fatalf("subscriber shares publisher buffer: %q", got)
+	}
+}
+
+func TestMemoryBusWildcards(t *testing.T) {
+	b := NewMemoryBus()
+	counts := map[string]int{}
+	b.Subscribe("jae.*", func(m *Message) { counts["*"]++ })
+	b.Subscribe("jae.>", func(m *Message) { counts[">"]++ })
+
+	b.Publish("jae.deleted", nil)
+	b.Publish("jae.staging.success", nil)
+	b.Publish("jae", nil)
+	if counts["*"] != 1 || counts[">"] != 2 {
+		t.Fatalf("unexpected wildcard deliveries: %v", counts)
+	}
+}
+
+func TestMemoryBusQueueGroup(t *testing.T) {
+	b := NewMemoryBus()
+	queued, plain := 0, 0
+	for i := 0; i < 3; i++ {
+		b.SubscribeWithQueue("jae.deleted", "scheduler", func(m *Message) { queued++ })
+	}
+	b.Subscribe("jae.deleted", func(m *Message) { plain++ })
+
+	for i := 0; i < 10; i++ {
+		b.Publish("jae.deleted", nil)
+	}
+	if queued != 10 {
+		t.Fatalf("queue group received %v messages, want 10", queued)
+	}
+	if plain != 10 {
+		t.Fatalf("plain subscriber received %v messages, want 10", plain)
+	}
+}
+
+func TestMemoryBusUnsubscribe(t *testing.T) {
+	b := NewMemoryBus()
+	count := 0
+	sid, _ := b.Subscribe("x", func(m *Message) { count++ })
+	b.Publish("x", nil)
+	if err := b.Unsubscribe(sid); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	b.Publish("x", nil)
+	if count != 1 {
+		t.Fatalf("received %v messages after unsubscribe, want 1", count)
+	}
+	if n := b.Status().Subscriptions; n != 0 {
+		t.Fatalf("status reports %v subscriptions", n)
+	}
+}
+
+func TestMemoryBusRequest(t *testing.T) {
+	b := NewMemoryBus()
+	b.Subscribe("scheduler.ping", func(m *Message) {
+		b.Publish(m.ReplyTo, append([]byte("pong:"), m.Payload...))
+	})
+
+	reply, err := b.Request("scheduler.ping", []byte("1"), time.Second)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if string(reply.Payload) != "pong:1" {
+		t.Fatalf("unexpected reply %q", reply.Payload)
+	}
+
+	if _, err := b.Request("nobody", nil, 10*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("request without responder: %v", err)
+	}
+}
+
+func TestMemoryBusDisconnect(t *testing.T) {
+	b := NewMemoryBus()
+	b.Subscribe("x", func(m *Message) { t.Fatalf("delivered after disconnect") })
+	b.Disconnect()
+
+	if err := b.Publish("x", nil); err != ErrClosed {
+		t.Fatalf("publish after disconnect: %v", err)
+	}
+	if _, err := b.Subscribe("x", func(m *Message) {}); err != ErrClosed {
+		t.Fatalf("subscribe after disconnect: %v", err)
+	}
+	if b.Status().Connected {
+		t.Fatalf("status still connected")
+	}
+}
+
+func TestMatchSubject(t *testing.T) {
+	cases := []struct {
+		pattern, subject	string
+		match				bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{"*.b", "a.b", true},
+		{"a.b.c", "a.b", false},
+	}
+	for _, c := range cases {
+		if got := MatchSubject(c.pattern, c.subject); got != c.match {
+			t.Errorf("MatchSubject(%q, %q) = %v, want %v", c.pattern, c.subject, got, c.match)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package bus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+	"github.com/cloudfoundry/yagnats"
+)
+
+//基于 yagnats 的消息总线
+type NatsBus struct {
+	client				yagnats.NATSClient
+}
+
+//包装 yagnats 客户端,调用方负责 Connect
+func NewNatsBus(client yagnats.NATSClient) *NatsBus {
+	return &NatsBus{client: client}
+}
+
+//返回 yagnats 客户端
+func (b *NatsBus) Client() yagnats.NATSClient {
+	return b.client
+}
+
+func (b *NatsBus) Subscribe(subject string, callback Callback) (int64, error) {
+	return b.client.Subscribe(subject, wrapCallback(callback))
+}
+
+func (b *NatsBus) SubscribeWithQueue(subject string, queue string, callback Callback) (int64, error) {
+	return b.client.SubscribeWithQueue(subject, queue, wrapCallback(callback))
+}
+
+func (b *NatsBus) Unsubscribe(sid int64) error {
+	return b.client.Unsubscribe(sid)
+}
+
+func (b *NatsBus) Publish(subject string, payload []byte) error {
+	return b.client.Publish(subject, payload)
+}
+
+func (b *NatsBus) PublishWithReplyTo(subject string, reply string, payload []byte) error {
+	return b.client.PublishWithReplyTo(subject, reply, payload)
+}
+
+func (b *NatsBus) Request(subject string, payload []byte, timeout time.Duration) (*Message, error) {
+	return request(b, subject, payload, timeout)
+}
+
+func (b *NatsBus) Disconnect() {
+	b.client.Disconnect()
+}
+
+func wrapCallback(callback Callback) yagnats.Callback {
+	return func(m *yagnats.Message) {
+		callback(&Message{Subject: m.Subject, ReplyTo: m.ReplyTo, Payload: m.Payload})
+	}
+}
+
+//通过临时 inbox 实现 request/reply
+func request(b MessageBus, subject string, payload []byte, timeout time.Duration) (*Message, error) {
+	inbox := newInbox()
+	replies := make(chan *Message, 1)
+
+	sid, err := b.Subscribe(inbox, func(m *Message) {
+		select {
+		case replies <- m:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer b.Unsubscribe(sid)
+
+	if err := b.PublishWithReplyTo(subject, inbox, payload); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-replies:
+		return m, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+//生成唯一的应答 subject
+func newInbox() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "_INBOX." + hex.EncodeToString(b)
+}
@@ -0,0 +1,225 @@
+package bus
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"github.com/cloudfoundry/yagnats"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+//进程内的 zk,只支持 ZkDiscovery 用到的子节点读取和子节点 watch
+type fakeZk struct {
+	lock				sync.Mutex
+	//节点路径 -> 数据
+	nodes				map[string]string
+	watches				map[string][]chan zk.Event
+	//前 failDials 次连接失败
+	failDials			int
+	dials				int
+	closed				bool
+}
+
+func newFakeZk() *fakeZk {
+	return &fakeZk{nodes: make(map[string]string), watches: make(map[string][]chan zk.Event)}
+}
+
+func (f *fakeZk) dial(servers []string, sessionTimeout time.Duration) (zkConn, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.dials++
+	if f.dials <= f.failDials {
+		return nil, errors.New("zk connection refused")
+	}
+	return f, nil
+}
+
+//设置子节点并触发父节点的 watch
+func (f *fakeZk) set(path string, data string) {
+	f.lock.Lock()
+	_, found := f.nodes[path]
+	f.nodes[path] = data
+	f.lock.Unlock()
+	if !found {
+		f.fire(parentPath(path))
+	}
+}
+
+func (f *fakeZk) remove(path string) {
+	f.lock.Lock()
+	delete(f.nodes, path)
+	f.lock.Unlock()
+	f.fire(parentPath(path))
+}
+
+func (f *fakeZk) fire(parent string) {
+	f.lock.Lock()
+	watches := f.watches[parent]
+	delete(f.watches, parent)
+	f.lock.Unlock()
+
+	for _, w := range watches {
+		w <- zk.Event{Path: parent}
+	}
+}
+
+func parentPath(path string) string {
+	return path[:strings.LastIndex(path, "/")]
+}
+
+func (f *fakeZk) ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	children := []string{}
+	for node := range f.nodes {
+		if parentPath(node) == path {
+			children = append(children, node[len(path)+1:])
+		}
+	}
+	//与 zk 一样,watch 只触发一次
+	w := make(chan zk.Event, 1)
+	f.watches[path] = append(f.watches[path], w)
+	return children, &zk.Stat{}, w, nil
+}
+
+func (f *fakeZk) Get(path string) ([]byte, *zk.Stat, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, found := f.nodes[path]
+	if !found {
+		return nil, nil, errors.New("zk: node does not exist")
+	}
+	return []byte(data), &zk.Stat{}, nil
+}
+
+func (f *fakeZk) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+}
+
+//进程内的 nats server 集合,记录每个 server 是否可以连接
+type fakeNats struct {
+	lock				sync.Mutex
+	down				map[string]bool
+	clients				[]*fakeNatsClient
+}
+
+func newFakeNats() *fakeNats {
+	return &fakeNats{down: make(map[string]bool)}
+}
+
+func (n *fakeNats) newClient() yagnats.NATSClient {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	c := &fakeNatsClient{network: n, subscriptions: make(map[int64]*yagnatsSubscription)}
+	n.clients = append(n.clients, c)
+	return c
+}
+
+func (n *fakeNats) setDown(addr string, down bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.down[addr] = down
+}
+
+func (n *fakeNats) isDown(addr string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.down[addr]
+}
+
+type yagnatsSubscription struct {
+	subject				string
+	callback			yagnats.Callback
+}
+
+type fakeNatsClient struct {
+	network				*fakeNats
+	lock				sync.Mutex
+	addr				string
+	connected			bool
+	seq					int64
+	subscriptions		map[int64]*yagnatsSubscription
+}
+
+func (c *fakeNatsClient) Connect(provider yagnats.ConnectionProvider) error {
+	info := provider.(*yagnats.ConnectionInfo)
+	if c.network.isDown(info.Addr) {
+		return errors.New("connection refused: " + info.Addr)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.addr = info.Addr
+	c.connected = true
+	return nil
+}
+
+func (c *fakeNatsClient) Ping() bool {
+	c.lock.Lock()
+	addr, connected := c.addr, c.connected
+	c.lock.Unlock()
+	return connected && !c.network.isDown(addr)
+}
+
+func (c *fakeNatsClient) Disconnect() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connected = false
+}
+
+//消息投递给同一个 server 上所有已连接客户端的订阅
+func (c *fakeNatsClient) Publish(subject string, payload []byte) error {
+	return c.PublishWithReplyTo(subject, "", payload)
+}
+
+func (c *fakeNatsClient) PublishWithReplyTo(subject, reply string, payload []byte) error {
+	c.network.lock.Lock()
+	clients := append([]*fakeNatsClient{}, c.network.clients...)
+	c.network.lock.Unlock()
+
+	for _, other := range clients {
+		other.lock.Lock()
+		callbacks := []yagnats.Callback{}
+		if other.connected && other.addr == c.addr {
+			for _, s := range other.subscriptions {
+				if MatchSubject(s.subject, subject) {
+					callbacks = append(callbacks, s.callback)
+				}
+			}
+		}
+		other.lock.Unlock()
+		for _, callback := range callbacks {
+			callback(&yagnats.Message{Subject: subject, ReplyTo: reply, Payload: payload})
+		}
+	}
+	return nil
+}
+
+func (c *fakeNatsClient) Subscribe(subject string, callback yagnats.Callback) (int64, error) {
+	return c.SubscribeWithQueue(subject, "", callback)
+}
+
+func (c *fakeNatsClient) SubscribeWithQueue(subject, queue string, callback yagnats.Callback) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	c.subscriptions[c.seq] = &yagnatsSubscription{subject: subject, callback: callback}
+	return c.seq, nil
+}
+
+func (c *fakeNatsClient) Unsubscribe(sid int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.subscriptions, sid)
+	return nil
+}
+
+func (c *fakeNatsClient) UnsubscribeAll(subject string) {}
+
+func (c *fakeNatsClient) BeforeConnectCallback(callback func()) {}
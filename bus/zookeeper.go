@@ -0,0 +1,177 @@
+package bus
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	steno "github.com/cloudfoundry/gosteno"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const zkScheme = "zk://"
+
+//是否是 zk 地址
+func IsZkAddr(addr string) bool {
+	return strings.HasPrefix(addr, zkScheme)
+}
+
+//解析 zk://host1:2181,host2:2181/path,返回 zk server 列表和节点路径
+func ParseZkAddr(addr string) ([]string, string, error) {
+	if !IsZkAddr(addr) {
+		return nil, "", errors.New("not a zk address:" + addr)
+	}
+	rest := strings.TrimPrefix(addr, zkScheme)
+	i := strings.Index(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return nil, "", errors.New("zk address must be zk://host:port[,host:port]/path:" + addr)
+	}
+	return strings.Split(rest[:i], ","), strings.TrimRight(rest[i:], "/"), nil
+}
+
+//ZkDiscovery 使用的 zk 连接操作
+type zkConn interface {
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Close()
+}
+
+func dialZk(servers []string, sessionTimeout time.Duration) (zkConn, error) {
+	conn, _, err := zk.Connect(servers, sessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+/**
+	从 zk 读取 nats server 列表
+	path 下每个子节点代表一个 nats server,节点数据为 host:port,数据为空时使用节点名
+	监听子节点变化,变化后重新读取并通知
+**/
+type ZkDiscovery struct {
+	zkServers			[]string
+	path				string
+	sessionTimeout		time.Duration
+	minBackoff			time.Duration
+	maxBackoff			time.Duration
+
+	//建立 zk 连接,测试时替换
+	dial				func(servers []string, sessionTimeout time.Duration) (zkConn, error)
+
+	lock				sync.Mutex
+	conn				zkConn
+	stop				chan struct{}
+	stopped				bool
+	logger				*steno.Logger
+}
+
+func NewZkDiscovery(addr string, sessionTimeout time.Duration, minBackoff time.Duration, maxBackoff time.Duration) (*ZkDiscovery, error) {
+	servers, path, err := ParseZkAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &ZkDiscovery{
+		zkServers:		servers,
+		path:			path,
+		sessionTimeout:	sessionTimeout,
+		minBackoff:		minBackoff,
+		maxBackoff:		maxBackoff,
+		dial:			dialZk,
+		stop:			make(chan struct{}),
+		logger:			steno.NewLogger("cc_helper"),
+	}, nil
+}
+
+//读取 nats server 列表,返回子节点变化的 watch
+func (d *ZkDiscovery) Servers() ([]string, <-chan zk.Event, error) {
+	conn, err := d.connection()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	children, _, events, err := conn.ChildrenW(d.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	servers := make([]string, 0, len(children))
+	for _, child := range children {
+		data, _, err := conn.Get(d.path + "/" + child)
+		if err != nil {
+			//节点可能已经被删除,下次变化时重新读取
+			d.logger.Warnf("read zk node %v/%v fail, err:%v", d.path, child, err)
+			continue
+		}
+		addr := strings.TrimSpace(string(data))
+		if addr == "" {
+			addr = child
+		}
+		servers = append(servers, addr)
+	}
+	sort.Strings(servers)
+	return servers, events, nil
+}
+
+func (d *ZkDiscovery) connection() (zkConn, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.stopped {
+		return nil, ErrClosed
+	}
+	if d.conn == nil {
+		//连接断开后 zk 客户端会自动重连
+		conn, err := d.dial(d.zkServers, d.sessionTimeout)
+		if err != nil {
+			return nil, err
+		}
+		d.conn = conn
+	}
+	return d.conn, nil
+}
+
+//读取 server 列表并监听变化,每次读取成功后调用 onChange,读取失败时退避重试,直到 Close
+func (d *ZkDiscovery) Watch(onChange func([]string)) {
+	backoff := d.minBackoff
+	for {
+		servers, events, err := d.Servers()
+		if err != nil {
+			d.logger.Errorf("discover nats servers from zk:%v%v fail, retry after %v, err:%v", d.zkServers, d.path, backoff, err)
+			select {
+			case <-d.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > d.maxBackoff {
+				backoff = d.maxBackoff
+			}
+			continue
+		}
+
+		backoff = d.minBackoff
+		onChange(servers)
+
+		select {
+		case <-d.stop:
+			return
+		case <-events:
+		}
+	}
+}
+
+func (d *ZkDiscovery) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.stopped {
+		return
+	}
+	d.stopped = true
+	close(d.stop)
+	if d.conn != nil {
+		d.conn.Close()
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//调用 scheduler controller 接口的客户端
+type client struct {
+	api				string
+	token			string
+	http			*http.Client
+}
+
+//接口返回的错误信息
+type apiError struct {
+	Status			int
+	Kind			string				`json:"error"`
+	Message			string				`json:"message"`
+	RequestId		string				`json:"request_id"`
+	Details			json.RawMessage		`json:"details"`
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%d %s: %s", e.Status, e.Kind, e.Message)
+	if len(e.Details) > 0 && string(e.Details) != "null" {
+		msg += " " + string(e.Details)
+	}
+	if e.RequestId != "" {
+		msg += " (request_id " + e.RequestId + ")"
+	}
+	return msg
+}
+
+//创建客户端,配置了证书时使用 mTLS
+func newClient(api string, token string, certFile string, keyFile string, caFile string, timeout time.Duration) (*client, error) {
+	tlsConfig := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate found in ca file:" + caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &client{
+		api:	strings.TrimRight(api, "/"),
+		token:	token,
+		http:	&http.Client{
+			Timeout:	timeout,
+			Transport:	&http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+//发送请求,返回成功的响应,调用方负责关闭 Body
+func (c *client) do(method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = strings.NewReader(string(data))
+	}
+
+	req, err := http.NewRequest(method, c.api+"/scheduler"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	e := &apiError{Status: resp.StatusCode, Kind: http.StatusText(resp.StatusCode)}
+	if method != "HEAD" {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(data, e) != nil {
+			e.Message = strings.TrimSpace(string(data))
+		}
+	}
+	if e.RequestId == "" {
+		e.RequestId = resp.Header.Get("X-Request-Id")
+	}
+	return nil, e
+}
+
+//发送请求并解析 json 返回值
+func (c *client) getJson(method string, path string, body interface{}, v interface{}) error {
+	resp, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	//204 等没有返回数据的请求
+	if v == nil || len(data) == 0 {
+		return nil
+	}
+	return decodeJson(data, v)
+}
+
+//解析 json,兼容缓存列表接口返回的 base64 字符串(接口把 json 数据编码成了 []byte)
+func decodeJson(data []byte, v interface{}) error {
+	var encoded string
+	if json.Unmarshal(data, &encoded) == nil {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			data = decoded
+		}
+	}
+	return json.Unmarshal(data, v)
+}
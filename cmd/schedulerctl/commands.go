@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"scheduler/deapool"
+	"scheduler/util"
+)
+
+//缓存列表中的数据
+type cacheEntry struct {
+	AppGuid					string
+	Digest					string
+	CachePath				string
+	TimeOfLastUpdate		time.Time
+}
+
+//artifact 类型对应的接口路径
+var artifactPaths = map[string]string{
+	"droplet":		"/droplet/",
+	"package":		"/packages/",
+	"buildpack":	"/buildpackCache/",
+}
+
+//解析子命令参数,返回剩余的位置参数
+func parseFlags(fs *flag.FlagSet, args []string, positional int) ([]string, error) {
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != positional {
+		return nil, fmt.Errorf("expected %d argument(s), got %d", positional, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+//输出 json
+func printJson(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+//输出表格
+func printTable(header []string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+//格式化字节数
+func formatBytes(b int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	v := float64(b)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", b, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", v, units[i])
+}
+
+//格式化 MB
+func formatMb(mb int) string {
+	return formatBytes(int64(mb) * 1024 * 1024)
+}
+
+func yes(b bool) string {
+	if b {
+		return "yes"
+	}
+	return ""
+}
+
+//dea 状态
+func deaState(d *deapool.DeaView) string {
+	switch {
+	case d.Stale:
+		return "stale"
+	case d.Cordoned:
+		return "cordoned"
+	}
+	return "ok"
+}
+
+//应用实例总数
+func instanceCount(apps map[string]int) int {
+	count := 0
+	for _, n := range apps {
+		count += n
+	}
+	return count
+}
+
+//查询 dea 池
+func queryDeas(ctx *cmdContext, params url.Values) (*deapool.DeaQueryResult, error) {
+	if params.Get("limit") == "" {
+		params.Set("limit", strconv.Itoa(deapool.MaxQueryLimit))
+	}
+	var result deapool.DeaQueryResult
+	if err := ctx.client.getJson("GET", "/deapool?"+params.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+//查找指定 dea
+func findDea(ctx *cmdContext, id string) (*deapool.DeaView, error) {
+	result, err := queryDeas(ctx, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range result.Deas {
+		if d.Id == id {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("dea %s not found", id)
+}
+
+func listDeas(ctx *cmdContext, args []string) error {
+	fs := flag.NewFlagSet("deas", flag.ContinueOnError)
+	stack := fs.String("stack", "", "only DEAs with this stack")
+	docker := fs.String("docker", "", "true|false, filter by docker_vm")
+	zone := fs.String("zone", "", "only DEAs in this zone")
+	app := fs.String("app", "", "only DEAs running this app")
+	stale := fs.String("stale", "", "true|false, filter by staleness")
+	minMemory := fs.Int("min-memory", 0, "minimum available memory (MB)")
+	sortBy := fs.String("sort", "", "id|memory|-memory|disk|-disk")
+	limit := fs.Int("limit", 0, "max DEAs to return")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	set := func(k string, v string) {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	set("stack", *stack)
+	set("docker_vm", *docker)
+	set("zone", *zone)
+	set("app_id", *app)
+	set("stale", *stale)
+	set("sort", *sortBy)
+	if *minMemory > 0 {
+		params.Set("min_memory", strconv.Itoa(*minMemory))
+	}
+	if *limit > 0 {
+		params.Set("limit", strconv.Itoa(*limit))
+	}
+
+	result, err := queryDeas(ctx, params)
+	if err != nil {
+		return err
+	}
+	if ctx.json {
+		return printJson(result)
+	}
+
+	rows := [][]string{}
+	for _, d := range result.Deas {
+		rows = append(rows, []string{d.Id, d.Zone, strings.Join(d.Stacks, ","), yes(d.DockerVm), formatMb(d.AvailableMemory), formatMb(d.AvailableDisk), strconv.Itoa(len(d.AppIdToCount)), deaState(d)})
+	}
+	printTable([]string{"ID", "ZONE", "STACKS", "DOCKER", "MEMORY", "DISK", "APPS", "STATE"}, rows)
+
+	stacks := []string{}
+	for s := range result.Stacks {
+		stacks = append(stacks, s)
+	}
+	sort.Strings(stacks)
+	rows = [][]string{}
+	for _, s := range stacks {
+		c := result.Stacks[s]
+		row := []string{s, strconv.Itoa(c.DeaCount), formatMb(c.AvailableMemory), formatMb(c.AvailableDisk)}
+		if *minMemory > 0 {
+			row = append(row, strconv.Itoa(c.Slots))
+		}
+		rows = append(rows, row)
+	}
+	header := []string{"STACK", "DEAS", "MEMORY", "DISK"}
+	if *minMemory > 0 {
+		header = append(header, fmt.Sprintf("SLOTS(%s)", formatMb(*minMemory)))
+	}
+	fmt.Printf("\n%d DEA(s)\n", result.Total)
+	printTable(header, rows)
+	return nil
+}
+
+func describeDea(ctx *cmdContext, args []string) error {
+	fs := flag.NewFlagSet("dea", flag.ContinueOnError)
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	d, err := findDea(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	if ctx.json {
+		return printJson(d)
+	}
+
+	fmt.Printf("ID:           %s\n", d.Id)
+	fmt.Printf("Zone:         %s\n", d.Zone)
+	fmt.Printf("Stacks:       %s\n", strings.Join(d.Stacks, ","))
+	fmt.Printf("Docker:       %v\n", d.DockerVm)
+	fmt.Printf("Memory:       %s\n", formatMb(d.AvailableMemory))
+	fmt.Printf("Disk:         %s\n", formatMb(d.AvailableDisk))
+	fmt.Printf("State:        %s\n", deaState(d))
+	fmt.Printf("Last update:  %s\n", d.TimeOfLastUpdate.Format(time.RFC3339))
+	fmt.Printf("Instances:    %d\n\n", instanceCount(d.AppIdToCount))
+
+	apps := []string{}
+	for app := range d.AppIdToCount {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	rows := [][]string{}
+	for _, app := range apps {
+		rows = append(rows, []string{app, strconv.Itoa(d.AppIdToCount[app])})
+	}
+	printTable([]string{"APP", "INSTANCES"}, rows)
+	return nil
+}
+
+//暂停/恢复 dea 调度
+func setCordon(ctx *cmdContext, args []string, cordon bool) error {
+	fs := flag.NewFlagSet("cordon", flag.ContinueOnError)
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	method := "PUT"
+	if !cordon {
+		method = "DELETE"
+	}
+	var result map[string]interface{}
+	if err := ctx.client.getJson(method, "/deapool/"+url.PathEscape(pos[0])+"/cordon", nil, &result); err != nil {
+		return err
+	}
+	if ctx.json {
+		return printJson(result)
+	}
+	if cordon {
+		fmt.Printf("dea %s cordoned\n", pos[0])
+	}else {
+		fmt.Printf("dea %s uncordoned\n", pos[0])
+	}
+	return nil
+}
+
+func cordonDea(ctx *cmdContext, args []string) error {
+	return setCordon(ctx, args, true)
+}
+
+func uncordonDea(ctx *cmdContext, args []string) error {
+	return setCordon(ctx, args, false)
+}
+
+//暂停 dea 调度并等待 dea 上的应用实例全部迁走(实例由 cloud controller/dea 负责迁移)
+func drainDea(ctx *cmdContext, args []string) error {
+	fs := flag.NewFlagSet("drain", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 30*time.Minute, "max time to wait")
+	interval := fs.Duration("interval", 10*time.Second, "poll interval")
+	pos, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	id := pos[0]
+
+	if err := ctx.client.getJson("PUT", "/deapool/"+url.PathEscape(id)+"/cordon", nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("dea %s cordoned, waiting for app instances to leave\n", id)
+
+	deadline := time.Now().Add(*timeout)
+	for {
+		d, err := findDea(ctx, id)
+		if err != nil {
+			return err
+		}
+		count := instanceCount(d.AppIdToCount)
+		if count == 0 {
+			fmt.Printf("dea %s drained\n", id)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout, dea %s still runs %d instance(s) of %d app(s)", id, count, len(d.AppIdToCount))
+		}
+		fmt.Printf("%s  %d instance(s) of %d app(s) remaining\n", time.Now().Format("15:04:05"), count, len(d.AppIdToCount))
+		time.Sleep(*interval)
+	}
+}
+
+func explainPlacement(ctx *cmdContext, args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	msg := &deapool.FindDeaMessage{}
+	fs.StringVar(&msg.AppId, "app", "", "app id")
+	fs.IntVar(&msg.Memory, "memory", 0, "required memory (MB)")
+	fs.IntVar(&msg.Disk, "disk", 0, "required disk (MB)")
+	fs.StringVar(&msg.Stacks, "stack", "", "required stack")
+	fs.BoolVar(&msg.Docker, "docker", false, "require a docker DEA")
+	fs.BoolVar(&msg.OwnerApp, "owner", false, "only DEAs running the app")
+	fs.BoolVar(&msg.OtherDea, "other", false, "exclude DEAs running the app")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	var result deapool.PlacementExplanation
+	if err := ctx.client.getJson("POST", "/v2/placements/explain", msg, &result); err != nil {
+		return err
+	}
+	if ctx.json {
+		return printJson(&result)
+	}
+
+	fmt.Printf("%d candidate DEA(s)\n", result.Candidates)
+	reasons := []string{}
+	for r := range result.Rejected {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	for _, r := range reasons {
+		fmt.Printf("  rejected %-22s %d\n", r+":", result.Rejected[r])
+	}
+	fmt.Println()
+
+	rows := [][]string{}
+	for _, d := range result.Deas {
+		verdict := "eligible"
+		if !d.Eligible {
+			verdict = d.Reason
+		}
+		rows = append(rows, []string{d.DeaId, formatMb(d.AvailableMemory), formatMb(d.AvailableDisk), verdict})
+	}
+	printTable([]string{"DEA", "MEMORY", "DISK", "VERDICT"}, rows)
+	return nil
+}
+
+//列出缓存中的数据
+func listCache(ctx *cmdContext, args []string, path string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	entries := map[string]*cacheEntry{}
+	if err := ctx.client.getJson("GET", path, nil, &entries); err != nil {
+		return err
+	}
+	if ctx.json {
+		return printJson(entries)
+	}
+
+	guids := []string{}
+	for guid := range entries {
+		guids = append(guids, guid)
+	}
+	sort.Strings(guids)
+	rows := [][]string{}
+	for _, guid := range guids {
+		e := entries[guid]
+		rows = append(rows, []string{guid, e.Digest, e.CachePath, e.TimeOfLastUpdate.Format(time.RFC3339)})
+	}
+	printTable([]string{"GUID", "DIGEST", "PATH", "LAST ACCESS"}, rows)
+	return nil
+}
+
+func listDroplets(ctx *cmdContext, args []string) error {
+	return listCache(ctx, args, "/droplets")
+}
+
+func listPackages(ctx *cmdContext, args []string) error {
+	return listCache(ctx, args, "/packages")
+}
+
+func listBuildpacks(ctx *cmdContext, args []string) error {
+	return listCache(ctx, args, "/buildpackcache")
+}
+
+//解析 artifact 类型和 guid
+func artifactPath(ctx *cmdContext, args []string) (string, string, error) {
+	fs := flag.NewFlagSet("artifact", flag.ContinueOnError)
+	pos, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return "", "", err
+	}
+	prefix, found := artifactPaths[pos[0]]
+	if !found {
+		return "", "", errors.New("artifact type must be droplet, package or buildpack")
+	}
+	return prefix + url.PathEscape(pos[1]), pos[1], nil
+}
+
+func inspectArtifact(ctx *cmdContext, args []string) error {
+	path, guid, err := artifactPath(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ctx.client.do("HEAD", path, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	size, _ := strconv.ParseInt(resp.Header.Get("X-Artifact-Size"), 10, 64)
+	info := &util.ArtifactInfo{
+		Guid:		guid,
+		Digest:		resp.Header.Get("X-Artifact-Digest"),
+		Size:		size,
+		Location:	resp.Header.Get("X-Cache-Location"),
+		Path:		resp.Header.Get("X-Cache-Path"),
+	}
+	if ctx.json {
+		return printJson(info)
+	}
+
+	fmt.Printf("GUID:      %s\n", info.Guid)
+	fmt.Printf("Digest:    %s\n", info.Digest)
+	fmt.Printf("Size:      %s (%d bytes)\n", formatBytes(info.Size), info.Size)
+	fmt.Printf("Location:  %s\n", info.Location)
+	if info.Path != "" {
+		fmt.Printf("Path:      %s\n", info.Path)
+	}
+	return nil
+}
+
+func deleteArtifact(ctx *cmdContext, args []string) error {
+	path, guid, err := artifactPath(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	//jss 删除在后台执行时返回 pending 状态
+	var result struct {
+		State		string				`json:"state"`
+		Deletions	[]json.RawMessage	`json:"deletions"`
+	}
+	if err := ctx.client.getJson("DELETE", path, nil, &result); err != nil {
+		return err
+	}
+	pending := result.State == "pending"
+	if ctx.json {
+		return printJson(map[string]interface{}{"guid": guid, "deleted": !pending, "pending": pending})
+	}
+	if pending {
+		fmt.Printf("%s %s deleted from cache, %d jss deletions pending\n", args[0], guid, len(result.Deletions))
+		return nil
+	}
+	fmt.Printf("%s %s deleted\n", args[0], guid)
+	return nil
+}
+
+func cacheUsage(ctx *cmdContext, args []string) error {
+	fs := flag.NewFlagSet("cache-usage", flag.ContinueOnError)
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	var usage []*util.CacheUsage
+	if err := ctx.client.getJson("GET", "/cache/usage", nil, &usage); err != nil {
+		return err
+	}
+	if ctx.json {
+		return printJson(usage)
+	}
+
+	rows := [][]string{}
+	for _, u := range usage {
+		rows = append(rows, []string{u.Type, u.Path, strconv.Itoa(u.Files), formatBytes(u.Bytes), formatBytes(int64(u.DiskFree)), formatBytes(int64(u.DiskTotal)), fmt.Sprintf("%d%%", u.DiskUsedPercent)})
+	}
+	printTable([]string{"TYPE", "PATH", "FILES", "SIZE", "DISK FREE", "DISK TOTAL", "DISK USED"}, rows)
+	return nil
+}
@@ -0,0 +1,100 @@
+//==============================================================
+// schedulerctl: scheduler 运维命令行工具,通过 controller 接口
+// 查询/暂停 dea、说明调度结果、管理缓存的 droplet 和 package
+//==============================================================
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+//命令
+type command struct {
+	name			string
+	args			string
+	desc			string
+	run				func(ctx *cmdContext, args []string) error
+}
+
+//命令执行上下文
+type cmdContext struct {
+	client			*client
+	//true:输出 json,false:输出表格
+	json			bool
+}
+
+var commands = []*command{
+	{"deas", "[-stack s] [-docker true|false] [-zone z] [-app id] [-stale true|false] [-sort memory|-memory|disk|-disk] [-limit n]", "list DEAs and capacity per stack", listDeas},
+	{"dea", "<dea_id>", "describe a DEA", describeDea},
+	{"cordon", "<dea_id>", "stop placing new instances on a DEA", cordonDea},
+	{"uncordon", "<dea_id>", "allow placing new instances on a DEA again", uncordonDea},
+	{"drain", "[-timeout 30m] [-interval 10s] <dea_id>", "cordon a DEA and wait until it runs no app instances", drainDea},
+	{"explain", "-memory m [-disk d] [-stack s] [-docker] [-app id] [-owner] [-other]", "explain which DEAs a placement request can use", explainPlacement},
+	{"droplets", "", "list cached droplets", listDroplets},
+	{"packages", "", "list cached app packages", listPackages},
+	{"buildpacks", "", "list cached buildpack caches", listBuildpacks},
+	{"inspect", "<droplet|package|buildpack> <guid>", "show digest, size and location of an artifact", inspectArtifact},
+	{"delete", "<droplet|package|buildpack> <guid>", "delete an artifact from cache and backend", deleteArtifact},
+	{"cache-usage", "", "show cache disk usage per artifact type", cacheUsage},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: schedulerctl [options] <command> [args]\n\noptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n  %-12s   %s\n", c.name, c.desc, "", c.args)
+	}
+}
+
+func main() {
+	api := flag.String("api", envOr("SCHEDULER_API", "http://127.0.0.1:9081"), "scheduler address, env SCHEDULER_API")
+	token := flag.String("token", os.Getenv("SCHEDULER_TOKEN"), "bearer token, env SCHEDULER_TOKEN")
+	certFile := flag.String("cert", "", "client certificate for mTLS")
+	keyFile := flag.String("key", "", "client private key for mTLS")
+	caFile := flag.String("cacert", "", "CA certificate to verify the scheduler")
+	timeout := flag.Duration("timeout", 30*time.Second, "request timeout")
+	jsonOutput := flag.Bool("json", false, "print raw JSON instead of tables")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if c.name == flag.Arg(0) {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	cl, err := newClient(*api, *token, *certFile, *keyFile, *caFile, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "schedulerctl: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := cmd.run(&cmdContext{client: cl, json: *jsonOutput}, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "schedulerctl %s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
+
+//返回环境变量,不存在时返回默认值
+func envOr(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
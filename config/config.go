@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"github.com/cloudfoundry-incubator/candiedyaml"
 	"io/ioutil"
 	
@@ -13,6 +14,18 @@ type NatsConfig struct{
 	Port uint16 `yaml:"port"`
 	User string `yaml:"user"`
 	Pass string `yaml:"pass"`
+	//host 可以配置为 zk://host1:2181,host2:2181/path,从 zk 节点 path 的子节点读取 nats server 列表
+	//nats 集群地址列表 host:port,配置后忽略 host/port,连接失败时依次切换
+	Servers []string `yaml:"servers"`
+	//连接检测间隔(秒)
+	PingIntervalSecond int `yaml:"ping_interval_second"`
+	//连接失败后重试的最小/最大等待时间,每次失败翻倍
+	BackoffMinMs int `yaml:"backoff_min_ms"`
+	BackoffMaxSecond int `yaml:"backoff_max_second"`
+	//zk session 超时时间(秒)
+	ZkSessionTimeoutSecond int `yaml:"zk_session_timeout_second"`
+	//true:使用进程内消息总线,不连接 nats,用于单机开发
+	InMemory bool `yaml:"in_memory"`
 }
 
 //初始化 natsConfig 的默认值
@@ -21,6 +34,11 @@ var defaultNatsConfig = NatsConfig{
 	Port: 4222,
 	User: "",
 	Pass: "",
+	PingIntervalSecond: 5,
+	BackoffMinMs: 500,
+	BackoffMaxSecond: 30,
+	ZkSessionTimeoutSecond: 10,
+	InMemory: false,
 }
 
 // 日志配置
@@ -48,6 +66,16 @@ type DropletConfig struct {
 	CacheInterval		int 			`yaml:"cache_interval_second"`
 	//缓存磁盘最大空闲空间(使用百分比,超过该百分比将清空多余的缓存数据)
 	DiskMaxUsedSpace	int				`yaml:"disk_max_used_space_percent"`
+	//收到 jae.staging.success 时预热 droplet 缓存(只对 droplet 生效)
+	PrewarmOnStaging	bool			`yaml:"prewarm_on_staging"`
+	//同时预热的 droplet 个数,等待预热的消息超过队列长度时丢弃
+	PrewarmWorkers		int				`yaml:"prewarm_workers"`
+	//应用文件缓存池超过该时间未使用的文件在定时检测时删除(只对 app package 生效,0 不按时间删除)
+	ResourceTimeOut		int				`yaml:"resource_time_out_second"`
+	//应用文件缓存池的最大字节数,超过时从最久未使用的文件开始删除(只对 app package 生效,0 不限制)
+	ResourceMaxBytes	int64			`yaml:"resource_max_bytes"`
+	//每个上传的应用包最多加入缓存池的解压后字节数(只对 app package 生效,0 不限制)
+	ResourceMaxUnzipBytes	int64		`yaml:"resource_max_unzip_bytes"`
 }
 
 //默认的droplet 配置
@@ -57,6 +85,7 @@ var defaultDropletConfig = DropletConfig{
 	CacheTimeOut:	60*60*24*10,
 	CacheInterval:3600,
 	DiskMaxUsedSpace:60,
+	PrewarmWorkers:2,
 }
 
 //package 配置
@@ -80,6 +109,9 @@ var defaultPackageConfig = DropletConfig{
 	CacheTimeOut:	60*60*24*10,
 	CacheInterval:3600,
 	DiskMaxUsedSpace:70,
+	ResourceTimeOut:	60*60*24*10,
+	ResourceMaxBytes:	10*1024*1024*1024,
+	ResourceMaxUnzipBytes:	1024*1024*1024,
 }
 
 //buildpack cache 配置
@@ -123,6 +155,214 @@ var defaultJssConfig = JssConfig{
 	TimeOut:			60,
 }
 
+//缓存数据落盘配置(本地缓存和云存储中的 droplet/package)
+type StorageConfig struct {
+	//是否压缩
+	Compress			bool			`yaml:"compress"`
+	//是否加密(AES-GCM)
+	Encrypt				bool			`yaml:"encrypt"`
+	//密钥文件,每行一个密钥,格式: key_id base64(key),第一行为当前加密使用的密钥,其余密钥只用于解密
+	KeyFile				string			`yaml:"key_file"`
+}
+
+//默认不压缩不加密
+var defaultStorageConfig = StorageConfig{
+	Compress:			false,
+	Encrypt:			false,
+	KeyFile:			"",
+}
+
+//下载链接签名配置
+type SignedUrlConfig struct {
+	//签名密钥
+	SecretKey			string			`yaml:"secret_key"`
+	//签名链接有效期(秒)
+	ExpiresSecond		int				`yaml:"expires_second"`
+	//true:下载接口只接受带有效签名的请求
+	Required			bool			`yaml:"required"`
+}
+
+//签名链接默认有效期10分钟,默认不强制签名
+var defaultSignedUrlConfig = SignedUrlConfig{
+	SecretKey:			"",
+	ExpiresSecond:		600,
+	Required:			false,
+}
+
+//静态 token 鉴权
+type AuthTokenConfig struct {
+	Name				string			`yaml:"name"`
+	Token				string			`yaml:"token"`
+	Scopes				[]string		`yaml:"scopes"`
+}
+
+//HMAC 签名请求鉴权(签名方式与 jss 一致)
+type AuthHmacConfig struct {
+	Name				string			`yaml:"name"`
+	AccessKey			string			`yaml:"access_key"`
+	SecretKey			string			`yaml:"secret_key"`
+	Scopes				[]string		`yaml:"scopes"`
+}
+
+//mTLS 客户端证书鉴权(根据证书 CN 确定身份)
+type AuthClientCertConfig struct {
+	CommonName			string			`yaml:"common_name"`
+	Scopes				[]string		`yaml:"scopes"`
+}
+
+//http 接口鉴权配置,权限: dea(上传下载), admin(所有接口)
+type AuthConfig struct {
+	Enabled				bool						`yaml:"enabled"`
+	Tokens				[]AuthTokenConfig			`yaml:"tokens"`
+	HmacKeys			[]AuthHmacConfig			`yaml:"hmac_keys"`
+	ClientCerts			[]AuthClientCertConfig		`yaml:"client_certs"`
+	//HMAC 签名请求允许的时间误差(秒)
+	HmacSkewSecond		int							`yaml:"hmac_skew_second"`
+}
+
+//示例配置中的 token,不能用于开启鉴权的配置
+const exampleAuthToken = "change-me"
+
+//默认不开启鉴权
+var defaultAuthConfig = AuthConfig{
+	Enabled:			false,
+	HmacSkewSecond:		900,
+}
+
+//https 配置
+type TlsConfig struct {
+	Enabled				bool			`yaml:"enabled"`
+	CertFile			string			`yaml:"cert_file"`
+	KeyFile				string			`yaml:"key_file"`
+	//最低 tls 版本: 1.0/1.1/1.2/1.3
+	MinVersion			string			`yaml:"min_version"`
+	//客户端证书 CA(配置后开启 mTLS)
+	ClientCaFile		string			`yaml:"client_ca_file"`
+	//true:客户端必须提供证书, false:客户端证书可选(提供时校验)
+	RequireClientCert	bool			`yaml:"require_client_cert"`
+	//检测证书文件变化的时间间隔(秒)
+	ReloadIntervalSecond	int			`yaml:"reload_interval_second"`
+}
+
+//默认不开启 https
+var defaultTlsConfig = TlsConfig{
+	Enabled:				false,
+	MinVersion:				"1.2",
+	RequireClientCert:		false,
+	ReloadIntervalSecond:	60,
+}
+
+//事件发布开关,开启后在 nats 上发布对应的 scheduler.* 事件
+type EventsConfig struct {
+	DropletUploaded		bool			`yaml:"droplet_uploaded"`
+	PackageUploaded		bool			`yaml:"package_uploaded"`
+	ArtifactDeleted		bool			`yaml:"artifact_deleted"`
+	DeaStale			bool			`yaml:"dea_stale"`
+	PlacementDecided	bool			`yaml:"placement_decided"`
+}
+
+//默认不发布事件
+var defaultEventsConfig = EventsConfig{}
+
+//jss 删除重试配置
+type DeletionConfig struct {
+	//删除失败后的重试间隔,每次失败翻倍
+	RetryMinSecond		int				`yaml:"retry_min_second"`
+	RetryMaxSecond		int				`yaml:"retry_max_second"`
+	//超过该次数后标记为 failed,仍然按最大间隔重试
+	MaxAttempts			int				`yaml:"max_attempts"`
+	//该时间内重复的 jae.deleted 消息只处理一次
+	DedupeWindowSecond	int				`yaml:"dedupe_window_second"`
+}
+
+var defaultDeletionConfig = DeletionConfig{
+	RetryMinSecond:		5,
+	RetryMaxSecond:		600,
+	MaxAttempts:		10,
+	DedupeWindowSecond:	60,
+}
+
+//jss 孤儿数据清理配置
+type ReconcileConfig struct {
+	//查询 guid 是否存在的接口,POST {"guids":[...]},返回 {"guids":{"guid":true|false}}
+	SourceUrl			string			`yaml:"source_url"`
+	//配置后通过 Authorization: Bearer 发送
+	SourceToken			string			`yaml:"source_token"`
+	TimeoutSecond		int				`yaml:"timeout_second"`
+	//每次查询的 guid 个数
+	BatchSize			int				`yaml:"batch_size"`
+	//定时执行间隔(秒),0 不定时执行
+	IntervalSecond		int				`yaml:"interval_second"`
+	//true:定时执行时只报告不删除
+	DryRun				bool			`yaml:"dry_run"`
+	//只处理超过该时间的对象,避免删除正在上传的数据
+	MinAgeSecond		int				`yaml:"min_age_second"`
+	//一次最多删除的对象个数,超过时不删除(防止 source 返回错误数据时大量误删)
+	MaxDeletes			int				`yaml:"max_deletes"`
+}
+
+var defaultReconcileConfig = ReconcileConfig{
+	TimeoutSecond:		30,
+	BatchSize:			500,
+	IntervalSecond:		0,
+	DryRun:				true,
+	MinAgeSecond:		86400,
+	MaxDeletes:			1000,
+}
+
+//多个 scheduler 之间共享 droplet 缓存
+type PeerConfig struct {
+	Enabled				bool			`yaml:"enabled"`
+	//节点 id,默认为主机名
+	Id					string			`yaml:"id"`
+	//其他 scheduler 访问本节点的地址,如 http://10.0.0.1:9091
+	Url					string			`yaml:"url"`
+	//所有节点使用相同的 token,用于心跳签名(没有配置时不开启);请求其他节点时通过 Authorization: Bearer 发送,需要在对方的 auth.tokens 中配置 dea 权限
+	Token				string			`yaml:"token"`
+	//心跳间隔(秒),超过 3 个间隔没有心跳的节点被移除
+	HeartbeatIntervalSecond	int			`yaml:"heartbeat_interval_second"`
+	//从其他节点下载的超时时间(秒)
+	TimeoutSecond		int				`yaml:"timeout_second"`
+	//一致性 hash 每个节点的虚拟节点个数
+	VirtualNodes		int				`yaml:"virtual_nodes"`
+}
+
+//默认不开启
+var defaultPeerConfig = PeerConfig{
+	Enabled:					false,
+	HeartbeatIntervalSecond:	5,
+	TimeoutSecond:				60,
+	VirtualNodes:				100,
+}
+
+//上传下载限速和并发数限制,0 表示不限制
+type TransferConfig struct {
+	//dea 上传下载的最大并发数
+	MaxConcurrent		int				`yaml:"max_concurrent"`
+	//超过并发数时最多排队等待的时间(秒),超时返回 503,0 不排队直接返回 503
+	QueueTimeoutSecond	int				`yaml:"queue_timeout_second"`
+	//返回 503 时 Retry-After 的秒数
+	RetryAfterSecond	int				`yaml:"retry_after_second"`
+	//所有 dea 上传下载的总带宽(字节/秒)
+	BytesPerSecond		int64			`yaml:"bytes_per_second"`
+	//单个客户端(按 ip)上传下载的带宽(字节/秒)
+	ClientBytesPerSecond	int64		`yaml:"client_bytes_per_second"`
+	//经过负载均衡时从该 header 读取客户端 ip(比如 X-Forwarded-For,取最后一个地址),只能配置负载均衡会覆盖或追加的 header
+	ClientIpHeader		string			`yaml:"client_ip_header"`
+	//与 jss 之间上传下载的最大并发数,超过时最多排队等待 jss_queue_timeout_second,超时返回 503
+	JssMaxConcurrent	int				`yaml:"jss_max_concurrent"`
+	JssQueueTimeoutSecond	int			`yaml:"jss_queue_timeout_second"`
+	//与 jss 之间上传下载的总带宽(字节/秒)
+	JssBytesPerSecond	int64			`yaml:"jss_bytes_per_second"`
+}
+
+//默认不限制
+var defaultTransferConfig = TransferConfig{
+	QueueTimeoutSecond:		10,
+	RetryAfterSecond:		5,
+	JssQueueTimeoutSecond:	30,
+}
+
 //cc 助手配置
 type Config struct{
 	
@@ -132,11 +372,22 @@ type Config struct{
 	Package			 DropletConfig				`yaml:"package"`
 	Jss				 JssConfig					`yaml:"jss"`
 	Buildpack		 BuildpackConfig            `yaml:"buildpackcache"`
+	Storage			 StorageConfig              `yaml:"storage"`
+	SignedUrl		 SignedUrlConfig            `yaml:"signed_url"`
+	Auth			 AuthConfig                 `yaml:"auth"`
+	Tls				 TlsConfig                  `yaml:"tls"`
+	Events			 EventsConfig               `yaml:"events"`
+	Deletion		 DeletionConfig             `yaml:"deletion"`
+	Reconcile		 ReconcileConfig            `yaml:"reconcile"`
+	Peer			 PeerConfig                 `yaml:"peer"`
+	Transfer		 TransferConfig             `yaml:"transfer"`
 	
 	//监控检测端口
 	Port              string                      `yaml:port`
 	//dea资源心跳检测超时时间
 	DeaTimeoutSecond  int                         `yaml:dea_timeout_second`
+	//退出时等待正在处理的请求完成的最长时间(秒)
+	ShutdownTimeoutSecond int                     `yaml:"shutdown_timeout_second"`
 	
 }
 
@@ -145,9 +396,19 @@ var defaultConfig = Config{
 	Logging:                defaultLoggingConfig,
 	Port:                   "9091",
 	DeaTimeoutSecond:       10,
+	ShutdownTimeoutSecond:  30,
 	Droplet:				   defaultDropletConfig,
 	Jss:					   defaultJssConfig,
 	Buildpack:				   defaultBuildpackConfig,
+	Storage:				   defaultStorageConfig,
+	SignedUrl:				   defaultSignedUrlConfig,
+	Auth:					   defaultAuthConfig,
+	Tls:					   defaultTlsConfig,
+	Events:					   defaultEventsConfig,
+	Deletion:				   defaultDeletionConfig,
+	Reconcile:				   defaultReconcileConfig,
+	Peer:					   defaultPeerConfig,
+	Transfer:				   defaultTransferConfig,
 	
 }
 
@@ -164,6 +425,19 @@ func (c *Config) Initialize(configYAML [] byte) error{
 	return candiedyaml.Unmarshal(configYAML, &c)
 }
 
+//检查配置,开启鉴权时不允许空 token 和示例 token
+func (c *Config) Validate() error {
+	if !c.Auth.Enabled {
+		return nil
+	}
+	for _, t := range c.Auth.Tokens {
+		if t.Token == "" || t.Token == exampleAuthToken {
+			return fmt.Errorf("auth.tokens %v: token is empty or %v", t.Name, exampleAuthToken)
+		}
+	}
+	return nil
+}
+
 //根据文件初始化配置对象
 func InitConfigFromFile(path string) *Config{
 
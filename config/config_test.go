@@ -0,0 +1,25 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestValidateAuthTokens(t *testing.T) {
+	c := DefaultConfig()
+	c.Auth.Tokens = []AuthTokenConfig{{Name: "dea", Token: "change-me", Scopes: []string{"dea"}}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("auth disabled: %v", err)
+	}
+
+	c.Auth.Enabled = true
+	for _, token := range []string{"", "change-me"} {
+		c.Auth.Tokens[0].Token = token
+		if err := c.Validate(); err == nil {
+			t.Fatalf("token %q accepted", token)
+		}
+	}
+	c.Auth.Tokens[0].Token = "0f3a9b"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"scheduler/events"
+	"scheduler/util"
+)
+
+//查询 droplet/packages/buildpackCache 存储信息,HEAD /scheduler/{kind}/{guid}
+//不存在时返回 404,存在时通过响应头返回摘要、大小和缓存位置
+func (c *Controller) artifactHeadHandler(kind string, stat func(string) (*util.ArtifactInfo, error)) HttpApiFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		guid := vars["guid"]
+		if guid == "" {
+			return util.NewInvalidArgumentError("head %v, guid is empty", kind)
+		}
+
+		info, err := stat(guid)
+		if err != nil {
+			util.RequestLogger(r, c.logger).Infof("head %v, guid:%v, err:%v", kind, guid, err)
+			return err
+		}
+
+		w.Header().Set("X-Artifact-Digest", info.Digest)
+		w.Header().Set("X-Artifact-Size", strconv.FormatInt(info.Size, 10))
+		w.Header().Set("X-Cache-Location", info.Location)
+		if info.Path != "" {
+			w.Header().Set("X-Cache-Path", info.Path)
+		}
+		w.WriteHeader(200)
+		return nil
+	}
+}
+
+//删除 droplet/packages/buildpackCache 的本地缓存和 jss 数据,DELETE /scheduler/{kind}/{guid}
+//jss 删除由删除日志在后台执行,还有未完成的删除任务时返回 202 和任务状态
+func (c *Controller) artifactDeleteHandler(kind string, artifact string, destroy func(string), deletions *util.DeleteJournal) HttpApiFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		guid := vars["guid"]
+		if guid == "" {
+			return util.NewInvalidArgumentError("delete %v, guid is empty", kind)
+		}
+
+		util.RequestLogger(r, c.logger).Infof("delete %v, guid:%v", kind, guid)
+		destroy(guid)
+
+		var tasks []*util.DeleteTask
+		if deletions != nil {
+			tasks = deletions.PendingFor(guid)
+		}
+		c.publisher.Publish(events.ArtifactDeleted, &events.ArtifactDeletedEvent{
+			Type:		artifact,
+			Guid:		guid,
+			Source:		events.SourceApi,
+			Pending:	len(tasks) > 0,
+			RequestId:	util.RequestId(r.Context()),
+			Time:		time.Now(),
+		})
+
+		if len(tasks) > 0 {
+			data, err := encodeJson(&responseDeletePending{State: util.DeletePending, Deletions: tasks})
+			if err != nil {
+				return err
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(202)
+			w.Write(data)
+			return nil
+		}
+		w.WriteHeader(204)
+		return nil
+	}
+}
+
+//jss 删除还没有完成
+type responseDeletePending struct {
+	State			string					`json:"state"`
+	Deletions		[]*util.DeleteTask		`json:"deletions"`
+}
+
+//上传成功后发布 scheduler.droplet.uploaded/scheduler.package.uploaded 事件
+//摘要和大小取自上传处理返回的 X-Artifact-Digest/X-Artifact-Size 响应头,不再访问 jss
+func (c *Controller) publishUploaded(subject string, artifact string, handlerFunc HttpApiFunc) HttpApiFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		err := handlerFunc(w, r, vars)
+		if err != nil || !c.publisher.Enabled(subject) {
+			return err
+		}
+
+		guid := vars["guid"]
+		digest := w.Header().Get("X-Artifact-Digest")
+		size, sizeErr := strconv.ParseInt(w.Header().Get("X-Artifact-Size"), 10, 64)
+		if digest == "" || sizeErr != nil {
+			util.RequestLogger(r, c.logger).Warnf("upload %v response without digest or size, guid:%v", artifact, guid)
+			return nil
+		}
+		c.publisher.Publish(subject, &events.ArtifactUploadedEvent{
+			Type:		artifact,
+			Guid:		guid,
+			Digest:		digest,
+			Size:		size,
+			RequestId:	util.RequestId(r.Context()),
+			Time:		time.Now(),
+		})
+		return nil
+	}
+}
+
+//记录 dea 上传/下载数据的传输信息,用于运维页面展示
+func (c *Controller) trackTransfer(kind string, op string, handlerFunc HttpApiFunc) HttpApiFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		transfer := util.BeginTransfer(kind, op, vars["guid"])
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		err := handlerFunc(w, r, vars)
+
+		bytes := body.bytes
+		if rec, ok := recorderOf(w); ok && op == util.TransferDownload {
+			bytes = rec.bytes
+		}
+		transfer.End(bytes, err)
+		return err
+	}
+}
+
+//返回最外层的 responseRecorder(可能被限速包装)
+func recorderOf(w http.ResponseWriter) (*responseRecorder, bool) {
+	switch rw := w.(type) {
+	case *responseRecorder:
+		return rw, true
+	case *limitedResponseWriter:
+		return recorderOf(rw.ResponseWriter)
+	}
+	return nil, false
+}
+
+//统计读取的字节数
+type countingReader struct {
+	io.ReadCloser
+	bytes				int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,288 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"scheduler/config"
+	"scheduler/util"
+)
+
+//接口权限
+const (
+	//不需要鉴权
+	ScopePublic		= "public"
+	//dea 上传下载
+	ScopeDea		= "dea"
+	//运维管理接口,拥有所有权限
+	ScopeAdmin		= "admin"
+)
+
+//接口需要的权限,没有配置的接口默认需要 admin 权限
+var routeScopes = map[string]string{
+	"GET /test":										ScopePublic,
+	"GET /health":										ScopePublic,
+	//页面本身不包含数据,数据接口仍然需要 admin 权限
+	"GET /dashboard":									ScopePublic,
+	"GET /droplet/{guid}/download":						ScopeDea,
+	"GET /packages/{guid}/download":					ScopeDea,
+	"GET /buildpackCache/{guid}/download":				ScopeDea,
+	"GET /droplet/{guid}/signedurl":					ScopeDea,
+	"GET /packages/{guid}/signedurl":					ScopeDea,
+	"GET /buildpackCache/{guid}/signedurl":				ScopeDea,
+	"GET /{appid}/{memory}/{disk}/{stacks}/{owner}/{other}/{docker}/finddea":	ScopeDea,
+	"POST /droplet/{guid}/upload":						ScopeDea,
+	"POST /packages/{guid}/upload":						ScopeDea,
+	"POST /buildpackCache/:guid/upload":				ScopeDea,
+	"PUT /resource_match":								ScopeDea,
+	"POST /v2/placements":								ScopeDea,
+	"POST /v2/placements/explain":						ScopeDea,
+	"GET /apps/{appid}/placements":						ScopeDea,
+	//其他 scheduler 下载缓存
+	"GET /peer/droplet/{digest}":						ScopeDea,
+}
+
+//返回接口需要的权限
+func routeScope(method string, route string) string {
+	scope, found := routeScopes[method+" "+route]
+	if !found {
+		return ScopeAdmin
+	}
+	return scope
+}
+
+//请求方身份
+type Identity struct {
+	Name			string
+	//鉴权方式: token/hmac/mtls
+	Method			string
+	Scopes			[]string
+}
+
+//是否拥有指定权限
+func (i *Identity) HasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+//鉴权接口,请求中没有对应的鉴权信息时返回 nil, nil
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+//根据配置创建所有的鉴权方式
+func newAuthenticators(c *config.Config) []Authenticator {
+	return []Authenticator{
+		&clientCertAuthenticator{certs: c.Auth.ClientCerts},
+		&tokenAuthenticator{tokens: c.Auth.Tokens},
+		&hmacAuthenticator{keys: c.Auth.HmacKeys, skew: time.Duration(c.Auth.HmacSkewSecond) * time.Second},
+	}
+}
+
+//静态 token 鉴权: Authorization: Bearer <token>
+type tokenAuthenticator struct {
+	tokens			[]config.AuthTokenConfig
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+	for _, t := range a.tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return &Identity{Name: t.Name, Method: "token", Scopes: t.Scopes}, nil
+		}
+	}
+	return nil, errors.New("invalid bearer token")
+}
+
+//HMAC 签名请求鉴权,签名方式与 jss 一致
+//Authorization: jingdong <access_key>:base64(hmac-sha1(secret_key, method\ncontent-md5\ncontent-type\ndate\nresource))
+//resource 为 path,有 query 时为 path?raw query(与请求中的 query 完全一致)
+//带 Content-MD5 时校验请求 body 的 md5(base64),防止 body 被替换
+type hmacAuthenticator struct {
+	keys			[]config.AuthHmacConfig
+	skew			time.Duration
+}
+
+func (a *hmacAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "jingdong ") {
+		return nil, nil
+	}
+
+	credential := strings.SplitN(strings.TrimPrefix(header, "jingdong "), ":", 2)
+	if len(credential) != 2 {
+		return nil, errors.New("invalid hmac authorization header")
+	}
+
+	date := r.Header.Get("Date")
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return nil, errors.New("invalid date header:" + date)
+	}
+	if d := time.Now().Sub(t); d > a.skew || d < -a.skew {
+		return nil, errors.New("request date is out of range:" + date)
+	}
+
+	for _, k := range a.keys {
+		if k.AccessKey == "" || k.AccessKey != credential[0] {
+			continue
+		}
+		token := &util.JssToken{AccessKey: k.AccessKey, SecretKey: k.SecretKey}
+		expected := token.Sign(r.Method, r.Header.Get("Content-MD5"), r.Header.Get("Content-Type"), date, signedResource(r))
+		if !hmacEqual(expected, credential[1]) {
+			return nil, errors.New("invalid hmac signature")
+		}
+		if err := verifyContentMd5(r); err != nil {
+			return nil, err
+		}
+		return &Identity{Name: k.Name, Method: "hmac", Scopes: k.Scopes}, nil
+	}
+	return nil, errors.New("unknown access key:" + credential[0])
+}
+
+func hmacEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+//HMAC 签名的资源,query 参数也在签名范围内
+func signedResource(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + r.URL.RawQuery
+}
+
+//校验 Content-MD5 时在内存中保存的最大 body,超过时写入临时文件
+const maxMemoryMd5Body = 1 << 20
+
+//请求带 Content-MD5 时读取整个 body 校验 md5,校验通过后用读取的数据替换 r.Body
+func verifyContentMd5(r *http.Request) error {
+	expected := r.Header.Get("Content-MD5")
+	if expected == "" || r.Body == nil {
+		return nil
+	}
+
+	h := md5.New()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMemoryMd5Body+1))
+	if err != nil {
+		return errors.New("read request body fail:" + err.Error())
+	}
+	h.Write(data)
+
+	var body io.ReadCloser = ioutil.NopCloser(bytes.NewReader(data))
+	if len(data) > maxMemoryMd5Body {
+		f, err := ioutil.TempFile("", "scheduler-body-")
+		if err != nil {
+			return err
+		}
+		//文件打开后直接删除,关闭后自动释放空间
+		os.Remove(f.Name())
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := io.Copy(io.MultiWriter(f, h), r.Body); err != nil {
+			f.Close()
+			return errors.New("read request body fail:" + err.Error())
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+		body = f
+	}
+
+	if !hmacEqual(base64.StdEncoding.EncodeToString(h.Sum(nil)), expected) {
+		body.Close()
+		return errors.New("content-md5 does not match request body")
+	}
+	r.Body = body
+	return nil
+}
+
+//mTLS 客户端证书鉴权,只信任已经通过 CA 校验的证书
+type clientCertAuthenticator struct {
+	certs			[]config.AuthClientCertConfig
+}
+
+func (a *clientCertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, c := range a.certs {
+		if c.CommonName != "" && c.CommonName == cn {
+			return &Identity{Name: cn, Method: "mtls", Scopes: c.Scopes}, nil
+		}
+	}
+	//证书合法但没有配置权限时继续尝试其他鉴权方式
+	return nil, nil
+}
+
+//接口鉴权,根据接口需要的权限校验请求方身份
+func (c *Controller) authorize(scope string, handlerFunc HttpApiFunc) HttpApiFunc {
+	if !c.cfg.Auth.Enabled || scope == ScopePublic {
+		return handlerFunc
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		//带有效签名的下载链接不需要再鉴权
+		if scope == ScopeDea && r.URL.Query().Get("signature") != "" {
+			if err := c.signer.Verify(r.Method, r.URL.Path, r.URL.Query()); err == nil {
+				return handlerFunc(w, r, vars)
+			}
+		}
+
+		identity, err := c.authenticate(r)
+		if err != nil || identity == nil {
+			if err == nil {
+				err = errors.New("authentication required")
+			}
+			c.logger.Errorf("authenticate fail, path:%v, remote:%v, err:%v", r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return util.NewUnauthorizedError("%v", err)
+		}
+
+		if !identity.HasScope(scope) {
+			c.logger.Errorf("authorize fail, path:%v, identity:%v, scope:%v", r.URL.Path, identity.Name, scope)
+			return util.NewForbiddenError("permission denied, required scope:%v", scope)
+		}
+
+		c.logger.Debugf("authorize success, path:%v, identity:%v, method:%v", r.URL.Path, identity.Name, identity.Method)
+		//校验 Content-MD5 时 body 可能被替换为临时文件,处理完成后关闭
+		defer r.Body.Close()
+		return handlerFunc(w, r, vars)
+	}
+}
+
+//依次尝试所有鉴权方式
+func (c *Controller) authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c.authenticators {
+		identity, err := a.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if identity != nil {
+			return identity, nil
+		}
+	}
+	return nil, nil
+}
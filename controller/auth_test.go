@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"scheduler/config"
+	"scheduler/util"
+)
+
+func newTestHmac() *hmacAuthenticator {
+	return &hmacAuthenticator{
+		keys:	[]config.AuthHmacConfig{{Name: "cc", AccessKey: "ak", SecretKey: "sk", Scopes: []string{ScopeAdmin}}},
+		skew:	time.Minute,
+	}
+}
+
+func contentMd5(body []byte) string {
+	sum := md5.Sum(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+//按客户端的方式签名请求
+func signedRequest(method string, target string, body []byte, md5 string, resource string) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	date := time.Now().UTC().Format(http.TimeFormat)
+	r.Header.Set("Date", date)
+	r.Header.Set("Content-Type", "application/json")
+	if md5 != "" {
+		r.Header.Set("Content-MD5", md5)
+	}
+	token := &util.JssToken{AccessKey: "ak", SecretKey: "sk"}
+	r.Header.Set("Authorization", "jingdong ak:"+token.Sign(method, md5, "application/json", date, resource))
+	return r
+}
+
+func TestHmacSignsQuery(t *testing.T) {
+	a := newTestHmac()
+	target := "/scheduler/reconcile?dry_run=true&limit=10"
+
+	r := signedRequest("POST", target, nil, "", "/scheduler/reconcile?dry_run=true&limit=10")
+	if identity, err := a.Authenticate(r); err != nil || identity == nil || identity.Name != "cc" {
+		t.Fatalf("Authenticate = %v, %v", identity, err)
+	}
+
+	//只对 path 签名的请求不能携带 query
+	r = signedRequest("POST", target, nil, "", "/scheduler/reconcile")
+	if _, err := a.Authenticate(r); err == nil {
+		t.Fatal("signature without query accepted")
+	}
+
+	//修改 query 后签名失效
+	r = signedRequest("POST", target, nil, "", "/scheduler/reconcile?dry_run=true&limit=10")
+	r.URL.RawQuery = "dry_run=false&limit=10"
+	if _, err := a.Authenticate(r); err == nil {
+		t.Fatal("signature accepted for modified query")
+	}
+}
+
+func TestHmacVerifiesContentMd5(t *testing.T) {
+	a := newTestHmac()
+	body := []byte(`{"guids":["a","b"]}`)
+
+	r := signedRequest("POST", "/scheduler/resource_match", body, contentMd5(body), "/scheduler/resource_match")
+	if _, err := a.Authenticate(r); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if data, _ := ioutil.ReadAll(r.Body); !bytes.Equal(data, body) {
+		t.Fatalf("body after verification = %q", data)
+	}
+
+	//签名中的 Content-MD5 与替换后的 body 不一致
+	r = signedRequest("POST", "/scheduler/resource_match", []byte(`{"guids":["c"]}`), contentMd5(body), "/scheduler/resource_match")
+	if _, err := a.Authenticate(r); err == nil {
+		t.Fatal("body not matching content-md5 accepted")
+	}
+}
+
+func TestHmacVerifiesLargeBody(t *testing.T) {
+	a := newTestHmac()
+	body := bytes.Repeat([]byte("0123456789abcdef"), maxMemoryMd5Body/16+100)
+
+	r := signedRequest("PUT", "/scheduler/packages/guid/upload", body, contentMd5(body), "/scheduler/packages/guid/upload")
+	if _, err := a.Authenticate(r); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if !bytes.Equal(data, body) {
+		t.Fatalf("large body after verification has %v bytes, expected %v", len(data), len(body))
+	}
+
+	tampered := append([]byte{}, body...)
+	tampered[len(tampered)-1] ^= 1
+	r = signedRequest("PUT", "/scheduler/packages/guid/upload", tampered, contentMd5(body), "/scheduler/packages/guid/upload")
+	if _, err := a.Authenticate(r); err == nil {
+		t.Fatal("tampered large body accepted")
+	}
+}
@@ -2,39 +2,63 @@ package controller
 
 import (
 	"net/http"
+	"scheduler/bus"
 	"scheduler/config"
 	"scheduler/deapool"
+	"scheduler/events"
 	steno "github.com/cloudfoundry/gosteno"
 	"github.com/gorilla/mux"
 	"net"
-	"os"
+	"crypto/tls"
 	"scheduler/droplet"
 	"scheduler/apppackage"
 	"scheduler/buildpackcache"
+	"scheduler/peer"
+	"scheduler/reconcile"
+	"scheduler/util"
 	"strconv"
-	"encoding/json"
+	"sync"
+	"time"
+	"context"
 )
 
 type Controller struct {
    
    cfg      		*config.Config
+   mbus				bus.MessageBus
+   publisher		*events.Publisher
    deaPool 			*deapool.DeaPool
    droplet			*droplet.DropletMgm
    packages			*apppackage.PackageMgm
    buildpack		*buildpackcache.BuildpackMgm
+   reconciler		*reconcile.Reconciler
+   peers			*peer.Cluster
+   limits			*transferLimits
+   cacheUsage		cacheUsageCache
+   signer			*util.UrlSigner
+   authenticators	[]Authenticator
    logger         	*steno.Logger
+   httpSrv			*http.Server
+   lock				sync.Mutex
 }
 
 type HttpApiFunc func(w http.ResponseWriter, r *http.Request, vars map[string]string) error
 
 //创建一个controller对象
-func NewController(config *config.Config, pool *deapool.DeaPool, dropletMgm *droplet.DropletMgm, packageMgm *apppackage.PackageMgm, buildpackmgm *buildpackcache.BuildpackMgm) *Controller{
+func NewController(config *config.Config, mbus bus.MessageBus, pool *deapool.DeaPool, dropletMgm *droplet.DropletMgm, packageMgm *apppackage.PackageMgm, buildpackmgm *buildpackcache.BuildpackMgm, reconciler *reconcile.Reconciler, peers *peer.Cluster) *Controller{
 	return &Controller{
 		cfg:			config,
+		mbus:			mbus,
+		publisher:		events.NewPublisher(config, mbus),
 		deaPool:      	pool,
 		droplet:		dropletMgm,
 		packages:		packageMgm,
 		buildpack:		buildpackmgm,
+		reconciler:		reconciler,
+		peers:			peers,
+		limits:			newTransferLimits(config),
+		signer:			util.NewUrlSigner(config),
+		authenticators:	newAuthenticators(config),
 		logger: 		steno.NewLogger("cc_helper"),
 	}
 }
@@ -54,16 +78,11 @@ func (c *Controller) returnJson(v interface{}, w http.ResponseWriter) error{
 func (c *Controller) makeHttpHandler(logging bool, localMethod string, localRouter string, handlerFunc HttpApiFunc) http.HandlerFunc {
 	
 	return func(w http.ResponseWriter, r *http.Request) {
-		c.logger.Infof("Calling %s %s", localMethod, localRouter)
-		
 		if logging {
-			c.logger.Infof("reqMethod:%s , reqURI:%s , userAgent:%s", r.Method, r.RequestURI, r.Header.Get("User-Agent"))
+			c.logger.Debugf("Calling %s %s, reqURI:%s", localMethod, localRouter, r.RequestURI)
 		}
 		
-		if err := handlerFunc(w , r, mux.Vars(r)) ; err != nil {
-			c.logger.Errorf("Handler for %s %s returned error: %s", localMethod, localRouter, err)
-			http.Error(w, err.Error(), 400)
-		}
+		c.serveRequest(localRouter, handlerFunc, w, r, mux.Vars(r))
 	}
 }
 
@@ -76,24 +95,50 @@ func (c *Controller) createoRuter () (*mux.Router, error) {
 			"/test":																c.testHandler,
 			"/health":																c.healthHandler,
 			"/deapool":																c.deaPoolHandler,	
+			"/deapool/events":														c.deaPoolEventsHandler,
+			"/apps/{appid}/placements":												c.appPlacementsHandler,
+			"/placements/recent":													c.recentPlacementsHandler,
+			"/cache/usage":															c.cacheUsageHandler,
+			"/activity":															c.activityHandler,
+			"/deletions":															c.deletionsHandler,
+			"/reconcile":															c.reconcileStatusHandler,
+			"/peers":																c.peersHandler,
+			"/peer/droplet/{digest}":												c.limitTransfer(util.TransferDownload, c.trackTransfer("droplet", util.TransferDownload, c.droplet.ServePeerDroplet)),
+			"/transfer/limits":														c.transferLimitsHandler,
+			"/dashboard":															c.dashboardHandler,
 			"/droplets":															c.dropletsHandler,	
 			"/packages":															c.packagesHandler,	
-			"/buildpackcache":														c.packagesHandler,	
-			"/droplet/{guid}/download":												c.droplet.DownloadDroplet,		
-			"/packages/{guid}/download":											c.packages.DownloadPackage,
-			"/buildpackCache/{guid}/download":										c.buildpack.DownloadBuildpack,	
+			"/buildpackcache":														c.buildpackCacheHandler,	
+			"/droplet/{guid}/download":												c.requireSignature(c.limitTransfer(util.TransferDownload, c.trackTransfer("droplet", util.TransferDownload, c.droplet.DownloadDroplet))),		
+			"/packages/{guid}/download":											c.requireSignature(c.limitTransfer(util.TransferDownload, c.trackTransfer("app package", util.TransferDownload, c.packages.DownloadPackage))),
+			"/buildpackCache/{guid}/download":										c.requireSignature(c.limitTransfer(util.TransferDownload, c.trackTransfer("buildpackCache", util.TransferDownload, c.buildpack.DownloadBuildpack))),	
+			"/droplet/{guid}/signedurl":											c.signedUrlHandler("droplet"),
+			"/packages/{guid}/signedurl":											c.signedUrlHandler("packages"),
+			"/buildpackCache/{guid}/signedurl":										c.signedUrlHandler("buildpackCache"),
 			"/{appid}/{memory}/{disk}/{stacks}/{owner}/{other}/{docker}/finddea":	c.findDea,
 		},
 		"POST": {
-			"/droplet/{guid}/upload":			c.droplet.UploadDroplet,
-			"/packages/{guid}/upload":			c.packages.UploadPackage,
-			"/buildpackCache/:guid/upload":		c.buildpack.UploadBuildpack,
+			"/droplet/{guid}/upload":			c.limitTransfer(util.TransferUpload, c.trackTransfer("droplet", util.TransferUpload, c.publishUploaded(events.DropletUploaded, events.ArtifactDroplet, c.droplet.UploadDroplet))),
+			"/packages/{guid}/upload":			c.limitTransfer(util.TransferUpload, c.trackTransfer("app package", util.TransferUpload, c.publishUploaded(events.PackageUploaded, events.ArtifactPackage, c.packages.UploadPackage))),
+			"/buildpackCache/{guid}/upload":		c.limitTransfer(util.TransferUpload, c.trackTransfer("buildpackCache", util.TransferUpload, c.buildpack.UploadBuildpack)),
+			"/v2/placements":					c.placementsHandler,
+			"/v2/placements/explain":			c.explainPlacementHandler,
+			"/reconcile":						c.reconcileHandler,
 		},
 		"DELETE": {
-		
+			"/deapool/{id}/cordon":				c.uncordonHandler,
+			"/droplet/{guid}":					c.artifactDeleteHandler("droplet", events.ArtifactDroplet, c.droplet.DestoryDroplet, c.droplet.Deletions()),
+			"/packages/{guid}":					c.artifactDeleteHandler("packages", events.ArtifactPackage, c.packages.DestoryPackage, c.packages.Deletions()),
+			"/buildpackCache/{guid}":			c.artifactDeleteHandler("buildpackCache", events.ArtifactBuildpackCache, c.buildpack.DestoryBuildpack, nil),
+		},
+		"HEAD": {
+			"/droplet/{guid}":					c.artifactHeadHandler("droplet", c.droplet.StatDroplet),
+			"/packages/{guid}":					c.artifactHeadHandler("packages", c.packages.StatPackage),
+			"/buildpackCache/{guid}":			c.artifactHeadHandler("buildpackCache", c.buildpack.StatBuildpack),
 		},
 		"PUT": {
-		
+			"/resource_match":					c.packages.MatchResources,
+			"/deapool/{id}/cordon":				c.cordonHandler,
 		},
 	}
 	
@@ -108,7 +153,7 @@ func (c *Controller) createoRuter () (*mux.Router, error) {
 			localMethod := method
 			
 			//build the handler function
-			f := c.makeHttpHandler(true, localMethod, localRoute, localFct)
+			f := c.makeHttpHandler(true, localMethod, localRoute, c.authorize(routeScope(localMethod, localRoute), localFct))
 			
 			if localRoute == "" {
 				r.Methods(localMethod).HandlerFunc(f)
@@ -139,22 +184,75 @@ func (c *Controller) listenAndServe() error {
 		c.logger.Errorf("listenAndServe fail, %s", err)	
 		return err
 	}
-	httpSrv := http.Server{Addr: addr, Handler: r}
 	
-	return httpSrv.Serve(l)
+	//开启 https
+	if c.cfg.Tls.Enabled {
+		reloader, err := newCertReloader(c.cfg.Tls)
+		if err != nil {
+			c.logger.Errorf("listenAndServe load tls certificate fail, %s", err)
+			l.Close()
+			return err
+		}
+		tlsConfig, err := reloader.tlsConfig()
+		if err != nil {
+			c.logger.Errorf("listenAndServe tls config fail, %s", err)
+			l.Close()
+			return err
+		}
+		reloader.start()
+		defer reloader.stop()
+		
+		l = tls.NewListener(l, tlsConfig)
+		c.logger.Infof("listenAndServe https enabled, min_version:%s, client_ca:%s", c.cfg.Tls.MinVersion, c.cfg.Tls.ClientCaFile)
+	}
+	httpSrv := &http.Server{Addr: addr, Handler: r}
+	
+	c.lock.Lock()
+	c.httpSrv = httpSrv
+	c.lock.Unlock()
+	
+	err = httpSrv.Serve(l)
+	if err == http.ErrServerClosed {//调用了 Stop,正常退出
+		return nil
+	}
+	return err
 }
 
-func (c *Controller) Start() {
+//启动http服务,阻塞直到服务停止
+func (c *Controller) Start() error {
 	c.logger.Infof("starting service ........")
 	err :=  c.listenAndServe()
 	if err != nil {
 		c.logger.Errorf("ServeApi error , %s", err)
-		os.Exit(1)
+		return err
 	}
-	c.logger.Infof("starting service success, port: %s", c.cfg.Port)
+	c.logger.Infof("service stopped, port: %s", c.cfg.Port)
+	return nil
 }
 
-//查询可用的dea
+//停止http服务:不再接受新的请求,等待正在处理的上传下载完成,超过 timeout 后强制关闭
+func (c *Controller) Stop(timeout time.Duration) error {
+	c.lock.Lock()
+	httpSrv := c.httpSrv
+	c.lock.Unlock()
+	
+	if httpSrv == nil {
+		return nil
+	}
+	
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	
+	c.logger.Infof("stopping service, wait in-flight requests, timeout:%v", timeout)
+	err := httpSrv.Shutdown(ctx)
+	if err != nil {
+		c.logger.Errorf("stopping service timeout, close all connections, %s", err)
+		httpSrv.Close()
+	}
+	return err
+}
+
+//查询可用的dea(旧版本接口,兼容保留,新的调用方使用 POST /scheduler/v2/placements)
 func (c *Controller) findDea(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	appid 		:= vars["appid"]
 	memoryStr		:= vars["memory"]
@@ -201,15 +299,10 @@ func (c *Controller) findDea(w http.ResponseWriter, r *http.Request, vars map[st
 		Docker:			docker,
 	}
 	
-	a, err := json.Marshal(findMesg)
+	dea, err := c.placeDea(findMesg)
 	if err != nil {
-		c.logger.Errorf("call find dea fail, parameter fail:%s", err)
 		return err
 	}
-	
-	c.logger.Infof("begin call find dea, paramteer:%s", string(a) )
-	
-	dea := c.deaPool.FindDea(findMesg)
 	c.returnJson(dea, w)
 	return nil
 }
@@ -219,7 +312,11 @@ func (c *Controller) testHandler(w http.ResponseWriter, r *http.Request, vars ma
 	return nil
 }
 
+//dea 池查询,没有查询参数时返回原始数据(兼容旧版本),有查询参数时见 queryDeaPool
 func (c *Controller) deaPoolHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if len(r.URL.Query()) > 0 {
+		return c.queryDeaPool(w, r)
+	}
 	c.returnJson(c.deaPool.CheckDeaPool(), w)
 	return nil
 }
@@ -242,13 +339,25 @@ func (c *Controller) dropletsHandler(w http.ResponseWriter, r *http.Request, var
 	return nil
 }
 
-//存活检测
+//返回缓存共享的所有节点
+func (c *Controller) peersHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return c.returnJson(c.peers.Peers(), w)
+}
+
+//存活检测,nats 断开时 Status 为 degraded
 func (c *Controller) healthHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error{
 	health := &responseHealth{Status:"ok"}
+	if reporter, ok := c.mbus.(bus.StatusReporter); ok {
+		health.Nats = reporter.Status()
+		if !health.Nats.Connected {
+			health.Status = "degraded"
+		}
+	}
 	c.returnJson(health, w)
 	return nil
 }
 
 type responseHealth struct {
 	Status			string
+	Nats			*bus.Status			`json:"nats,omitempty"`
 }
\ No newline at end of file
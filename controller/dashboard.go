@@ -0,0 +1,255 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"scheduler/util"
+)
+
+//最近调度结果默认返回条数
+const defaultRecentPlacements = 50
+
+//缓存目录统计需要遍历整个目录,结果缓存一段时间,避免运维页面轮询时反复遍历
+const cacheUsageTTL = 30 * time.Second
+
+//缓存目录使用情况的统计结果
+type cacheUsageCache struct {
+	lock				sync.Mutex
+	usage				[]*util.CacheUsage
+	expires				time.Time
+}
+
+//返回未过期的统计结果,过期时重新统计;统计期间持有锁,并发请求只统计一次
+func (u *cacheUsageCache) get(load func() []*util.CacheUsage) []*util.CacheUsage {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	now := time.Now()
+	if u.usage == nil || now.After(u.expires) {
+		u.usage = load()
+		u.expires = now.Add(cacheUsageTTL)
+	}
+	return u.usage
+}
+
+//最近的调度结果,GET /scheduler/placements/recent?limit=50
+func (c *Controller) recentPlacementsHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	limit := defaultRecentPlacements
+	if v := r.URL.Query().Get("limit"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			return util.NewInvalidArgumentError("invalid limit:%v", v)
+		}
+		limit = i
+	}
+	return c.returnJson(c.deaPool.RecentDecisions(limit), w)
+}
+
+//各类缓存的磁盘使用情况,GET /scheduler/cache/usage,结果最多缓存 cacheUsageTTL
+func (c *Controller) cacheUsageHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return c.returnJson(c.cacheUsage.get(func() []*util.CacheUsage {
+		return []*util.CacheUsage{
+			c.droplet.CacheUsage(),
+			c.packages.CacheUsage(),
+			c.buildpack.CacheUsage(),
+		}
+	}), w)
+}
+
+//正在进行和最近完成的上传/下载/jss 同步,GET /scheduler/activity
+func (c *Controller) activityHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return c.returnJson(util.Transfers(), w)
+}
+
+//运维页面,GET /scheduler/dashboard
+func (c *Controller) dashboardHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	_, err := w.Write([]byte(dashboardHtml))
+	return err
+}
+
+//运维页面,数据来自 /scheduler/deapool、/scheduler/placements/recent、/scheduler/cache/usage、/scheduler/activity
+//开启鉴权时页面中输入 token,请求时通过 Authorization: Bearer 发送
+const dashboardHtml = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>scheduler dashboard</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 16px; color: #222; }
+h2 { font-size: 15px; margin: 20px 0 6px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ddd; padding: 3px 6px; text-align: left; white-space: nowrap; }
+th { background: #f3f3f3; }
+td.num { text-align: right; }
+tr.stale td { color: #b00; }
+tr.cordoned td { color: #888; font-style: italic; }
+#error { color: #b00; }
+.bar { background: #eee; width: 120px; height: 10px; display: inline-block; }
+.bar span { background: #4a8; height: 10px; display: block; }
+</style>
+</head>
+<body>
+<div>
+	token: <input id="token" type="password" size="32">
+	refresh: <select id="interval"><option value="5">5s</option><option value="15" selected>15s</option><option value="60">60s</option><option value="0">off</option></select>
+	<span id="updated"></span> <span id="error"></span>
+</div>
+
+<h2>DEA pool</h2>
+<table id="stacks"></table>
+<br>
+<table id="deas"></table>
+
+<h2>Recent placements</h2>
+<table id="placements"></table>
+
+<h2>Cache disk usage</h2>
+<table id="cache"></table>
+
+<h2>Transfers</h2>
+<table id="activity"></table>
+
+<script>
+var timer = null;
+var tokenInput = document.getElementById("token");
+tokenInput.value = sessionStorage.getItem("scheduler_token") || "";
+tokenInput.onchange = function() { sessionStorage.setItem("scheduler_token", tokenInput.value); refresh(); };
+document.getElementById("interval").onchange = schedule;
+
+function esc(v) {
+	return String(v === undefined || v === null ? "" : v).replace(/[&<>"']/g, function(c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+	});
+}
+
+function size(b) {
+	var units = ["B", "KB", "MB", "GB", "TB"];
+	var i = 0;
+	while (b >= 1024 && i < units.length - 1) { b /= 1024; i++; }
+	return b.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function time(t) {
+	return t ? new Date(t).toLocaleString() : "";
+}
+
+function get(path) {
+	var headers = {};
+	if (tokenInput.value) {
+		headers["Authorization"] = "Bearer " + tokenInput.value;
+	}
+	return fetch("/scheduler" + path, {headers: headers, credentials: "same-origin"}).then(function(resp) {
+		if (!resp.ok) {
+			throw new Error(path + ": " + resp.status);
+		}
+		return resp.json();
+	});
+}
+
+function table(id, columns, rows, rowClass) {
+	var html = "<tr>" + columns.map(function(c) { return "<th>" + esc(c[0]) + "</th>"; }).join("") + "</tr>";
+	rows.forEach(function(row) {
+		html += "<tr class='" + (rowClass ? rowClass(row) : "") + "'>" + columns.map(function(c) {
+			var v = c[1](row);
+			return c[2] ? "<td class='num'>" + v + "</td>" : "<td>" + v + "</td>";
+		}).join("") + "</tr>";
+	});
+	document.getElementById(id).innerHTML = html;
+}
+
+function renderPool(pool) {
+	var stacks = Object.keys(pool.stacks).sort().map(function(k) { var s = pool.stacks[k]; s.stack = k; return s; });
+	table("stacks", [
+		["stack", function(s) { return esc(s.stack); }],
+		["deas", function(s) { return s.dea_count; }, true],
+		["available memory", function(s) { return size(s.available_memory * 1024 * 1024); }, true],
+		["available disk", function(s) { return size(s.available_disk * 1024 * 1024); }, true]
+	], stacks);
+	table("deas", [
+		["id", function(d) { return esc(d.id); }],
+		["zone", function(d) { return esc(d.zone); }],
+		["stacks", function(d) { return esc((d.stacks || []).join(",")); }],
+		["docker", function(d) { return d.docker_vm ? "yes" : ""; }],
+		["available memory", function(d) { return size(d.available_memory * 1024 * 1024); }, true],
+		["available disk", function(d) { return size(d.available_disk * 1024 * 1024); }, true],
+		["apps", function(d) { return Object.keys(d.app_id_to_count || {}).length; }, true],
+		["state", function(d) { return d.stale ? "stale" : (d.cordoned ? "cordoned" : "ok"); }],
+		["last update", function(d) { return esc(time(d.time_of_last_update)); }]
+	], pool.deas, function(d) { return d.stale ? "stale" : (d.cordoned ? "cordoned" : ""); });
+}
+
+function renderPlacements(placements) {
+	table("placements", [
+		["time", function(p) { return esc(time(p.time)); }],
+		["app", function(p) { return esc(p.app_id); }],
+		["memory", function(p) { return p.memory; }, true],
+		["disk", function(p) { return p.disk; }, true],
+		["stacks", function(p) { return esc(p.stacks); }],
+		["docker", function(p) { return p.docker ? "yes" : ""; }],
+		["mode", function(p) { return p.owner_app ? "owner" : (p.other_dea ? "other" : ""); }],
+		["candidates", function(p) { return p.candidates; }, true],
+		["dea", function(p) { return esc(p.dea_id || (p.owner_dea_ids || []).join(",")); }]
+	], placements);
+}
+
+function renderCache(usage) {
+	table("cache", [
+		["type", function(u) { return esc(u.type); }],
+		["path", function(u) { return esc(u.path); }],
+		["files", function(u) { return u.files; }, true],
+		["size", function(u) { return size(u.bytes); }, true],
+		["disk free", function(u) { return size(u.disk_free) + " / " + size(u.disk_total); }, true],
+		["disk used", function(u) { return "<span class='bar'><span style='width:" + Math.min(100, u.disk_used_percent) + "%'></span></span> " + u.disk_used_percent + "%"; }]
+	], usage);
+}
+
+function renderActivity(activity) {
+	var rows = activity.active.map(function(t) { t.state = "running"; return t; })
+		.concat(activity.recent.map(function(t) { t.state = t.error ? "failed" : "done"; return t; }));
+	table("activity", [
+		["start", function(t) { return esc(time(t.start)); }],
+		["kind", function(t) { return esc(t.kind); }],
+		["op", function(t) { return esc(t.op); }],
+		["guid", function(t) { return esc(t.guid); }],
+		["size", function(t) { return t.done ? size(t.bytes) : ""; }, true],
+		["duration", function(t) { return (t.duration_ms / 1000).toFixed(1) + "s"; }, true],
+		["state", function(t) { return esc(t.state + (t.error ? ": " + t.error : "")); }]
+	], rows, function(t) { return t.error ? "stale" : ""; });
+}
+
+function refresh() {
+	Promise.all([
+		get("/deapool?limit=1000").then(renderPool),
+		get("/placements/recent").then(renderPlacements),
+		get("/cache/usage").then(renderCache),
+		get("/activity").then(renderActivity)
+	]).then(function() {
+		document.getElementById("error").textContent = "";
+		document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+	}).catch(function(e) {
+		document.getElementById("error").textContent = e.message;
+	});
+}
+
+function schedule() {
+	if (timer) {
+		clearInterval(timer);
+		timer = null;
+	}
+	var seconds = parseInt(document.getElementById("interval").value, 10);
+	if (seconds > 0) {
+		timer = setInterval(refresh, seconds * 1000);
+	}
+}
+
+refresh();
+schedule();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"scheduler/deapool"
+	"scheduler/util"
+)
+
+//事件流心跳间隔,避免中间代理断开空闲连接
+const eventKeepaliveInterval = 15 * time.Second
+
+//事件流初始快照格式
+type responseSnapshot struct {
+	Seq					uint64							`json:"seq"`
+	Deas				[]*deapool.DeaAdvertisement		`json:"deas"`
+}
+
+//cordon 接口返回格式
+type responseCordon struct {
+	DeaId				string							`json:"dea_id"`
+	Cordoned			bool							`json:"cordoned"`
+}
+
+/**
+	dea 池变化事件流(Server-Sent Events),GET /scheduler/deapool/events
+	客户端断线重连时通过 Last-Event-ID 请求头或者 since 参数续传
+	无法续传(历史事件已丢失)或者首次连接时先返回 snapshot 事件
+**/
+func (c *Controller) deaPoolEventsHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return util.NewInternalError("streaming is not supported")
+	}
+
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	var seq uint64
+	if since != "" {
+		v, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return util.NewInvalidArgumentError("invalid event sequence:%v", since)
+		}
+		seq = v
+	}
+
+	logger := util.RequestLogger(r, c.logger)
+	sub := c.deaPool.SubscribeEvents(seq)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	logger.Infof("dea pool event stream start, since:%v, resumed:%v, seq:%v", seq, sub.Resumed, sub.Seq)
+
+	if !sub.Resumed {
+		if err := writeEvent(w, sub.Seq, "snapshot", &responseSnapshot{Seq: sub.Seq, Deas: sub.Snapshot}); err != nil {
+			return nil
+		}
+	}
+	for _, e := range sub.Events {
+		if err := writeEvent(w, e.Seq, e.Type, e); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {//dea 池停止或者客户端处理太慢,客户端重连续传
+				logger.Infof("dea pool event stream closed by server")
+				return nil
+			}
+			if err := writeEvent(w, e.Seq, e.Type, e); err != nil {
+				return nil
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+		case <-r.Context().Done():
+			logger.Infof("dea pool event stream closed by client")
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+//写入一个 SSE 事件
+func writeEvent(w http.ResponseWriter, seq uint64, eventType string, v interface{}) error {
+	data, err := encodeJson(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, eventType, data)
+	return err
+}
+
+//暂停dea调度,PUT /scheduler/deapool/{id}/cordon
+func (c *Controller) cordonHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	id := vars["id"]
+	if !c.deaPool.Cordon(id) {
+		return util.NewNotFoundError("dea:%v not found", id)
+	}
+	util.RequestLogger(r, c.logger).Infof("cordon dea:%v", id)
+	return c.returnJson(&responseCordon{DeaId: id, Cordoned: true}, w)
+}
+
+//恢复dea调度,DELETE /scheduler/deapool/{id}/cordon
+func (c *Controller) uncordonHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	id := vars["id"]
+	if !c.deaPool.Uncordon(id) {
+		return util.NewNotFoundError("dea:%v not found", id)
+	}
+	util.RequestLogger(r, c.logger).Infof("uncordon dea:%v", id)
+	return c.returnJson(&responseCordon{DeaId: id, Cordoned: false}, w)
+}
+
+/**
+	按条件查询 dea 池,GET /scheduler/deapool?stack=cflinuxfs2&docker_vm=true&min_memory=2048&sort=-memory&limit=20
+	参数: stack, docker_vm, app_id, zone, stale, min_memory, min_disk, sort(id/memory/-memory/disk/-disk), offset, limit
+	返回分页后的 dea 以及所有满足条件的 dea 按 stack 汇总的可用资源
+**/
+func (c *Controller) queryDeaPool(w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	errs := []deapool.FieldError{}
+
+	parseInt := func(field string) int {
+		v := params.Get(field)
+		if v == "" {
+			return 0
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, deapool.FieldError{Field: field, Message: "must be an integer"})
+		}
+		return i
+	}
+	parseBool := func(field string) *bool {
+		v := params.Get(field)
+		if v == "" {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, deapool.FieldError{Field: field, Message: "must be true or false"})
+			return nil
+		}
+		return &b
+	}
+
+	q := &deapool.DeaQuery{
+		Stack:			params.Get("stack"),
+		DockerVm:		parseBool("docker_vm"),
+		AppId:			params.Get("app_id"),
+		Zone:			params.Get("zone"),
+		Stale:			parseBool("stale"),
+		MinMemory:		parseInt("min_memory"),
+		MinDisk:		parseInt("min_disk"),
+		Sort:			params.Get("sort"),
+		Offset:			parseInt("offset"),
+		Limit:			parseInt("limit"),
+	}
+	errs = append(errs, q.Validate()...)
+	if len(errs) > 0 {
+		e := util.NewApiError(util.ErrorInvalidArgument, "dea pool query validation fail")
+		e.Details = errs
+		return e
+	}
+
+	return c.returnJson(c.deaPool.Query(q), w)
+}
+
+//查询应用所在的 dea,GET /scheduler/apps/{appid}/placements
+func (c *Controller) appPlacementsHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	appId := vars["appid"]
+	if appId == "" {
+		return util.NewInvalidArgumentError("app placements, appid is empty")
+	}
+	return c.returnJson(c.deaPool.AppPlacements(appId), w)
+}
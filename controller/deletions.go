@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"net/http"
+	"scheduler/util"
+)
+
+//未完成的 jss 删除任务
+type responseDeletions struct {
+	Pending			[]*util.DeleteTask		`json:"pending"`
+	Failed			[]*util.DeleteTask		`json:"failed"`
+}
+
+//等待重试和多次重试失败的 jss 删除任务,GET /scheduler/deletions?state=pending|failed
+func (c *Controller) deletionsHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	state := r.URL.Query().Get("state")
+	if state != "" && state != util.DeletePending && state != util.DeleteFailed {
+		return util.NewInvalidArgumentError("invalid state:%v", state)
+	}
+
+	result := &responseDeletions{Pending: []*util.DeleteTask{}, Failed: []*util.DeleteTask{}}
+	tasks := append(c.droplet.Deletions().List(), c.packages.Deletions().List()...)
+	for _, task := range tasks {
+		if state != "" && task.State != state {
+			continue
+		}
+		if task.State == util.DeleteFailed {
+			result.Failed = append(result.Failed, task)
+		}else {
+			result.Pending = append(result.Pending, task)
+		}
+	}
+	return c.returnJson(result, w)
+}
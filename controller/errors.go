@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"scheduler/util"
+)
+
+//错误返回格式
+type responseError struct {
+	Error				string					`json:"error"`
+	Message				string					`json:"message"`
+	RequestId			string					`json:"request_id"`
+	Details				interface{}				`json:"details,omitempty"`
+}
+
+//根据错误类型返回对应的状态码和 json 格式的错误信息
+func (c *Controller) writeError(w *responseRecorder, id string, err error) {
+	e := util.ToApiError(err)
+
+	//已经开始返回数据(比如下载过程中 jss 连接中断),只能记录日志
+	if w.wroteHeader {
+		c.logger.Errorf("request:%v fail after response started, status:%v, err:%v", id, w.status, err)
+		return
+	}
+
+	data, encodeErr := encodeJson(&responseError{
+		Error:		e.Kind,
+		Message:	e.Message,
+		RequestId:	id,
+		Details:	e.Details,
+	})
+	if encodeErr != nil {
+		http.Error(w, e.Message, e.Status())
+		return
+	}
+
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status())
+	w.Write(data)
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"scheduler/config"
+	"scheduler/util"
+)
+
+//客户端限速器空闲超过该时间后移除
+const clientLimiterIdle = 5 * time.Minute
+
+//dea 上传下载的并发数和带宽限制
+type transferLimits struct {
+	slots				*util.Slots
+	queueTimeout		time.Duration
+	retryAfter			int
+	global				*util.RateLimiter
+	clientRate			int64
+	clientHeader		string
+	lock				sync.Mutex
+	clients				map[string]*clientLimiter
+	lastSweep			time.Time
+}
+
+type clientLimiter struct {
+	limiter				*util.RateLimiter
+	lastUsed			time.Time
+}
+
+func newTransferLimits(c *config.Config) *transferLimits {
+	return &transferLimits{
+		slots:			util.NewSlots(c.Transfer.MaxConcurrent),
+		queueTimeout:	time.Duration(c.Transfer.QueueTimeoutSecond) * time.Second,
+		retryAfter:		c.Transfer.RetryAfterSecond,
+		global:			util.NewRateLimiter(c.Transfer.BytesPerSecond),
+		clientRate:		c.Transfer.ClientBytesPerSecond,
+		clientHeader:	c.Transfer.ClientIpHeader,
+		clients:		make(map[string]*clientLimiter),
+		lastSweep:		time.Now(),
+	}
+}
+
+/**
+	返回客户端 ip
+	1:没有配置 client_ip_header 时使用连接地址,经过负载均衡时为负载均衡的地址,所有客户端共享一个限速器
+	2:配置后使用该 header 的最后一个地址(由最近一层可信的负载均衡添加),header 不存在时使用连接地址
+**/
+func (l *transferLimits) clientIp(r *http.Request) string {
+	if l.clientHeader != "" {
+		if v := r.Header.Get(l.clientHeader); v != "" {
+			parts := strings.Split(v, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//返回客户端(按 ip)的限速器,没有配置单客户端限速时返回 nil
+func (l *transferLimits) client(r *http.Request) *util.RateLimiter {
+	if l.clientRate <= 0 {
+		return nil
+	}
+	host := l.clientIp(r)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > clientLimiterIdle {
+		for k, c := range l.clients {
+			if now.Sub(c.lastUsed) > clientLimiterIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, found := l.clients[host]
+	if !found {
+		c = &clientLimiter{limiter: util.NewRateLimiter(l.clientRate)}
+		l.clients[host] = c
+	}
+	c.lastUsed = now
+	return c.limiter
+}
+
+/**
+	限制上传下载的并发数和带宽,在 createoRuter 中包装上传下载接口
+	1:超过 max_concurrent 时最多排队 queue_timeout_second,超时返回 503 和 Retry-After
+	2:下载限制写给客户端的速度,上传限制读取请求数据的速度,同时受总带宽和单个客户端带宽限制
+**/
+func (c *Controller) limitTransfer(op string, handlerFunc HttpApiFunc) HttpApiFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		if !c.limits.slots.Acquire(c.limits.queueTimeout) {
+			util.RequestLogger(r, c.logger).Warnf("too many transfers, reject %v %v, remote:%v", r.Method, r.URL.Path, r.RemoteAddr)
+			return util.NewTooBusyError(c.limits.retryAfter, "too many concurrent transfers, retry later")
+		}
+		defer c.limits.slots.Release()
+
+		client := c.limits.client(r)
+		if op == util.TransferUpload {
+			r.Body = &limitedBody{Reader: util.NewLimitedReader(r.Body, c.limits.global, client), Closer: r.Body}
+		}else {
+			w = &limitedResponseWriter{ResponseWriter: w, writer: util.NewLimitedWriter(w, c.limits.global, client)}
+		}
+		return handlerFunc(w, r, vars)
+	}
+}
+
+//限速的请求数据
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+//限速的响应,不实现 io.ReaderFrom,保证 http.ServeFile 等通过 Write 写数据
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	writer				io.Writer
+}
+
+func (w *limitedResponseWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+//并发数使用情况
+type responseTransferLimits struct {
+	Dea				*util.SlotsUsage		`json:"dea"`
+	Jss				*util.SlotsUsage		`json:"jss"`
+}
+
+//查询上传下载并发数,GET /scheduler/transfer/limits
+func (c *Controller) transferLimitsHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return c.returnJson(&responseTransferLimits{Dea: c.limits.slots.Usage(), Jss: util.JssSlotsUsage()}, w)
+}
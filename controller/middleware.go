@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"scheduler/util"
+	"time"
+)
+
+//请求 id 请求头
+const requestIdHeader = "X-Request-Id"
+
+//请求 id 最大长度
+const maxRequestIdLen = 128
+
+//记录响应状态和返回的字节数,handler 已经写过响应头时不能再写错误信息
+type responseRecorder struct {
+	http.ResponseWriter
+	status				int
+	bytes				int64
+	wroteHeader			bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: 200}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.status = status
+	r.wroteHeader = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(200)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+//返回请求 id,请求中没有合法的 id 时生成一个新的 id
+func requestId(r *http.Request) string {
+	if id := r.Header.Get(requestIdHeader); validRequestId(id) {
+		return id
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+//请求 id 会写入日志和响应头,只接受字母、数字和 -_.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+/**
+	请求处理中间件
+	1:分配请求 id(或使用请求头中的 X-Request-Id),写入响应头和请求 context,handler 通过 util.RequestLogger 获取带请求 id 的日志
+	2:handler 返回错误时返回 json 格式的错误信息
+	3:请求结束后记录访问日志
+**/
+func (c *Controller) serveRequest(route string, handlerFunc HttpApiFunc, rw http.ResponseWriter, r *http.Request, vars map[string]string) {
+	start := time.Now()
+	id := requestId(r)
+	w := newResponseRecorder(rw)
+	w.Header().Set(requestIdHeader, id)
+	r = r.WithContext(util.WithRequestId(r.Context(), id))
+
+	if err := handlerFunc(w, r, vars); err != nil {
+		util.RequestLogger(r, c.logger).Errorf("Handler for %s %s returned error: %s", r.Method, route, err)
+		c.writeError(w, id, err)
+	}
+
+	c.logger.Infof("access request_id=%s method=%s path=%s route=%s status=%d bytes=%d duration_ms=%d remote=%s user_agent=%q",
+		id, r.Method, r.URL.Path, route, w.status, w.bytes, time.Since(start).Nanoseconds()/int64(time.Millisecond), r.RemoteAddr, r.Header.Get("User-Agent"))
+}
+
+//流式接口(SSE)需要及时把数据发送给客户端
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		if !r.wroteHeader {
+			r.WriteHeader(200)
+		}
+		f.Flush()
+	}
+}
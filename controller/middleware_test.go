@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	steno "github.com/cloudfoundry/gosteno"
+	"scheduler/util"
+)
+
+func TestValidRequestId(t *testing.T) {
+	valid := []string{"abc", "0f3a-9b_c.1", strings.Repeat("a", maxRequestIdLen)}
+	invalid := []string{"", strings.Repeat("a", maxRequestIdLen+1), "a b", "a\nb", "id\"quoted", "中文", "a=b"}
+	for _, id := range valid {
+		if !validRequestId(id) {
+			t.Errorf("validRequestId(%q) = false", id)
+		}
+	}
+	for _, id := range invalid {
+		if validRequestId(id) {
+			t.Errorf("validRequestId(%q) = true", id)
+		}
+	}
+}
+
+//请求头中的非法 id 不会进入日志、响应头和错误信息,替换为新生成的 id
+func TestServeRequestReplacesInvalidRequestId(t *testing.T) {
+	c := &Controller{logger: steno.NewLogger("cc_helper")}
+
+	for _, header := range []string{"", "bad id\nINFO forged log line", strings.Repeat("x", 1000), "client-id_1.2"} {
+		var seen string
+		handler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+			seen = util.RequestId(r.Context())
+			return util.NewNotFoundError("droplet not found")
+		}
+
+		r := httptest.NewRequest("GET", "/scheduler/droplet/guid/download", nil)
+		if header != "" {
+			r.Header.Set(requestIdHeader, header)
+		}
+		w := httptest.NewRecorder()
+		c.serveRequest("/droplet/{guid}/download", handler, w, r, map[string]string{})
+
+		id := w.Header().Get(requestIdHeader)
+		if !validRequestId(id) || id != seen {
+			t.Fatalf("header %q: response id %q, handler id %q", header, id, seen)
+		}
+		if validRequestId(header) && id != header {
+			t.Fatalf("valid request id %q replaced by %q", header, id)
+		}
+		if !validRequestId(header) && id == header {
+			t.Fatalf("invalid request id %q accepted", header)
+		}
+
+		var body responseError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 404 || body.RequestId != id {
+			t.Fatalf("status %v, body %+v", w.Code, body)
+		}
+	}
+}
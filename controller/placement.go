@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"scheduler/deapool"
+	"scheduler/util"
+)
+
+//请求体最大长度
+const maxPlacementBodySize = 1 << 20
+
+//v2 调度接口返回格式
+type placementResponse struct {
+	Found				bool					`json:"found"`
+	DeaId				string					`json:"dea_id"`
+	OwnerDeaIds			[]string				`json:"owner_dea_ids"`
+}
+
+/**
+	v2 调度接口,POST /scheduler/v2/placements
+	参数格式: {"appId":"0001","memory":256,"disk":512,"stacks":"linux","ownerApp":false,"otherDea":false,"docker":true}
+	参数不合法时返回 400(无法解析) 或 422(字段校验失败)
+**/
+func (c *Controller) placementsHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	msg, err := c.decodePlacement(w, r)
+	if err != nil {
+		return err
+	}
+
+	dea, err := c.placeDea(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.returnJson(&placementResponse{
+		Found:			dea.DeaIds != "" || len(dea.OwnerDeaIds) > 0,
+		DeaId:			dea.DeaIds,
+		OwnerDeaIds:	dea.OwnerDeaIds,
+	}, w)
+}
+
+/**
+	调度说明,POST /scheduler/v2/placements/explain
+	参数与 /scheduler/v2/placements 相同,返回每个 dea 是否满足条件以及不满足的原因,不会真正分配 dea
+**/
+func (c *Controller) explainPlacementHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	msg, err := c.decodePlacement(w, r)
+	if err != nil {
+		return err
+	}
+	return c.returnJson(c.deaPool.ExplainPlacement(msg), w)
+}
+
+//解析并校验调度参数
+func (c *Controller) decodePlacement(w http.ResponseWriter, r *http.Request) (*deapool.FindDeaMessage, error) {
+	var msg deapool.FindDeaMessage
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPlacementBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&msg); err != nil {
+		c.logger.Errorf("placement request invalid, decode fail:%v", err)
+		return nil, util.NewBadRequestError("invalid json:%v", err)
+	}
+
+	if errs := msg.Validate(); len(errs) > 0 {
+		c.logger.Errorf("placement request invalid, fields:%v", errs)
+		e := util.NewApiError(util.ErrorInvalidArgument, "placement request validation fail")
+		e.Details = errs
+		return nil, e
+	}
+	return &msg, nil
+}
+
+//根据参数查找dea,v2 接口和旧版本接口共用
+func (c *Controller) placeDea(msg *deapool.FindDeaMessage) (*deapool.FindDeaData, error) {
+	a, err := json.Marshal(msg)
+	if err != nil {
+		c.logger.Errorf("call find dea fail, parameter fail:%s", err)
+		return nil, err
+	}
+
+	c.logger.Infof("begin call find dea, paramteer:%s", string(a))
+
+	dea := c.deaPool.FindDea(msg)
+	if dea == nil {
+		return nil, errors.New("find dea fail")
+	}
+	return dea, nil
+}
@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"scheduler/util"
+)
+
+//最近一次孤儿数据清理结果,GET /scheduler/reconcile
+func (c *Controller) reconcileStatusHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return c.returnJson(c.reconciler.Status(), w)
+}
+
+//在后台执行一次孤儿数据清理,POST /scheduler/reconcile?dry_run=true|false,默认 dry run
+func (c *Controller) reconcileHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	dryRun := true
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return util.NewInvalidArgumentError("invalid dry_run:%v", v)
+		}
+		dryRun = b
+	}
+
+	if err := c.reconciler.RunAsync(dryRun); err != nil {
+		return err
+	}
+	util.RequestLogger(r, c.logger).Infof("reconcile started, dry_run:%v", dryRun)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	return c.returnJson(c.reconciler.Status(), w)
+}
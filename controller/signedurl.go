@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"net/http"
+	"scheduler/util"
+)
+
+//签名下载链接返回格式
+type responseSignedUrl struct {
+	Url				string
+	Path			string
+	Expires			int64
+}
+
+//生成带签名的下载链接,kind 为 droplet/packages/buildpackCache
+func (c *Controller) signedUrlHandler(kind string) HttpApiFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		guid := vars["guid"]
+		if guid == "" {
+			return util.NewInvalidArgumentError("sign download url, guid is empty")
+		}
+
+		path := "/scheduler/" + kind + "/" + guid + "/download"
+		signedPath, expires, err := c.signer.SignedUrl(path)
+		if err != nil {
+			c.logger.Errorf("sign download url fail, path:%v, err:%v", path, err)
+			return util.NewInternalError("sign download url fail, path:%v, err:%v", path, err)
+		}
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		c.logger.Infof("sign download url, path:%v, expires:%v", path, expires)
+		return c.returnJson(&responseSignedUrl{
+			Url:		scheme + "://" + r.Host + signedPath,
+			Path:		signedPath,
+			Expires:	expires,
+		}, w)
+	}
+}
+
+//下载接口签名校验,开启强制签名或者请求带了签名时校验签名和有效期
+func (c *Controller) requireSignature(handlerFunc HttpApiFunc) HttpApiFunc {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		params := r.URL.Query()
+
+		if c.signer.Required() || params.Get("signature") != "" {
+			if err := c.signer.Verify(r.Method, r.URL.Path, params); err != nil {
+				c.logger.Errorf("verify signed url fail, path:%v, err:%v", r.URL.Path, err)
+				return util.NewForbiddenError("verify signed url fail, path:%v, err:%v", r.URL.Path, err)
+			}
+		}
+
+		return handlerFunc(w, r, vars)
+	}
+}
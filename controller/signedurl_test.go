@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"scheduler/apppackage"
+	"scheduler/buildpackcache"
+	"scheduler/bus"
+	"scheduler/config"
+	"scheduler/deapool"
+	"scheduler/droplet"
+)
+
+//接受所有上传,其他请求返回 404 的 jss
+func newTestJss() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			ioutil.ReadAll(r.Body)
+			w.WriteHeader(200)
+			return
+		}
+		w.WriteHeader(404)
+	}))
+}
+
+func newTestRouter(t *testing.T, jssUrl string) (http.Handler, string) {
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.DefaultConfig()
+	c.Droplet.CacheBaseDir = dir
+	c.Package.CacheBaseDir = dir
+	c.Buildpack.CacheBaseDir = dir
+	c.Jss.Domain = jssUrl
+	c.SignedUrl.SecretKey = "secret"
+	c.SignedUrl.Required = true
+
+	mbus := bus.NewMemoryBus()
+	ctl := NewController(c, mbus, deapool.NewPool(c, mbus), droplet.NewDropletMgm(c), apppackage.NewPackageMgm(c), buildpackcache.NewBuildpackMgm(c), nil, nil)
+	router, err := ctl.createoRuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router, dir
+}
+
+func serve(router http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+//上传 droplet,生成签名下载链接,再通过签名链接下载
+func TestSignedUrlDownload(t *testing.T) {
+	jss := newTestJss()
+	defer jss.Close()
+	router, dir := newTestRouter(t, jss.URL)
+	defer os.RemoveAll(dir)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("upload[droplet]", "droplet.tgz")
+	part.Write([]byte("droplet content"))
+	mw.Close()
+	upload := httptest.NewRequest("POST", "/scheduler/droplet/app-guid/upload", &body)
+	upload.Header.Set("Content-Type", mw.FormDataContentType())
+	if w := serve(router, upload); w.Code != 200 {
+		t.Fatalf("upload status %v: %s", w.Code, w.Body.String())
+	}
+
+	w := serve(router, httptest.NewRequest("GET", "/scheduler/droplet/app-guid/signedurl", nil))
+	if w.Code != 200 {
+		t.Fatalf("signedurl status %v: %s", w.Code, w.Body.String())
+	}
+	var signed responseSignedUrl
+	if err := json.Unmarshal(w.Body.Bytes(), &signed); err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(router, httptest.NewRequest("GET", signed.Path, nil))
+	if w.Code != 200 || w.Body.String() != "droplet content" {
+		t.Fatalf("signed download status %v: %q", w.Code, w.Body.String())
+	}
+
+	//签名是必须的
+	w = serve(router, httptest.NewRequest("GET", "/scheduler/droplet/app-guid/download", nil))
+	if w.Code != 403 {
+		t.Fatalf("unsigned download status %v", w.Code)
+	}
+}
+
+//下载接口都从路由中读取 guid
+func TestSignedUrlDownloadReadsRouteGuid(t *testing.T) {
+	jss := newTestJss()
+	defer jss.Close()
+	router, dir := newTestRouter(t, jss.URL)
+	defer os.RemoveAll(dir)
+
+	for _, kind := range []string{"droplet", "packages", "buildpackCache"} {
+		w := serve(router, httptest.NewRequest("GET", "/scheduler/"+kind+"/missing-guid/signedurl", nil))
+		var signed responseSignedUrl
+		if err := json.Unmarshal(w.Body.Bytes(), &signed); err != nil {
+			t.Fatal(err)
+		}
+
+		//guid 为空时返回 422,guid 正确时找不到数据返回 404
+		w = serve(router, httptest.NewRequest("GET", signed.Path, nil))
+		if w.Code != 404 {
+			t.Fatalf("%v signed download status %v: %s", kind, w.Code, w.Body.String())
+		}
+	}
+}
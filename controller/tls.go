@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+	"scheduler/config"
+	steno "github.com/cloudfoundry/gosteno"
+)
+
+//tls 版本配置
+var tlsVersions = map[string]uint16{
+	"1.0":	tls.VersionTLS10,
+	"1.1":	tls.VersionTLS11,
+	"1.2":	tls.VersionTLS12,
+	"1.3":	tls.VersionTLS13,
+}
+
+//证书热加载,定时检测证书/私钥/客户端CA 文件的修改时间,变化时重新加载
+type certReloader struct {
+	cfg				config.TlsConfig
+	lock			sync.RWMutex
+	cert			*tls.Certificate
+	clientCAs		*x509.CertPool
+	modTimes		map[string]time.Time
+	ticker			*time.Ticker
+	logger			*steno.Logger
+}
+
+//创建证书热加载对象,并加载证书
+func newCertReloader(cfg config.TlsConfig) (*certReloader, error) {
+	r := &certReloader{
+		cfg:		cfg,
+		modTimes:	make(map[string]time.Time),
+		logger:		steno.NewLogger("cc_helper"),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//返回 https 使用的 tls 配置
+func (r *certReloader) tlsConfig() (*tls.Config, error) {
+	minVersion, found := tlsVersions[r.cfg.MinVersion]
+	if !found {
+		return nil, errors.New("unsupported tls min_version:" + r.cfg.MinVersion)
+	}
+
+	clientAuth := tls.NoClientCert
+	if r.cfg.ClientCaFile != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+		if r.cfg.RequireClientCert {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	base := &tls.Config{MinVersion: minVersion, ClientAuth: clientAuth}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+
+		c := &tls.Config{
+			MinVersion:		minVersion,
+			ClientAuth:		clientAuth,
+			Certificates:	[]tls.Certificate{*r.cert},
+			ClientCAs:		r.clientCAs,
+		}
+		return c, nil
+	}
+	return base, nil
+}
+
+//启动证书文件检测
+func (r *certReloader) start() {
+	if r.cfg.ReloadIntervalSecond <= 0 {
+		return
+	}
+
+	r.ticker = time.NewTicker(time.Duration(r.cfg.ReloadIntervalSecond) * time.Second)
+	go func() {
+		for range r.ticker.C {
+			if !r.changed() {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				r.logger.Errorf("reload tls certificate fail, keep current certificate, err:%v", err)
+				continue
+			}
+			r.logger.Infof("reload tls certificate success, cert:%v", r.cfg.CertFile)
+		}
+	}()
+}
+
+//停止证书文件检测
+func (r *certReloader) stop() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+	}
+}
+
+//返回需要检测的文件
+func (r *certReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCaFile != "" {
+		files = append(files, r.cfg.ClientCaFile)
+	}
+	return files
+}
+
+//检测文件是否有变化
+func (r *certReloader) changed() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+//加载证书和客户端CA
+func (r *certReloader) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.cfg.ClientCaFile != "" {
+		data, err := ioutil.ReadFile(r.cfg.ClientCaFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("no certificate found in client ca file:" + r.cfg.ClientCaFile)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+	return nil
+}
@@ -6,8 +6,9 @@ import (
 	"sync"
 	"time"
 	steno "github.com/cloudfoundry/gosteno"
-	"github.com/cloudfoundry/yagnats"
+	"scheduler/bus"
 	"scheduler/config"
+	"scheduler/events"
 	"sort"
 	"math/rand"
 )
@@ -16,14 +17,28 @@ type DeaPool struct{
 	
 	timeOutSecond		int
 	timeOutThreshold  	time.Duration
-	messageBus        	yagnats.NATSClient
+	messageBus        	bus.MessageBus
 	logger            	*steno.Logger
 	lock 				sync.Mutex
 	endpoints        	map[string]*DeaAdvertisement
 	ticker 		   		*time.Ticker
+	//nats 订阅id,退出时取消订阅
+	subscriptions		[]int64
+	//停止后不再响应调度请求
+	stopped				bool
+	stopChan			chan struct{}
+	//暂停调度的dea,dea 重新上报资源后保持暂停状态,dea 超时被移除时清除
+	cordoned			map[string]bool
+	//dea 池变化事件
+	events				[]*PoolEvent
+	eventSeq			uint64
+	subscribers			map[chan *PoolEvent]struct{}
+	//最近的调度结果
+	decisions			[]*PlacementDecision
+	publisher			*events.Publisher
 }
 
-func NewPool(c *config.Config, mbus yagnats.NATSClient) *DeaPool{
+func NewPool(c *config.Config, mbus bus.MessageBus) *DeaPool{
 
 	return &DeaPool{
 		timeOutSecond: 						c.DeaTimeoutSecond,
@@ -31,6 +46,10 @@ func NewPool(c *config.Config, mbus yagnats.NATSClient) *DeaPool{
 		messageBus:							mbus,
 		logger: 							steno.NewLogger("cc_helper"),
 		endpoints:  						make(map[string]*DeaAdvertisement),
+		stopChan:							make(chan struct{}),
+		cordoned:							make(map[string]bool),
+		subscribers:						make(map[chan *PoolEvent]struct{}),
+		publisher:							events.NewPublisher(c, mbus),
 	}
 	
 }
@@ -68,6 +87,32 @@ type FindDeaMessage struct{
 }
 
 
+//参数校验错误
+type FieldError struct {
+	Field				   string				`json:"field"`
+	Message				   string				`json:"message"`
+}
+
+//校验查找dea的参数,返回所有不合法的字段
+func (m *FindDeaMessage) Validate() []FieldError {
+	errs := []FieldError{}
+	
+	if m.Memory <= 0 {
+		errs = append(errs, FieldError{Field: "memory", Message: "must be greater than 0"})
+	}
+	if m.Disk < 0 {
+		errs = append(errs, FieldError{Field: "disk", Message: "must not be negative"})
+	}
+	if (m.OwnerApp || m.OtherDea) && m.AppId == "" {
+		errs = append(errs, FieldError{Field: "appId", Message: "is required when ownerApp or otherDea is true"})
+	}
+	if m.OwnerApp && m.OtherDea {
+		errs = append(errs, FieldError{Field: "otherDea", Message: "can not be true when ownerApp is true"})
+	}
+	
+	return errs
+}
+
 //每个dea资源对象信息
 type DeaAdvertisement struct{
 	Id   					 	string
@@ -78,6 +123,10 @@ type DeaAdvertisement struct{
 	App_id_to_count				map[string]int
 	TimeOfLastUpdate		    time.Time
 	DockerVm					bool
+	//暂停调度,不再分配新的应用实例
+	Cordoned					bool
+	//dea 所在可用区,来自 placement_properties.zone
+	Zone						string
 }
 
 //资源调度返回的dea数据格式
@@ -112,10 +161,53 @@ func (p *DeaPool) Start(){
 	p.subDeaAdvertise()
 	p.subDeaShutdown()
 	p.deaResourceDispatch()
+	p.subAppPlacements()
 	p.startPruningCycle()
 	
 }
 
+//停止deapool:不再响应调度请求,取消nats订阅,停止超时检测
+func (p *DeaPool) Stop(){
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		return
+	}
+	p.stopped = true
+	subscriptions := p.subscriptions
+	p.subscriptions = nil
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+	p.closeSubscribers()
+	p.lock.Unlock()
+	
+	close(p.stopChan)
+	
+	for _, sid := range subscriptions {
+		if err := p.messageBus.Unsubscribe(sid); err != nil {
+			p.logger.Errorf("unsubscribe sid:%v fail:%v", sid, err)
+		}
+	}
+	p.logger.Info("deapool stopped")
+}
+
+//是否已经停止
+func (p *DeaPool) isStopped() bool{
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	
+	return p.stopped
+}
+
+//记录订阅id
+func (p *DeaPool) addSubscription(sid int64){
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	
+	p.subscriptions = append(p.subscriptions, sid)
+}
+
 //启动dea资源超时检测
 func (p *DeaPool) startPruningCycle(){
 	
@@ -130,6 +222,8 @@ func (p *DeaPool) startPruningCycle(){
 				case <-p.ticker.C:
 					p.logger.Info("Start to check and prune stale dea resources")
 					p.pruneStaleDeaResources()
+				case <-p.stopChan:
+					return
 				}
 			}
 		}()
@@ -138,9 +232,25 @@ func (p *DeaPool) startPruningCycle(){
 
 //定时检测dea上报的资源是否超时
 func (p *DeaPool) pruneStaleDeaResources(){
+	now := time.Now()
+	for _, val := range p.removeStaleDeas() {
+		p.publisher.Publish(events.DeaStale, &events.DeaStaleEvent{
+			DeaId:				val.Id,
+			Zone:				val.Zone,
+			Stacks:				val.Stacks,
+			AppIdToCount:		val.App_id_to_count,
+			TimeOfLastUpdate:	val.TimeOfLastUpdate,
+			Time:				now,
+		})
+	}
+}
+
+//从资源池中删除超时的dea,返回删除的dea
+func (p *DeaPool) removeStaleDeas() []*DeaAdvertisement{
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	
+	stale := []*DeaAdvertisement{}
 	pruneTime := time.Now().Add(-p.timeOutThreshold)
 	
 	//遍历数据
@@ -150,10 +260,13 @@ func (p *DeaPool) pruneStaleDeaResources(){
 		if val.TimeOfLastUpdate.Before(pruneTime) {
 			p.logger.Infof("dea 资源调度,当前dea已经超时上报了, dea_info:%v ",val)
 			delete(p.endpoints,val.Id)
+			delete(p.cordoned,val.Id)
+			p.publishEvent(EventStale, val.Id, val)
+			stale = append(stale, val)
 		}
 		
 	}
-	
+	return stale
 }
 
 //检测当前dea资源信息
@@ -171,8 +284,13 @@ func (p *DeaPool) CheckDeaPool() []byte{
 //参数格式: {"appId":"0001","memory":10,"disk":10,"stacks":"linux","ownerApp":true,"otherDea":false}
 //返回值格式:{"OwnerDeaIds":["0000000001","0000000002"],"DeaIds":"0000000003"}
 func (p *DeaPool) deaResourceDispatch() {
-	p.messageBus.SubscribeWithQueue("dea.resource.dispatch", "QUEUE_DISPATCH", func(message *yagnats.Message) {
+	sid, err := p.messageBus.SubscribeWithQueue("dea.resource.dispatch", "QUEUE_DISPATCH", func(message *bus.Message) {
 	
+		//已经停止,不再响应调度请求
+		if p.isStopped() {
+			return
+		}
+		
 		start := time.Now()
 		
 		payload := message.Payload
@@ -195,6 +313,12 @@ func (p *DeaPool) deaResourceDispatch() {
 		end := time.Now()
 		p.logger.Infof("dea资源调度,deaResourceDispatch,return dea_id:%v 耗时:%v ",response.DeaIds, end.Sub(start))
 	})
+	
+	if err != nil {
+		p.logger.Errorf("Error subscribing to %s: %s", "dea.resource.dispatch", err)
+		return
+	}
+	p.addSubscription(sid)
 }
 
 //根据条件选择资源最优的dea
@@ -202,6 +326,11 @@ func (p *DeaPool) FindDea(message *FindDeaMessage) *FindDeaData{
 	
 	result := &FindDeaData{}
 	
+	//已经停止,不再返回可用的dea
+	if p.isStopped() {
+		return result
+	}
+	
 	sortdeas := p.validateDdeas(message)
 	
 	for _, val := range sortdeas.owners {
@@ -212,6 +341,7 @@ func (p *DeaPool) FindDea(message *FindDeaMessage) *FindDeaData{
 	
 	count := len(sortdeas.deas)
 	p.logger.Infof("dea资源调度,满足条件的dea个数:%v",count)
+	defer p.recordDecision(message, count, result)
 	
 	if count <= 0 {
 		return result
@@ -250,11 +380,7 @@ func (p *DeaPool) validateDdeas(message *FindDeaMessage) *sortDeas{
 	p.logger.Debugf("begin find dea validateDdeas ,param:%v , dea_count:%v",message,len(p.endpoints))
 	
 	appId 				:= message.AppId
-	stacks 				:= message.Stacks
-	available_memory 	:= message.Memory
 	ownerApp          	:= message.OwnerApp //是否返回当前应用所在dea
-	otherDea          	:= message.OtherDea // 是否需要排除应用运行所在的dea
-	docker 				:= message.Docker //是否需要部署在docker上
 	//超时时间
 	pruneTime := time.Now().Add(-p.timeOutThreshold)
 	
@@ -274,35 +400,10 @@ func (p *DeaPool) validateDdeas(message *FindDeaMessage) *sortDeas{
 			continue
 		}
 		
-		//判断是否满足docker要求
-		if docker && !val.DockerVm {
-			continue
-		}
-		//判断资源是否符合规则
-		if val.Available_memory <= available_memory {//memory
-			continue
-		} 
-		
-		if val.Available_disk <= 1024 {//disk
-			continue
-		}
-		
-		if stacks != ""{
-			_ , found := val.ByStacks[stacks]
-			if !found {
-				continue
+		if reason := rejectReason(val, message, pruneTime); reason != "" {
+			if reason == RejectStale {
+				p.logger.Infof("dea 资源调度,当前dea已经超时上报了, dea_info:%v ",val)
 			}
-		}
-		
-		if otherDea {
-			_ , found := val.App_id_to_count[appId]
-			if found {
-				continue
-			}
-		}
-//		//判断资源是否过期
-		if val.TimeOfLastUpdate.Before(pruneTime) {
-			p.logger.Infof("dea 资源调度,当前dea已经超时上报了, dea_info:%v ",val)
 			continue
 		}
 		
@@ -357,10 +458,17 @@ func (p *DeaPool) register(itemMessage *poolItemMessage){
 		App_id_to_count:		itemMessage.AppIdToCount,
 		TimeOfLastUpdate:		t,
 		DockerVm:				itemMessage.DockerVm,
+		Cordoned:				p.cordoned[deaid],
+		Zone:					itemMessage.PlacementProperties["zone"],
 	}
 	
 	p.endpoints[deaid] = deaObj
 	
+	if found {
+		p.publishEvent(EventUpdate, deaid, deaObj)
+	}else {
+		p.publishEvent(EventRegister, deaid, deaObj)
+	}
 }
 
 //remove 一个已经注册过的dea信息
@@ -371,18 +479,59 @@ func (p *DeaPool) unRegister(itemMessage *poolItemDownMessage){
 	
 	deaid := itemMessage.Id
 	
-	_, found := p.endpoints[deaid]
+	dea, found := p.endpoints[deaid]
 	
 	if found {//已经存在
 		delete(p.endpoints, deaid)
+		p.publishEvent(EventShutdown, deaid, dea)
+	}
+}
+
+//暂停dea调度,已经运行的实例不受影响;dea 不存在时返回 false
+func (p *DeaPool) Cordon(deaId string) bool {
+	return p.setCordoned(deaId, true)
+}
+
+//恢复dea调度;dea 不存在时返回 false
+func (p *DeaPool) Uncordon(deaId string) bool {
+	return p.setCordoned(deaId, false)
+}
+
+func (p *DeaPool) setCordoned(deaId string, cordoned bool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	
+	dea, found := p.endpoints[deaId]
+	if !found {
+		return false
+	}
+	
+	if cordoned {
+		p.cordoned[deaId] = true
+	}else {
+		delete(p.cordoned, deaId)
+	}
+	
+	if dea.Cordoned == cordoned {
+		return true
+	}
+	dea.Cordoned = cordoned
+	
+	if cordoned {
+		p.logger.Infof("cordon dea:%v", deaId)
+		p.publishEvent(EventCordoned, deaId, dea)
+	}else {
+		p.logger.Infof("uncordon dea:%v", deaId)
+		p.publishEvent(EventUncordoned, deaId, dea)
 	}
+	return true
 }
 
 
 //注册nats信息,收集dea上报的数据
 func (p *DeaPool) subscribeRegister(subject string, successCallback func(*poolItemMessage)){
 
-	callback := func(message *yagnats.Message) {
+	callback := func(message *bus.Message) {
 		payload := message.Payload
 
 		var msg poolItemMessage
@@ -399,10 +548,12 @@ func (p *DeaPool) subscribeRegister(subject string, successCallback func(*poolIt
 		successCallback(&msg)
 	}
 
-	_, err := p.messageBus.Subscribe(subject, callback)
+	sid, err := p.messageBus.Subscribe(subject, callback)
 	if err != nil {
 		p.logger.Errorf("Error subscribing to %s: %s", subject, err)
+		return
 	}
+	p.addSubscription(sid)
 
 }
 
@@ -410,7 +561,7 @@ func (p *DeaPool) subscribeRegister(subject string, successCallback func(*poolIt
 //注册nats信息,收集dea shutdown的数据
 func (p *DeaPool) subscribeShutdown(subject string, successCallback func(*poolItemDownMessage)){
 
-	callback := func(message *yagnats.Message) {
+	callback := func(message *bus.Message) {
 		payload := message.Payload
 
 		var msg poolItemDownMessage
@@ -427,9 +578,11 @@ func (p *DeaPool) subscribeShutdown(subject string, successCallback func(*poolIt
 		successCallback(&msg)
 	}
 
-	_, err := p.messageBus.Subscribe(subject, callback)
+	sid, err := p.messageBus.Subscribe(subject, callback)
 	if err != nil {
 		p.logger.Errorf("Error subscribing to %s: %s", subject, err)
+		return
 	}
+	p.addSubscription(sid)
 }
 
@@ -0,0 +1,37 @@
+package deapool
+
+import (
+	"testing"
+	"time"
+	"scheduler/bus"
+	"scheduler/config"
+)
+
+//dea 重新上报资源时保持暂停状态,超时移除后清除暂停状态
+func TestCordonClearedForStaleDea(t *testing.T) {
+	c := config.DefaultConfig()
+	c.DeaTimeoutSecond = 60
+	p := NewPool(c, bus.NewMemoryBus())
+
+	p.register(&poolItemMessage{Id: "dea-1", Stacks: []string{"cflinuxfs2"}})
+	if !p.Cordon("dea-1") {
+		t.Fatal("cordon registered dea failed")
+	}
+	p.register(&poolItemMessage{Id: "dea-1", Stacks: []string{"cflinuxfs2"}})
+	if !p.endpoints["dea-1"].Cordoned {
+		t.Fatal("cordon lost after re-advertise")
+	}
+
+	p.endpoints["dea-1"].TimeOfLastUpdate = time.Now().Add(-time.Hour)
+	if stale := p.removeStaleDeas(); len(stale) != 1 {
+		t.Fatalf("removeStaleDeas removed %v deas", len(stale))
+	}
+	if p.cordoned["dea-1"] {
+		t.Fatal("cordon kept for removed dea")
+	}
+
+	p.register(&poolItemMessage{Id: "dea-1", Stacks: []string{"cflinuxfs2"}})
+	if p.endpoints["dea-1"].Cordoned {
+		t.Fatal("dea cordoned after re-registering")
+	}
+}
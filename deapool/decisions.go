@@ -0,0 +1,75 @@
+package deapool
+
+import (
+	"time"
+	"scheduler/events"
+)
+
+//保留的最近调度结果个数
+const decisionHistorySize = 200
+
+//一次调度的参数和结果
+type PlacementDecision struct {
+	Time					time.Time			`json:"time"`
+	AppId					string				`json:"app_id"`
+	Memory					int					`json:"memory"`
+	Disk					int					`json:"disk"`
+	Stacks					string				`json:"stacks"`
+	Docker					bool				`json:"docker"`
+	OwnerApp				bool				`json:"owner_app"`
+	OtherDea				bool				`json:"other_dea"`
+	//满足条件的 dea 个数
+	Candidates				int					`json:"candidates"`
+	DeaId					string				`json:"dea_id"`
+	OwnerDeaIds				[]string			`json:"owner_dea_ids"`
+}
+
+//记录调度结果
+func (p *DeaPool) recordDecision(message *FindDeaMessage, candidates int, result *FindDeaData) {
+	d := &PlacementDecision{
+		Time:			time.Now(),
+		AppId:			message.AppId,
+		Memory:			message.Memory,
+		Disk:			message.Disk,
+		Stacks:			message.Stacks,
+		Docker:			message.Docker,
+		OwnerApp:		message.OwnerApp,
+		OtherDea:		message.OtherDea,
+		Candidates:		candidates,
+		DeaId:			result.DeaIds,
+		OwnerDeaIds:	result.OwnerDeaIds,
+	}
+
+	p.lock.Lock()
+	p.decisions = append(p.decisions, d)
+	if len(p.decisions) > decisionHistorySize {
+		p.decisions = p.decisions[len(p.decisions)-decisionHistorySize:]
+	}
+	p.lock.Unlock()
+
+	p.publisher.Publish(events.PlacementDecided, &events.PlacementDecidedEvent{
+		AppId:			d.AppId,
+		Memory:			d.Memory,
+		Disk:			d.Disk,
+		Stacks:			d.Stacks,
+		Docker:			d.Docker,
+		OwnerApp:		d.OwnerApp,
+		OtherDea:		d.OtherDea,
+		Candidates:		d.Candidates,
+		DeaId:			d.DeaId,
+		OwnerDeaIds:	d.OwnerDeaIds,
+		Time:			d.Time,
+	})
+}
+
+//返回最近的调度结果,按时间倒序
+func (p *DeaPool) RecentDecisions(limit int) []*PlacementDecision {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	result := []*PlacementDecision{}
+	for i := len(p.decisions) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		result = append(result, p.decisions[i])
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package deapool
+
+import (
+	"time"
+)
+
+//dea 池变化事件类型
+const (
+	EventRegister		= "register"
+	EventUpdate			= "update"
+	EventStale			= "stale"
+	EventShutdown		= "shutdown"
+	EventCordoned		= "cordoned"
+	EventUncordoned		= "uncordoned"
+)
+
+//保留的历史事件个数,客户端断线重连时从历史事件中续传
+const eventHistorySize = 1024
+
+//每个订阅者的事件缓冲,缓冲满时断开订阅者,由客户端重连续传
+const eventBufferSize = 256
+
+//dea 池变化事件
+type PoolEvent struct {
+	Seq						uint64				`json:"seq"`
+	Type					string				`json:"type"`
+	DeaId					string				`json:"dea_id"`
+	Time					time.Time			`json:"time"`
+	Dea						*DeaAdvertisement	`json:"dea,omitempty"`
+}
+
+//事件订阅
+type EventSubscription struct {
+	//true:since 之后的事件都在 Events 中;false:历史事件已经丢失,Snapshot 为当前 dea 池
+	Resumed					bool
+	Snapshot				[]*DeaAdvertisement
+	//订阅时已经发生的事件
+	Events					[]*PoolEvent
+	//当前事件序号,Snapshot 对应的序号
+	Seq						uint64
+	//之后的事件,dea 池停止或者订阅者处理太慢时关闭
+	C						<-chan *PoolEvent
+	ch						chan *PoolEvent
+	pool					*DeaPool
+}
+
+//取消订阅
+func (s *EventSubscription) Close() {
+	s.pool.lock.Lock()
+	defer s.pool.lock.Unlock()
+
+	if _, found := s.pool.subscribers[s.ch]; found {
+		delete(s.pool.subscribers, s.ch)
+		close(s.ch)
+	}
+}
+
+/**
+	订阅 dea 池变化事件
+	since > 0 且 since 之后的事件还在历史中时,返回 since 之后的事件
+	否则返回当前 dea 池快照
+**/
+func (p *DeaPool) SubscribeEvents(since uint64) *EventSubscription {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ch := make(chan *PoolEvent, eventBufferSize)
+	sub := &EventSubscription{Seq: p.eventSeq, C: ch, ch: ch, pool: p}
+
+	if since > 0 && since <= p.eventSeq && p.eventResumable(since) {
+		sub.Resumed = true
+		for _, e := range p.events {
+			if e.Seq > since {
+				sub.Events = append(sub.Events, e)
+			}
+		}
+	}else {
+		for _, val := range p.endpoints {
+			sub.Snapshot = append(sub.Snapshot, val.copy())
+		}
+	}
+
+	if p.stopped {
+		close(ch)
+		return sub
+	}
+	p.subscribers[ch] = struct{}{}
+	return sub
+}
+
+//since 之后的事件是否都还在历史中,调用方需要持有锁
+func (p *DeaPool) eventResumable(since uint64) bool {
+	if since == p.eventSeq {
+		return true
+	}
+	return len(p.events) > 0 && p.events[0].Seq <= since+1
+}
+
+//发布事件,调用方需要持有锁
+func (p *DeaPool) publishEvent(eventType string, deaId string, dea *DeaAdvertisement) {
+	p.eventSeq++
+	e := &PoolEvent{
+		Seq:		p.eventSeq,
+		Type:		eventType,
+		DeaId:		deaId,
+		Time:		time.Now(),
+	}
+	if dea != nil {
+		e.Dea = dea.copy()
+	}
+
+	p.events = append(p.events, e)
+	if len(p.events) > eventHistorySize {
+		p.events = p.events[len(p.events)-eventHistorySize:]
+	}
+
+	for ch := range p.subscribers {
+		select {
+		case ch <- e:
+		default:
+			p.logger.Warnf("dea pool event subscriber too slow, disconnect it, seq:%v", e.Seq)
+			delete(p.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+//关闭所有订阅,调用方需要持有锁
+func (p *DeaPool) closeSubscribers() {
+	for ch := range p.subscribers {
+		delete(p.subscribers, ch)
+		close(ch)
+	}
+}
+
+//复制 dea 信息,事件和快照中的数据不受之后的更新影响
+func (d *DeaAdvertisement) copy() *DeaAdvertisement {
+	c := *d
+	return &c
+}
@@ -0,0 +1,117 @@
+package deapool
+
+import (
+	"sort"
+	"time"
+)
+
+//dea 不满足调度条件的原因
+const (
+	RejectCordoned			= "cordoned"
+	RejectNotDocker			= "not_docker_vm"
+	RejectMemory			= "insufficient_memory"
+	RejectDisk				= "insufficient_disk"
+	RejectStack				= "stack_mismatch"
+	RejectRunsApp			= "runs_app"
+	RejectStale				= "stale"
+)
+
+//dea 的最小可用磁盘(MB),低于该值不再分配新的实例
+const minAvailableDisk = 1024
+
+//返回 dea 不满足调度条件的原因,满足时返回空字符串
+//FindDea 和 ExplainPlacement 共用,保证两者的判断一致
+func rejectReason(val *DeaAdvertisement, message *FindDeaMessage, pruneTime time.Time) string {
+	//暂停调度的dea不分配新的实例
+	if val.Cordoned {
+		return RejectCordoned
+	}
+	//判断是否满足docker要求
+	if message.Docker && !val.DockerVm {
+		return RejectNotDocker
+	}
+	//判断资源是否符合规则
+	if val.Available_memory <= message.Memory {
+		return RejectMemory
+	}
+	if val.Available_disk <= minAvailableDisk {
+		return RejectDisk
+	}
+	if message.Stacks != "" {
+		if _, found := val.ByStacks[message.Stacks]; !found {
+			return RejectStack
+		}
+	}
+	//需要排除应用运行所在的dea
+	if message.OtherDea {
+		if _, found := val.App_id_to_count[message.AppId]; found {
+			return RejectRunsApp
+		}
+	}
+	//判断资源是否过期
+	if val.TimeOfLastUpdate.Before(pruneTime) {
+		return RejectStale
+	}
+	return ""
+}
+
+//每个 dea 的调度判断结果
+type DeaVerdict struct {
+	DeaId					string				`json:"dea_id"`
+	Eligible				bool				`json:"eligible"`
+	Reason					string				`json:"reason,omitempty"`
+	AvailableMemory			int					`json:"available_memory"`
+	AvailableDisk			int					`json:"available_disk"`
+}
+
+//调度说明,不会真正分配 dea
+type PlacementExplanation struct {
+	Request					*FindDeaMessage		`json:"request"`
+	//满足条件的 dea 个数,实际调度时从中按可用内存选择
+	Candidates				int					`json:"candidates"`
+	//每种原因被排除的 dea 个数
+	Rejected				map[string]int		`json:"rejected"`
+	Deas					[]*DeaVerdict		`json:"deas"`
+}
+
+//说明按当前参数调度时每个 dea 是否满足条件以及不满足的原因,满足条件的 dea 按可用内存升序排在前面
+func (p *DeaPool) ExplainPlacement(message *FindDeaMessage) *PlacementExplanation {
+	result := &PlacementExplanation{Request: message, Rejected: make(map[string]int), Deas: []*DeaVerdict{}}
+	pruneTime := time.Now().Add(-p.timeOutThreshold)
+
+	p.lock.Lock()
+	for _, val := range p.endpoints {
+		v := &DeaVerdict{DeaId: val.Id, AvailableMemory: val.Available_memory, AvailableDisk: val.Available_disk}
+		if message.OwnerApp {
+			//只返回当前应用运行的dea,不检查资源
+			if _, found := val.App_id_to_count[message.AppId]; found {
+				v.Eligible = true
+			}else {
+				v.Reason = "not_running_app"
+			}
+		}else {
+			v.Reason = rejectReason(val, message, pruneTime)
+			v.Eligible = v.Reason == ""
+		}
+
+		if v.Eligible {
+			result.Candidates++
+		}else {
+			result.Rejected[v.Reason]++
+		}
+		result.Deas = append(result.Deas, v)
+	}
+	p.lock.Unlock()
+
+	sort.Slice(result.Deas, func(i, j int) bool {
+		a, b := result.Deas[i], result.Deas[j]
+		if a.Eligible != b.Eligible {
+			return a.Eligible
+		}
+		if a.AvailableMemory != b.AvailableMemory {
+			return a.AvailableMemory < b.AvailableMemory
+		}
+		return a.DeaId < b.DeaId
+	})
+	return result
+}
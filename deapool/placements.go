@@ -0,0 +1,93 @@
+package deapool
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+	"scheduler/bus"
+)
+
+//查询应用所在 dea 的 nats 请求
+type AppPlacementsMessage struct {
+	AppId					string				`json:"appId"`
+}
+
+//应用在一个 dea 上的实例信息
+type AppPlacement struct {
+	DeaId					string				`json:"dea_id"`
+	Instances				int					`json:"instances"`
+	Zone					string				`json:"zone"`
+	Stale					bool				`json:"stale"`
+	Cordoned				bool				`json:"cordoned"`
+	TimeOfLastUpdate		time.Time			`json:"time_of_last_update"`
+}
+
+//应用所在的所有 dea
+type AppPlacements struct {
+	AppId					string				`json:"app_id"`
+	//所有 dea 上的实例数之和
+	Instances				int					`json:"instances"`
+	Deas					[]*AppPlacement		`json:"deas"`
+}
+
+//根据 dea 上报的 app_id_to_count 返回应用所在的 dea,按 dea id 排序
+func (p *DeaPool) AppPlacements(appId string) *AppPlacements {
+	result := &AppPlacements{AppId: appId, Deas: []*AppPlacement{}}
+	pruneTime := time.Now().Add(-p.timeOutThreshold)
+
+	p.lock.Lock()
+	for _, val := range p.endpoints {
+		count, found := val.App_id_to_count[appId]
+		if !found {
+			continue
+		}
+		result.Instances += count
+		result.Deas = append(result.Deas, &AppPlacement{
+			DeaId:				val.Id,
+			Instances:			count,
+			Zone:				val.Zone,
+			Stale:				p.timeOutSecond > 0 && val.TimeOfLastUpdate.Before(pruneTime),
+			Cordoned:			val.Cordoned,
+			TimeOfLastUpdate:	val.TimeOfLastUpdate,
+		})
+	}
+	p.lock.Unlock()
+
+	sort.Slice(result.Deas, func(i, j int) bool {
+		return result.Deas[i].DeaId < result.Deas[j].DeaId
+	})
+	return result
+}
+
+//查询应用所在的 dea,监听 dea.app.placements
+//参数格式: {"appId":"0001"}
+//返回值格式: {"app_id":"0001","instances":3,"deas":[{"dea_id":"0000000001","instances":2,"zone":"z1",...}]}
+func (p *DeaPool) subAppPlacements() {
+	subject := "dea.app.placements"
+	sid, err := p.messageBus.SubscribeWithQueue(subject, "QUEUE_APP_PLACEMENTS", func(message *bus.Message) {
+		if p.isStopped() || message.ReplyTo == "" {
+			return
+		}
+
+		var msg AppPlacementsMessage
+		if err := json.Unmarshal(message.Payload, &msg); err != nil || msg.AppId == "" {
+			logMessage := fmt.Sprintf("%s: invalid request (%d; %s): %v", subject, len(message.Payload), message.Payload, err)
+			p.logger.Warnd(map[string]interface{}{"payload": string(message.Payload)}, logMessage)
+			return
+		}
+
+		a, err := json.Marshal(p.AppPlacements(msg.AppId))
+		if err != nil {
+			p.logger.Errorf("%s ,json.Marshal response err:%v", subject, err)
+			return
+		}
+		p.messageBus.Publish(message.ReplyTo, a)
+	})
+
+	if err != nil {
+		p.logger.Errorf("Error subscribing to %s: %s", subject, err)
+		return
+	}
+	p.addSubscription(sid)
+}
@@ -0,0 +1,198 @@
+package deapool
+
+import (
+	"sort"
+	"time"
+)
+
+//查询结果默认/最大返回条数
+const (
+	DefaultQueryLimit	= 100
+	MaxQueryLimit		= 1000
+)
+
+//dea 排序方式
+var querySorts = map[string]func(a, b *DeaView) bool{
+	"id":		func(a, b *DeaView) bool { return a.Id < b.Id },
+	"memory":	func(a, b *DeaView) bool { return a.AvailableMemory < b.AvailableMemory },
+	"-memory":	func(a, b *DeaView) bool { return a.AvailableMemory > b.AvailableMemory },
+	"disk":		func(a, b *DeaView) bool { return a.AvailableDisk < b.AvailableDisk },
+	"-disk":	func(a, b *DeaView) bool { return a.AvailableDisk > b.AvailableDisk },
+}
+
+//dea 池查询条件,空值表示不过滤
+type DeaQuery struct {
+	Stack					string
+	DockerVm				*bool
+	//只返回运行了该应用的 dea
+	AppId					string
+	Zone					string
+	//true:只返回超时未上报的 dea;false:只返回正常的 dea
+	Stale					*bool
+	//可用内存/磁盘不小于该值
+	MinMemory				int
+	MinDisk					int
+	//id/memory/-memory/disk/-disk,"-" 表示降序
+	Sort					string
+	Offset					int
+	Limit					int
+}
+
+//校验查询条件
+func (q *DeaQuery) Validate() []FieldError {
+	errs := []FieldError{}
+
+	if _, found := querySorts[q.Sort]; q.Sort != "" && !found {
+		errs = append(errs, FieldError{Field: "sort", Message: "must be one of id, memory, -memory, disk, -disk"})
+	}
+	if q.Offset < 0 {
+		errs = append(errs, FieldError{Field: "offset", Message: "must not be negative"})
+	}
+	if q.Limit < 0 || q.Limit > MaxQueryLimit {
+		errs = append(errs, FieldError{Field: "limit", Message: "must be between 0 and 1000"})
+	}
+	if q.MinMemory < 0 {
+		errs = append(errs, FieldError{Field: "min_memory", Message: "must not be negative"})
+	}
+	if q.MinDisk < 0 {
+		errs = append(errs, FieldError{Field: "min_disk", Message: "must not be negative"})
+	}
+
+	return errs
+}
+
+//查询返回的 dea 信息
+type DeaView struct {
+	Id						string				`json:"id"`
+	Stacks					[]string			`json:"stacks"`
+	AvailableMemory			int					`json:"available_memory"`
+	AvailableDisk			int					`json:"available_disk"`
+	AppIdToCount			map[string]int		`json:"app_id_to_count"`
+	DockerVm				bool				`json:"docker_vm"`
+	Zone					string				`json:"zone"`
+	Cordoned				bool				`json:"cordoned"`
+	Stale					bool				`json:"stale"`
+	TimeOfLastUpdate		time.Time			`json:"time_of_last_update"`
+}
+
+//每个 stack 的可用资源汇总
+type StackCapacity struct {
+	DeaCount				int					`json:"dea_count"`
+	AvailableMemory			int					`json:"available_memory"`
+	AvailableDisk			int					`json:"available_disk"`
+	//指定 min_memory 时,按 min_memory 大小还能分配的实例数
+	Slots					int					`json:"slots,omitempty"`
+}
+
+//dea 池查询结果,Total 和 Stacks 按所有满足条件的 dea 统计,Deas 为分页后的数据
+type DeaQueryResult struct {
+	Total					int							`json:"total"`
+	Offset					int							`json:"offset"`
+	Limit					int							`json:"limit"`
+	Deas					[]*DeaView					`json:"deas"`
+	Stacks					map[string]*StackCapacity	`json:"stacks"`
+}
+
+//按条件查询 dea 池
+func (p *DeaPool) Query(q *DeaQuery) *DeaQueryResult {
+	limit := q.Limit
+	if limit == 0 {
+		limit = DefaultQueryLimit
+	}
+	less, found := querySorts[q.Sort]
+	if !found {
+		less = querySorts["id"]
+	}
+
+	pruneTime := time.Now().Add(-p.timeOutThreshold)
+	deas := []*DeaView{}
+
+	p.lock.Lock()
+	for _, val := range p.endpoints {
+		view := val.view(p.timeOutSecond > 0 && val.TimeOfLastUpdate.Before(pruneTime))
+		if q.match(val, view) {
+			deas = append(deas, view)
+		}
+	}
+	p.lock.Unlock()
+
+	sort.SliceStable(deas, func(i, j int) bool {
+		return less(deas[i], deas[j])
+	})
+
+	result := &DeaQueryResult{
+		Total:		len(deas),
+		Offset:		q.Offset,
+		Limit:		limit,
+		Deas:		[]*DeaView{},
+		Stacks:		make(map[string]*StackCapacity),
+	}
+
+	for _, dea := range deas {
+		for _, stack := range dea.Stacks {
+			capacity, found := result.Stacks[stack]
+			if !found {
+				capacity = &StackCapacity{}
+				result.Stacks[stack] = capacity
+			}
+			capacity.DeaCount++
+			capacity.AvailableMemory += dea.AvailableMemory
+			capacity.AvailableDisk += dea.AvailableDisk
+			if q.MinMemory > 0 {
+				capacity.Slots += dea.AvailableMemory / q.MinMemory
+			}
+		}
+	}
+
+	if q.Offset < len(deas) {
+		end := q.Offset + limit
+		if end > len(deas) {
+			end = len(deas)
+		}
+		result.Deas = deas[q.Offset:end]
+	}
+	return result
+}
+
+//dea 是否满足查询条件
+func (q *DeaQuery) match(dea *DeaAdvertisement, view *DeaView) bool {
+	if q.Stack != "" {
+		if _, found := dea.ByStacks[q.Stack]; !found {
+			return false
+		}
+	}
+	if q.DockerVm != nil && *q.DockerVm != dea.DockerVm {
+		return false
+	}
+	if q.AppId != "" {
+		if _, found := dea.App_id_to_count[q.AppId]; !found {
+			return false
+		}
+	}
+	if q.Zone != "" && q.Zone != dea.Zone {
+		return false
+	}
+	if q.Stale != nil && *q.Stale != view.Stale {
+		return false
+	}
+	if dea.Available_memory < q.MinMemory || dea.Available_disk < q.MinDisk {
+		return false
+	}
+	return true
+}
+
+//返回查询使用的 dea 信息
+func (d *DeaAdvertisement) view(stale bool) *DeaView {
+	return &DeaView{
+		Id:					d.Id,
+		Stacks:				d.Stacks,
+		AvailableMemory:	d.Available_memory,
+		AvailableDisk:		d.Available_disk,
+		AppIdToCount:		d.App_id_to_count,
+		DockerVm:			d.DockerVm,
+		Zone:				d.Zone,
+		Cordoned:			d.Cordoned,
+		Stale:				stale,
+		TimeOfLastUpdate:	d.TimeOfLastUpdate,
+	}
+}
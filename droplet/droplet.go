@@ -2,6 +2,7 @@ package droplet
 
 import (
 	"scheduler/config"
+	"scheduler/peer"
 	"scheduler/util"
 	"time"
 	"sync"
@@ -9,10 +10,9 @@ import (
 	"encoding/json"
 	"os"
 	"io"
+	"strconv"
 	"syscall"
 	"path/filepath"
-	"errors"
-	"fmt"
 	steno "github.com/cloudfoundry/gosteno"
 )
 
@@ -27,12 +27,23 @@ type DropletMgm struct {
 	ticker 		       		*time.Ticker
 	logger              	*steno.Logger
 	jssUtil					*util.JssUtil
+	//guid->摘要 引用及引用计数(相同内容的droplet只保存一份)
+	index					*util.DigestIndex
+	//jss 删除日志,删除失败时后台重试
+	deletions				*util.DeleteJournal
+	//缓存数据压缩/加密
+	codec					*util.ArtifactCodec
+	//其他 scheduler 节点,本地缓存未命中时先从 owner 下载
+	peers					*peer.Cluster
+	//相同摘要的并发下载只执行一次
+	fetches					util.FlightGroup
 	lock 					sync.Mutex
 }
 
 //droplet 对象
 type Droplet struct {
 	AppGuid					string
+	Digest					string
 	CachePath				string
 	TimeOfLastUpdate		time.Time
 }
@@ -40,7 +51,8 @@ type Droplet struct {
 //创建droplet 管理对象
 func NewDropletMgm (c *config.Config) *DropletMgm {
 	
-	return &DropletMgm{
+	jssUtil := util.NewJssUtil(c, true)
+	d := &DropletMgm{
 		cache_base_dir: c.Droplet.CacheBaseDir,
 		cache_directory: c.Droplet.CacheDirecotry,
 		cache_time_out: c.Droplet.CacheTimeOut,
@@ -48,8 +60,15 @@ func NewDropletMgm (c *config.Config) *DropletMgm {
 		cache_interval: c.Droplet.CacheInterval,
 		disk_mak_used_space: c.Droplet.DiskMaxUsedSpace,
 		logger:steno.NewLogger("cc_helper"),
-		jssUtil: util.NewJssUtil(c, true),
+		jssUtil: jssUtil,
+		index: util.NewDigestIndex(c.Droplet.CacheBaseDir+"/"+c.Droplet.CacheDirecotry+"/index.json"),
+		deletions: util.NewDeleteJournal(c, c.Droplet.CacheBaseDir+"/"+c.Droplet.CacheDirecotry+"/deletions.json", jssUtil),
+		codec: util.NewArtifactCodec(c),
 	}
+	d.deletions.Protect(func(digest string) bool {
+		return d.index.RefCount(digest) > 0
+	})
+	return d
 }
 
 //返回当前内存中的所有droplets 格式化成 json
@@ -62,6 +81,11 @@ func (d *DropletMgm) CacheDroplets() []byte{
 	return a
 }
 
+//返回droplet缓存目录的磁盘使用情况
+func (d *DropletMgm) CacheUsage() *util.CacheUsage {
+	return util.DirCacheUsage("droplet", d.cache_base_dir+"/"+d.cache_directory)
+}
+
 /**
 	检测缓存使用情况,清空过期的数据
 	缓存清理规则
@@ -92,7 +116,7 @@ func (d *DropletMgm) CheckCacheDroplet(){
 			return nil  
 		} 
 		
-		if !fi.IsDir() {//只判断文件
+		if !fi.IsDir() && path != d.index.Path() && path != d.deletions.Path() {//只判断文件(索引文件和删除日志不能删除)
 			mdtime := fi.ModTime()
 			//判断时间是否过期
 			if mdtime.Before(pruneTime) {
@@ -107,6 +131,7 @@ func (d *DropletMgm) CheckCacheDroplet(){
 }
 
 //从缓存中清空超时未使用的droplet
+//相同内容的 droplet 共用一个摘要文件,还有未过期的 guid 使用该文件时只清除缓存信息,不删除文件
 func (d *DropletMgm) cleanCacheDroplet() {
 	d.logger.Infof("process CheckCacheDroplet cleanCacheDroplet.......")
 	
@@ -116,14 +141,27 @@ func (d *DropletMgm) cleanCacheDroplet() {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	
+	expired := []*Droplet{}
 	for key, droplet := range d.cache_droplets {
 		
 		if droplet.TimeOfLastUpdate.Before(pruneTime) {
-			d.logger.Infof("cache droplet time out and remove local cache ,droplet:%v",droplet)
-			os.Remove(droplet.CachePath)
+			expired = append(expired, droplet)
 			delete(d.cache_droplets, key)
+		}
+	}
+	
+	inUse := make(map[string]bool)
+	for _, droplet := range d.cache_droplets {
+		inUse[droplet.CachePath] = true
+	}
+	
+	for _, droplet := range expired {
+		if inUse[droplet.CachePath] {
+			d.logger.Infof("cache droplet time out, cache file still used by other droplet, droplet:%v",droplet)
 			continue
 		}
+		d.logger.Infof("cache droplet time out and remove local cache ,droplet:%v",droplet)
+		os.Remove(droplet.CachePath)
 	}
 }
 
@@ -144,18 +182,106 @@ func (p *DropletMgm) diskStatus(path string) (uint64,uint64,int64){
 }
 
 
-//根据guid删除本地缓存数据
+/**
+	根据guid删除droplet
+	1:释放guid对摘要的引用,删除jss中guid的引用对象
+	2:摘要在本地没有任何引用时删除本地缓存,jss 中的数据在删除日志中确认没有其他 guid 引用后才删除
+	3:兼容旧版本按guid保存的本地缓存和jss数据
+**/
 func (p *DropletMgm) DestoryDroplet(guid string) {
 
 	p.logger.Infof("delete app droplet,guid:%v,from cache ",guid)
-	dropletPath,cache := p.getCacheDroplet(guid)
-	if !cache {
-		dropletPath = p.getCachePath(guid)+"/"+guid
-		os.Remove(dropletPath)
-	}else{
-		os.Remove(dropletPath)
+	p.unRegisterCache(guid)
+	os.Remove(p.getCachePath(guid)+"/"+guid)
+	
+	digest, orphan := p.index.Release(guid)
+	if digest == "" {
+		//本地索引中不存在,可能是其他scheduler上传的,只删除引用对象,数据由引用它的scheduler负责删除
+		if _, found := p.jssUtil.GetRef(guid); found {
+			p.deletions.Delete(util.DeleteRef, guid, guid)
+			return
+		}
+		p.deletions.Delete(util.DeleteObject, guid, guid)
+		return
 	}
+	
+	p.deletions.Delete(util.DeleteRef, guid, guid)
+	if orphan {
+		p.removeDigest(guid, digest)
+	} else {
+		p.logger.Infof("delete app droplet,guid:%v,digest:%v still referenced, keep data",guid, digest)
+	}
+}
+
+//只清除guid的本地缓存信息,不删除数据(按摘要保存的数据不会过期,其他guid可能还在引用)
+func (p *DropletMgm) EvictDroplet(guid string) {
+
+	p.logger.Infof("evict app droplet,guid:%v,from cache ",guid)
 	p.unRegisterCache(guid)
+	os.Remove(p.getCachePath(guid)+"/"+guid)
+}
+
+//返回droplet的存储信息,本地缓存存在时返回本地缓存文件信息,否则查询jss
+func (d *DropletMgm) StatDroplet(guid string) (*util.ArtifactInfo, error) {
+
+	info := &util.ArtifactInfo{Guid: guid}
+	digest, found := d.resolveDigest(guid)
+	if found {
+		info.Digest = digest
+		info.Path = d.getDigestPath(digest)
+	}else {
+		//兼容旧版本按guid保存的数据
+		info.Path = d.getCachePath(guid)+"/"+guid
+	}
+	
+	if fi, err := os.Stat(info.Path); err == nil {
+		info.Size = fi.Size()
+		info.Location = util.LocationLocal
+		return info, nil
+	}
+	
+	info.Path = ""
+	var err error
+	if found {
+		info.Size, err = d.jssUtil.StatDigest(digest)
+	}else {
+		info.Size, err = d.jssUtil.Stat(guid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Location = util.LocationBackend
+	return info, nil
+}
+
+//删除摘要对应的本地缓存和jss数据
+func (p *DropletMgm) removeDigest(guid string, digest string) {
+
+	p.logger.Infof("delete droplet data,digest:%v, no reference remains",digest)
+	if path := p.getDigestPath(digest); path != "" {
+		os.Remove(path)
+	}
+	p.deletions.Delete(util.DeleteDigest, digest, guid)
+}
+
+//增加guid对摘要的引用,guid 之前引用的摘要没有任何引用时删除旧数据
+func (p *DropletMgm) addRef(guid string, digest string) {
+
+	old, orphan := p.index.AddRef(guid, digest)
+	if orphan {
+		p.removeDigest(guid, old)
+	}
+}
+
+//返回guid对应的摘要,本地索引中不存在时从jss的引用对象中解析
+func (p *DropletMgm) resolveDigest(guid string) (string, bool) {
+
+	if digest, found := p.index.Digest(guid); found {
+		return digest, true
+	}
+	
+	//只读取,不加入本地索引:本地索引只记录本节点上传的 guid,否则会增加不属于本节点的引用计数
+	return p.jssUtil.GetRef(guid)
 }
 
 /**
@@ -166,27 +292,26 @@ func (p *DropletMgm) DestoryDroplet(guid string) {
 	3:上传到jss
 */
 func (d *DropletMgm) UploadDroplet(rw http.ResponseWriter, req *http.Request, vars map[string]string) error{
+	logger := util.RequestLogger(req, d.logger)
+	jss := d.jssUtil.ForRequest(req)
 
 	start := time.Now()
 	method := req.Method
-	params := req.URL.Query()
-	guid := params.Get(":guid")
+	guid := util.RouteGuid(req, vars)
 	
 	if guid == "" {
-		d.logger.Error("upload droplet,guid is empty")
-		rw.WriteHeader(400);
-		return errors.New("upload droplet,guid is empty")
+		logger.Error("upload droplet,guid is empty")
+		return util.NewInvalidArgumentError("upload droplet,guid is empty")
 	}
 	
-	d.logger.Infof("upload droplet,guid:%v, method:%v",guid,method)
+	logger.Infof("upload droplet,guid:%v, method:%v",guid,method)
 	
 	//解析上传文件
 	reader,err := req.MultipartReader()
 	
 	if err != nil {
-		d.logger.Errorf("upload droplet,guid:%v, method:%v,fail: %v",guid,method,err)
-		rw.WriteHeader(400);
-		return errors.New(fmt.Sprintf("upload droplet,guid:%v, method:%v,fail: %v",guid,method,err) )
+		logger.Errorf("upload droplet,guid:%v, method:%v,fail: %v",guid,method,err)
+		return util.NewInvalidArgumentError("upload droplet,guid:%v, method:%v,fail: %v",guid,method,err)
 	}
 	
 	//检测缓存目录是否存在
@@ -194,26 +319,28 @@ func (d *DropletMgm) UploadDroplet(rw http.ResponseWriter, req *http.Request, va
 	dir ,err := os.Stat(cachePath)
 	
 	if err != nil || !dir.IsDir() {//目录不存在需要创建
-		err := os.MkdirAll(cachePath , 0777)
+		err := os.MkdirAll(cachePath , util.CacheDirMode)
 		if err != nil {
-			d.logger.Errorf("upload droplet,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
-			rw.WriteHeader(400);
-			return errors.New(fmt.Sprintf("upload droplet,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err) )
+			logger.Errorf("upload droplet,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
+			return util.NewInternalError("upload droplet,guid:%v, method:%v,create cache dir fail, cache Path: %v, err:%v", guid, method, cachePath, err)
 		}
 	}
 	
-	//保存droplet 到 cache
-	filePath := cachePath+"/"+guid
-	d.checkCacheFileAndRemove(filePath)
+	//保存droplet 到 cache(先写入临时文件,同时计算摘要)
+	d.checkCacheFileAndRemove(cachePath+"/"+guid)
+	tmpPath := cachePath+"/"+guid+".uploading"
+	d.checkCacheFileAndRemove(tmpPath)
 	
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.CacheFileMode)
 	
 	if err !=nil {
-		d.logger.Errorf("upload droplet,guid:%v, method:%v,create droplet file fail,file: %v, err:%v", guid, method, filePath, err)
-		rw.WriteHeader(400);
-		return errors.New(fmt.Sprintf("upload droplet,guid:%v, method:%v,create droplet file fail,file: %v, err:%v", guid, method, filePath, err) )
+		logger.Errorf("upload droplet,guid:%v, method:%v,create droplet file fail,file: %v, err:%v", guid, method, tmpPath, err)
+		return util.NewInternalError("upload droplet,guid:%v, method:%v,create droplet file fail,file: %v, err:%v", guid, method, tmpPath, err)
 	}
 	
+	h := util.NewDigestHash()
+	w := io.MultiWriter(f, h)
+	
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
@@ -226,35 +353,86 @@ func (d *DropletMgm) UploadDroplet(rw http.ResponseWriter, req *http.Request, va
 			buffer := make([]byte,100000)
 			cBytes,err := part.Read(buffer)
 			
+			//最后一次读取可能同时返回数据和 io.EOF
+			w.Write(buffer[0:cBytes])
+			
 			if err == io.EOF {
 				break
 			}
-			
-			f.Write(buffer[0:cBytes])
+			if err != nil {
+				f.Close()
+				os.Remove(tmpPath)
+				logger.Errorf("upload droplet,guid:%v, method:%v,read request body fail: %v",guid,method,err)
+				return util.NewInvalidArgumentError("upload droplet,guid:%v, method:%v,read request body fail: %v",guid,method,err)
+			}
 		}
 	}
 	
 	err = f.Close()
 	if err != nil {
-		d.logger.Errorf("upload droplet,guid:%v, fail: %v", guid, err)
-		return errors.New(fmt.Sprintf("upload droplet,guid:%v, fail: %v", guid, err) )
+		os.Remove(tmpPath)
+		logger.Errorf("upload droplet,guid:%v, fail: %v", guid, err)
+		return util.NewInternalError("upload droplet,guid:%v, fail: %v", guid, err)
+	}
+	
+	//按摘要保存到缓存,相同内容的droplet已经缓存时直接使用已有文件
+	digest := util.DigestString(h)
+	filePath := d.getDigestPath(digest)
+	if filePath == "" {
+		os.Remove(tmpPath)
+		logger.Errorf("upload droplet,guid:%v, method:%v,create digest cache dir fail, digest: %v", guid, method, digest)
+		return util.NewInternalError("upload droplet,guid:%v, method:%v,create digest cache dir fail, digest: %v", guid, method, digest)
 	}
 	
+	//上传内容的大小,用于响应头和上传事件
+	var size int64
+	if fi, err := os.Stat(tmpPath); err == nil {
+		size = fi.Size()
+	}
+	
+	if _, err := os.Stat(filePath); err == nil {
+		logger.Infof("upload droplet,guid:%v, digest:%v already cached",guid, digest)
+		os.Remove(tmpPath)
+	}else if err := d.codec.StoreFile(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		logger.Errorf("upload droplet,guid:%v, method:%v,move droplet file fail,file: %v, err:%v", guid, method, filePath, err)
+		return util.NewInternalError("upload droplet,guid:%v, method:%v,move droplet file fail,file: %v, err:%v", guid, method, filePath, err)
+	}
+	
+	//与相同数据的删除互斥:正在执行的删除完成后再上传,取消等待中的删除,避免删除新上传的数据
+	unlockDigest := d.deletions.Guard(util.DeleteDigest, digest)
+	unlockRef := d.deletions.Guard(util.DeleteRef, guid)
+	d.deletions.Cancel(util.DeleteDigest, digest)
+	d.deletions.Cancel(util.DeleteRef, guid)
+	
 	//上传文件到jss(如果上传失败 清空本地缓存,通知dea上传失败)
-	jssupload := d.jssUtil.Upload(guid, filePath)
-	if !jssupload {
-	 os.Remove(filePath)
-	 d.logger.Errorf("upload droplet,guid:%v, method:%v,upload to jss fail,clean cache file,file: %v", guid, method, filePath)
-	 rw.WriteHeader(400);
-	 return errors.New(fmt.Sprintf("upload droplet,guid:%v, method:%v,upload to jss fail,clean cache file,file: %v", guid, method, filePath) )
+	err = jss.UploadDigest(digest, filePath)
+	if err == nil && !jss.PutRef(guid, digest) {
+		err = util.NewBackendUnavailableError("put droplet ref to jss fail, guid:%v", guid)
+	}
+	unlockRef()
+	unlockDigest()
+	if err != nil {
+	 if d.index.RefCount(digest) == 0 {
+	 	os.Remove(filePath)
+	 }
+	 logger.Errorf("upload droplet,guid:%v, method:%v,upload to jss fail,clean cache file,file: %v, err:%v", guid, method, filePath, err)
+	 //jss 并发数超过限制时返回 503,dea 稍后重试
+	 if util.ToApiError(err).Kind == util.ErrorTooBusy {
+	 	return err
+	 }
+	 return util.NewBackendUnavailableError("upload droplet,guid:%v, method:%v,upload to jss fail,clean cache file,file: %v", guid, method, filePath)
 	}
 	
-	//注册缓存信息
-	d.registerCache(guid, filePath)
+	//注册引用和缓存信息
+	d.addRef(guid, digest)
+	d.registerCache(guid, digest, filePath)
 	
 	end := time.Now()
-	d.logger.Infof("upload droplet,guid:%v, method:%v, success, 耗时:%v",guid, method,  end.Sub(start))
+	logger.Infof("upload droplet,guid:%v, digest:%v, method:%v, success, 耗时:%v",guid, digest, method,  end.Sub(start))
 	
+	rw.Header().Set("X-Artifact-Digest", digest)
+	rw.Header().Set("X-Artifact-Size", strconv.FormatInt(size, 10))
 	rw.WriteHeader(200);
 	
 	return nil
@@ -266,49 +444,66 @@ func (d *DropletMgm) UploadDroplet(rw http.ResponseWriter, req *http.Request, va
  2:如果缓存中不存在就从JSS 下载到本地缓存,然后再返回到dea
 */
 func (d *DropletMgm) DownloadDroplet(rw http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	logger := util.RequestLogger(req, d.logger)
+	jss := d.jssUtil.ForRequest(req)
 	
 	start := time.Now()
 	method := req.Method
-	params := req.URL.Query()
-	guid := params.Get(":guid")
+	guid := util.RouteGuid(req, vars)
 	
 	if guid == "" {
-		d.logger.Error("download droplet,guid is empty")
-		rw.WriteHeader(400);
-		return errors.New("download droplet,guid is empty")
+		logger.Error("download droplet,guid is empty")
+		return util.NewInvalidArgumentError("download droplet,guid is empty")
 	}
 	
 	var dropletPath string
-	d.logger.Infof("download droplet,guid:%v, method:%v",guid,method)
+	logger.Infof("download droplet,guid:%v, method:%v",guid,method)
 	
-	dropletPath,cache := d.getCacheDroplet(guid)
+	dropletPath,digest,cache := d.getCacheDroplet(guid)
 	if !cache {
-		d.logger.Infof("download droplet,guid:%v, method:%v,not found from cache ",guid,method)
-		dropletPath := d.getCachePath(guid)+"/"+guid
+		logger.Infof("download droplet,guid:%v, method:%v,not found from cache ",guid,method)
+		
+		var found bool
+		digest, found = d.resolveDigest(guid)
+		if found {
+			dropletPath = d.getDigestPath(digest)
+		}else {
+			//兼容旧版本按guid保存的数据
+			dropletPath = d.getCachePath(guid)+"/"+guid
+		}
 		
 		//判断path在cache中是否存在(内存中的数据可能不准确,比如服务重启等情况)
 		if _, err := os.Stat(dropletPath); err == nil {
-	        d.logger.Infof("found file:%v, from cache disk ",dropletPath)
-	        d.registerCache(guid, dropletPath)
+	        logger.Infof("found file:%v, from cache disk ",dropletPath)
+	        d.registerCache(guid, digest, dropletPath)
+	    }else if found && d.fetchFromPeer(guid, digest, dropletPath) {
+	        //从其他 scheduler 下载成功
+	        d.registerCache(guid, digest, dropletPath)
 	    }else{
 		    //从jss中下载
-			jssdownload := d.jssUtil.Download(guid, dropletPath,rw)
-			if !jssdownload {
-				d.logger.Errorf("download droplet fail, cache not found and downlaod from jss fail,guid:%v,dropletpath:%v",guid, dropletPath)
-				rw.WriteHeader(400);
-				return errors.New(fmt.Sprintf("download droplet fail, cache not found and downlaod from jss fail,guid:%v,dropletpath:%v",guid, dropletPath) )
+		    var err error
+		    if found {
+				err = jss.DownloadDigest(digest, dropletPath, rw)
+		    }else {
+				err = jss.Download(guid, dropletPath, rw)
+		    }
+			if err != nil {
+				logger.Errorf("download droplet fail, cache not found and downlaod from jss fail,guid:%v,dropletpath:%v,err:%v",guid, dropletPath, err)
+				return err
 			}
-			rw.WriteHeader(200);
-			d.registerCache(guid, dropletPath)
+			d.registerCache(guid, digest, dropletPath)
 			end := time.Now()
-    		d.logger.Infof("download droplet,guid:%v, path:%v, success, 耗时:%v",guid, dropletPath,  end.Sub(start))
+    		logger.Infof("download droplet,guid:%v, path:%v, success, 耗时:%v",guid, dropletPath,  end.Sub(start))
 			return nil
 	    }
 	}
 	//send file
-	http.ServeFile(rw,req,dropletPath)
+	if err := d.codec.ServeFile(rw,req,dropletPath,digest); err != nil {
+		logger.Errorf("download droplet fail, send cache file fail,guid:%v,dropletpath:%v,err:%v",guid, dropletPath, err)
+		return util.NewInternalError("download droplet fail, send cache file fail,guid:%v,dropletpath:%v,err:%v",guid, dropletPath, err)
+	}
     end := time.Now()
-    d.logger.Infof("download droplet,guid:%v, path:%v, success, 耗时:%v",guid, dropletPath,  end.Sub(start))
+    logger.Infof("download droplet,guid:%v, path:%v, success, 耗时:%v",guid, dropletPath,  end.Sub(start))
     return nil
 }
 
@@ -322,8 +517,8 @@ func (d *DropletMgm) checkCacheFileAndRemove(path string) {
     }
 }
 
-//根据guid 从缓存中获取droplet 路径
-func (d *DropletMgm) getCacheDroplet(guid string) (string, bool){
+//根据guid 从缓存中获取droplet 路径和摘要(旧版本按guid保存的数据摘要为空)
+func (d *DropletMgm) getCacheDroplet(guid string) (string, string, bool){
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	
@@ -334,11 +529,11 @@ func (d *DropletMgm) getCacheDroplet(guid string) (string, bool){
 		if _, err := os.Stat(droplet.CachePath); err == nil {
 			droplet.TimeOfLastUpdate = time.Now()
 			d.cache_droplets[guid] = droplet
-          return droplet.CachePath,true
+          return droplet.CachePath,droplet.Digest,true
     	}
 	}
 	
-	return "",false
+	return "","",false
 }
 
 func (d *DropletMgm) unRegisterCache(guid string) {
@@ -356,7 +551,7 @@ func (d *DropletMgm) unRegisterCache(guid string) {
 }
 
 //注册缓存的 droplet 到内存缓存
-func (d *DropletMgm) registerCache(guid string, path string) {
+func (d *DropletMgm) registerCache(guid string, digest string, path string) {
 
 	d.logger.Infof("register droplet cache ,guid:%v,path:%v",guid, path)
 	
@@ -369,7 +564,7 @@ func (d *DropletMgm) registerCache(guid string, path string) {
 		delete(d.cache_droplets, guid)
 	}
 	
-	cacheDroplet := &Droplet{AppGuid:guid,CachePath:path,TimeOfLastUpdate:time.Now(),}
+	cacheDroplet := &Droplet{AppGuid:guid,Digest:digest,CachePath:path,TimeOfLastUpdate:time.Now(),}
 	d.cache_droplets[guid] = cacheDroplet
 }
 
@@ -387,7 +582,7 @@ func (d *DropletMgm) getCachePath(guid string) string {
 	//检测目录是否存在
 	dir ,err := os.Stat(path)
 	if err != nil || !dir.IsDir() {//目录不存在需要创建
-		err := os.MkdirAll(path , 0777)
+		err := os.MkdirAll(path , util.CacheDirMode)
 		if err != nil {
 			d.logger.Errorf("mkdir path:%v fail,%v", path, err)
 			return ""
@@ -395,4 +590,43 @@ func (d *DropletMgm) getCachePath(guid string) string {
 	}
 	
 	return path
-}
\ No newline at end of file
+}
+
+//根据摘要返回缓存文件在本地磁盘的路径
+func (d *DropletMgm) getDigestPath(digest string) string {
+	
+	rs := [] rune(digest)
+	
+	if len(rs) < 4{
+		return ""
+	}
+	
+	path := d.cache_base_dir+"/"+d.cache_directory+"/sha256/"+string(rs[0:2])+"/"+string(rs[2:4])
+	
+	//检测目录是否存在
+	dir ,err := os.Stat(path)
+	if err != nil || !dir.IsDir() {//目录不存在需要创建
+		err := os.MkdirAll(path , util.CacheDirMode)
+		if err != nil {
+			d.logger.Errorf("mkdir path:%v fail,%v", path, err)
+			return ""
+		}
+	}
+	
+	return path+"/"+digest
+}
+
+//返回 jss 删除日志
+func (d *DropletMgm) Deletions() *util.DeleteJournal {
+	return d.deletions
+}
+
+//返回 droplet 的 jss 存储
+func (d *DropletMgm) Backend() *util.JssUtil {
+	return d.jssUtil
+}
+
+//设置缓存共享的节点
+func (d *DropletMgm) UsePeers(peers *peer.Cluster) {
+	d.peers = peers
+}
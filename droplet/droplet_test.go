@@ -0,0 +1,52 @@
+package droplet
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"scheduler/config"
+)
+
+func newTestDropletMgm(t *testing.T) (*DropletMgm, string) {
+	dir, err := ioutil.TempDir("", "droplet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.DefaultConfig()
+	c.Droplet.CacheBaseDir = dir
+	c.Droplet.CacheTimeOut = 60
+	return NewDropletMgm(c), dir
+}
+
+//相同摘要的 droplet 共用缓存文件,只有所有 guid 都过期后才删除文件
+func TestCleanCacheKeepsSharedDigest(t *testing.T) {
+	d, dir := newTestDropletMgm(t)
+	defer os.RemoveAll(dir)
+
+	digest := "abcdef0123456789"
+	path := d.getDigestPath(digest)
+	if err := ioutil.WriteFile(path, []byte("droplet"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	d.registerCache("old", digest, path)
+	d.registerCache("new", digest, path)
+	d.cache_droplets["old"].TimeOfLastUpdate = time.Now().Add(-time.Hour)
+
+	d.cleanCacheDroplet()
+	if _, found := d.cache_droplets["old"]; found {
+		t.Fatal("expired droplet still cached")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("shared cache file removed: %v", err)
+	}
+	if cached, _, found := d.getCacheDroplet("new"); !found || cached != path {
+		t.Fatalf("getCacheDroplet(new) = %q, %v", cached, found)
+	}
+
+	d.cache_droplets["new"].TimeOfLastUpdate = time.Now().Add(-time.Hour)
+	d.cleanCacheDroplet()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("cache file kept after all droplets expired")
+	}
+}
@@ -0,0 +1,78 @@
+package droplet
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"time"
+	"scheduler/peer"
+	"scheduler/util"
+)
+
+//从 guid 的 owner 节点下载数据到 path 并校验摘要,失败时返回 false,由调用方从 jss 下载
+func (d *DropletMgm) fetchFromPeer(guid string, digest string, path string) bool {
+	if d.peers == nil || !d.peers.Enabled() {
+		return false
+	}
+
+	//相同摘要的并发请求只下载一次
+	_, err := d.fetches.Do("peer:"+digest, func() (string, error) {
+		//下载到临时文件,校验通过后 rename 到缓存路径,其他请求不会读到未校验的数据
+		tmp := path + ".peer"
+		if err := d.peers.Fetch("droplet", guid, digest, tmp); err != nil {
+			return "", err
+		}
+		if err := d.verifyDigest(tmp, digest); err != nil {
+			d.logger.Warnf("droplet from peer verify fail, guid:%v, digest:%v, err:%v", guid, digest, err)
+			os.Remove(tmp)
+			return "", err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		return path, nil
+	})
+	return err == nil
+}
+
+/**
+	其他 scheduler 下载本节点缓存的 droplet
+	1:返回本地缓存中的原始数据(压缩/加密),请求方解码后校验摘要
+	2:本地不存在时从 jss 下载到本地缓存,不再请求其他节点(避免节点之间循环请求)
+**/
+func (d *DropletMgm) ServePeerDroplet(rw http.ResponseWriter, req *http.Request, vars map[string]string) error {
+	logger := util.RequestLogger(req, d.logger)
+
+	start := time.Now()
+	digest := vars["digest"]
+	if !validDigest(digest) {
+		return util.NewInvalidArgumentError("peer download droplet, invalid digest:%v", digest)
+	}
+
+	path := d.getDigestPath(digest)
+	if path == "" {
+		return util.NewInternalError("peer download droplet, create digest cache dir fail, digest:%v", digest)
+	}
+	if _, err := os.Stat(path); err != nil {
+		if path, err = d.ensureDigest("", digest); err != nil {
+			logger.Errorf("peer download droplet fail, digest:%v, err:%v", digest, err)
+			return err
+		}
+	}
+
+	rw.Header().Set(peer.HeaderDigest, digest)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(rw, req, path)
+	logger.Infof("peer download droplet, digest:%v, path:%v, success, 耗时:%v", digest, path, time.Now().Sub(start))
+	return nil
+}
+
+//检测摘要是否合法(64位十六进制),防止拼接出非法路径
+func validDigest(digest string) bool {
+	if len(digest) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
@@ -0,0 +1,104 @@
+package droplet
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+	"scheduler/util"
+)
+
+/**
+	预热 droplet 缓存,应用启动前确保 dea 下载时命中本地缓存
+	1:本地缓存存在时校验内容摘要,校验通过直接注册缓存
+	2:本地不存在或者校验失败时从 jss 下载(droplet 可能是通过其他 scheduler 上传的),下载时同时校验摘要
+	3:兼容旧版本按guid保存的数据,不做校验
+**/
+func (d *DropletMgm) PrewarmDroplet(guid string) error {
+
+	start := time.Now()
+	digest, found := d.resolveDigest(guid)
+	if !found {
+		path := d.getCachePath(guid)+"/"+guid
+		if _, err := os.Stat(path); err != nil {
+			if err := d.jssUtil.Download(guid, path, ioutil.Discard); err != nil {
+				d.logger.Errorf("prewarm droplet,guid:%v, download from jss fail:%v", guid, err)
+				return err
+			}
+		}
+		d.registerCache(guid, "", path)
+		d.logger.Infof("prewarm droplet,guid:%v, path:%v, success, 耗时:%v", guid, path, time.Now().Sub(start))
+		return nil
+	}
+
+	path, err := d.ensureDigest(guid, digest)
+	if err != nil {
+		return err
+	}
+
+	d.registerCache(guid, digest, path)
+	d.logger.Infof("prewarm droplet,guid:%v, digest:%v, path:%v, success, 耗时:%v", guid, digest, path, time.Now().Sub(start))
+	return nil
+}
+
+//确保摘要对应的数据在本地缓存中且内容正确,不存在或者校验失败时从 jss 下载,返回缓存文件路径
+//相同摘要的并发调用只下载一次
+func (d *DropletMgm) ensureDigest(guid string, digest string) (string, error) {
+	return d.fetches.Do(digest, func() (string, error) {
+		return d.fetchDigest(guid, digest)
+	})
+}
+
+func (d *DropletMgm) fetchDigest(guid string, digest string) (string, error) {
+	path := d.getDigestPath(digest)
+	if path == "" {
+		return "", util.NewInternalError("create digest cache dir fail, guid:%v, digest:%v", guid, digest)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := d.verifyDigest(path, digest); err == nil {
+			d.logger.Infof("droplet digest:%v already cached and verified, guid:%v", digest, guid)
+			return path, nil
+		}else {
+			//不删除损坏的文件(可能正在被读取),校验通过后用新文件替换
+			d.logger.Warnf("droplet cache file:%v verify fail, download again, guid:%v, err:%v", path, guid, err)
+		}
+	}
+
+	//下载到临时文件,校验通过后 rename 到缓存路径
+	tmp := path + ".prewarm"
+	h := util.NewDigestHash()
+	if err := d.jssUtil.DownloadDigest(digest, tmp, h); err != nil {
+		d.logger.Errorf("download droplet from jss fail, guid:%v, digest:%v, err:%v", guid, digest, err)
+		return "", err
+	}
+	if actual := util.DigestString(h); actual != digest {
+		os.Remove(tmp)
+		d.logger.Errorf("download droplet from jss, guid:%v, digest mismatch, expected:%v, actual:%v", guid, digest, actual)
+		return "", util.NewBackendUnavailableError("download droplet,guid:%v, digest mismatch, expected:%v, actual:%v", guid, digest, actual)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", util.NewInternalError("download droplet,guid:%v, move cache file fail:%v", guid, err)
+	}
+	d.logger.Infof("droplet digest:%v downloaded from jss, guid:%v", digest, guid)
+	return path, nil
+}
+
+//校验缓存文件解码后的内容与摘要是否一致
+func (d *DropletMgm) verifyDigest(path string, digest string) error {
+	reader, err := d.codec.OpenDigestFile(path, digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	h := util.NewDigestHash()
+	if _, err := io.Copy(h, reader); err != nil {
+		return err
+	}
+	if actual := util.DigestString(h); actual != digest {
+		return util.NewInternalError("digest mismatch, expected:%v, actual:%v", digest, actual)
+	}
+	return nil
+}
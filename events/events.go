@@ -0,0 +1,80 @@
+package events
+
+import (
+	"time"
+)
+
+//scheduler 发布的事件,payload 为 json,字段说明见 README
+const (
+	//dea 上传 droplet 成功
+	DropletUploaded			= "scheduler.droplet.uploaded"
+	//cc 上传 app package 成功
+	PackageUploaded			= "scheduler.package.uploaded"
+	//droplet/package/buildpack cache 被删除(本地缓存和 jss)
+	ArtifactDeleted			= "scheduler.artifact.deleted"
+	//dea 超时未上报资源,从资源池中移除
+	DeaStale				= "scheduler.dea.stale"
+	//一次调度完成
+	PlacementDecided		= "scheduler.placement.decided"
+)
+
+//事件中的数据类型
+const (
+	ArtifactDroplet			= "droplet"
+	ArtifactPackage			= "package"
+	ArtifactBuildpackCache	= "buildpack_cache"
+)
+
+//删除的触发来源
+const (
+	SourceApi				= "api"
+	SourceAppDeleted		= "jae.deleted"
+	SourceStagingSuccess	= "jae.staging.success"
+)
+
+//scheduler.droplet.uploaded / scheduler.package.uploaded
+type ArtifactUploadedEvent struct {
+	Type					string				`json:"type"`
+	Guid					string				`json:"guid"`
+	Digest					string				`json:"digest"`
+	Size					int64				`json:"size"`
+	RequestId				string				`json:"request_id,omitempty"`
+	Time					time.Time			`json:"time"`
+}
+
+//scheduler.artifact.deleted
+type ArtifactDeletedEvent struct {
+	Type					string				`json:"type"`
+	Guid					string				`json:"guid"`
+	Source					string				`json:"source"`
+	//本地缓存已删除,jss 数据还在删除日志中等待后台删除
+	Pending					bool				`json:"pending"`
+	RequestId				string				`json:"request_id,omitempty"`
+	Time					time.Time			`json:"time"`
+}
+
+//scheduler.dea.stale
+type DeaStaleEvent struct {
+	DeaId					string				`json:"dea_id"`
+	Zone					string				`json:"zone,omitempty"`
+	Stacks					[]string			`json:"stacks"`
+	AppIdToCount			map[string]int		`json:"app_id_to_count"`
+	TimeOfLastUpdate		time.Time			`json:"time_of_last_update"`
+	Time					time.Time			`json:"time"`
+}
+
+//scheduler.placement.decided
+type PlacementDecidedEvent struct {
+	AppId					string				`json:"app_id"`
+	Memory					int					`json:"memory"`
+	Disk					int					`json:"disk"`
+	Stacks					string				`json:"stacks"`
+	Docker					bool				`json:"docker"`
+	OwnerApp				bool				`json:"owner_app"`
+	OtherDea				bool				`json:"other_dea"`
+	Candidates				int					`json:"candidates"`
+	//选中的 dea,没有可用 dea 时为空
+	DeaId					string				`json:"dea_id"`
+	OwnerDeaIds				[]string			`json:"owner_dea_ids"`
+	Time					time.Time			`json:"time"`
+}
@@ -0,0 +1,52 @@
+package events
+
+import (
+	"encoding/json"
+	steno "github.com/cloudfoundry/gosteno"
+	"scheduler/bus"
+	"scheduler/config"
+)
+
+//发布 scheduler 事件,未开启的事件类型直接忽略
+type Publisher struct {
+	messageBus				bus.MessageBus
+	enabled					map[string]bool
+	logger					*steno.Logger
+}
+
+func NewPublisher(c *config.Config, mbus bus.MessageBus) *Publisher {
+	return &Publisher{
+		messageBus:		mbus,
+		enabled:		map[string]bool{
+			DropletUploaded:		c.Events.DropletUploaded,
+			PackageUploaded:		c.Events.PackageUploaded,
+			ArtifactDeleted:		c.Events.ArtifactDeleted,
+			DeaStale:				c.Events.DeaStale,
+			PlacementDecided:		c.Events.PlacementDecided,
+		},
+		logger:			steno.NewLogger("cc_helper"),
+	}
+}
+
+//事件类型是否开启
+func (p *Publisher) Enabled(subject string) bool {
+	return p.enabled[subject]
+}
+
+//发布事件,失败时只记录日志,不影响调用方
+func (p *Publisher) Publish(subject string, event interface{}) {
+	if !p.enabled[subject] {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		p.logger.Errorf("encode event %v fail, err:%v", subject, err)
+		return
+	}
+	if err := p.messageBus.Publish(subject, data); err != nil {
+		p.logger.Warnf("publish event %v fail, err:%v", subject, err)
+		return
+	}
+	p.logger.Debugf("published event %v:%s", subject, data)
+}
@@ -5,10 +5,10 @@ import (
 	"scheduler/apppackage"
 	"scheduler/buildpackcache"
 	steno "github.com/cloudfoundry/gosteno"
-	"github.com/cloudfoundry/yagnats"
+	"scheduler/bus"
 	"time"
 	"scheduler/config"
-	"scheduler/util"
+	"scheduler/events"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -22,13 +22,22 @@ type Listener struct {
    droplet				*droplet.DropletMgm
    packages				*apppackage.PackageMgm
    buildpack			*buildpackcache.BuildpackMgm
-   messageBus     		yagnats.NATSClient
+   messageBus     		bus.MessageBus
+   publisher			*events.Publisher
    logger         		*steno.Logger
-   dropletJss			*util.JssUtil
-   packageJss    		*util.JssUtil
    ticker 		   		*time.Ticker
    timeOutThreshold 	time.Duration
    CacheTimeOut			int
+   //nats 订阅id,退出时取消订阅
+   subscriptions		[]int64
+   //最近处理过的消息(subject+guid -> 处理时间),用于去重
+   processed			map[string]time.Time
+   dedupeWindow			time.Duration
+   //打包成功后预热 droplet 缓存,由固定个数的 worker 处理
+   prewarm				bool
+   prewarmWorkers		int
+   prewarmQueue			chan string
+   stopChan				chan struct{}
 }
 
 //应用打包成功需要监听消息,删除本地缓存和 jss
@@ -36,27 +45,100 @@ type StagingSucc struct {
 	Guid string `json:"guid"`
 }
 
+//等待预热的 droplet 个数上限
+const prewarmQueueSize = 256
+
 //新建listener 对象
-func NewListener(c *config.Config, mbus yagnats.NATSClient, dropletMgm *droplet.DropletMgm, packageMgm *apppackage.PackageMgm, buildpackmgm *buildpackcache.BuildpackMgm) *Listener{
+func NewListener(c *config.Config, mbus bus.MessageBus, dropletMgm *droplet.DropletMgm, packageMgm *apppackage.PackageMgm, buildpackmgm *buildpackcache.BuildpackMgm) *Listener{
 	
 	return &Listener{
 		droplet:		dropletMgm,
 		packages:		packageMgm,
 		buildpack:		buildpackmgm,
 		messageBus:		mbus,
+		publisher:		events.NewPublisher(c, mbus),
 		logger: 		steno.NewLogger("cc_helper"),
-		dropletJss:		util.NewJssUtil(c, true),
-		packageJss:		util.NewJssUtil(c, false),
 		timeOutThreshold: time.Duration(c.Droplet.CacheInterval) * time.Second,
 		CacheTimeOut: c.Droplet.CacheTimeOut,
+		stopChan: make(chan struct{}),
+		processed: make(map[string]time.Time),
+		dedupeWindow: time.Duration(c.Deletion.DedupeWindowSecond) * time.Second,
+		prewarm: c.Droplet.PrewarmOnStaging,
+		prewarmWorkers: c.Droplet.PrewarmWorkers,
+		prewarmQueue: make(chan string, prewarmQueueSize),
 	}
 }
 
 //启动listener
 func (l *Listener) Start(){
+	l.droplet.Deletions().Start()
+	l.packages.Deletions().Start()
 	l.subScribeDelApp()
 	l.subScribeStagingSuccess()
 	l.startPruningCycle()
+	l.startPrewarmWorkers()
+}
+
+//启动预热 worker,listener 停止时退出
+func (l *Listener) startPrewarmWorkers() {
+	if !l.prewarm {
+		return
+	}
+	workers := l.prewarmWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-l.stopChan:
+					return
+				case guid := <-l.prewarmQueue:
+					l.droplet.PrewarmDroplet(guid)
+				}
+			}
+		}()
+	}
+}
+
+//停止listener:取消nats订阅,停止缓存检测
+func (l *Listener) Stop(){
+	l.lock.Lock()
+	subscriptions := l.subscriptions
+	l.subscriptions = nil
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+	l.lock.Unlock()
+	
+	select {
+	case <-l.stopChan:
+	default:
+		close(l.stopChan)
+	}
+	
+	for _, sid := range subscriptions {
+		if err := l.messageBus.Unsubscribe(sid); err != nil {
+			l.logger.Errorf("unsubscribe sid:%v fail:%v", sid, err)
+		}
+	}
+	l.droplet.Deletions().Stop()
+	l.packages.Deletions().Stop()
+	l.logger.Info("listener stopped")
+}
+
+//记录订阅id
+func (l *Listener) addSubscription(subject string, sid int64, err error){
+	if err != nil {
+		l.logger.Errorf("Error subscribing to %s: %s", subject, err)
+		return
+	}
+	
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	
+	l.subscriptions = append(l.subscriptions, sid)
 }
 
 //监控本地缓存使用情况
@@ -71,7 +153,10 @@ func (l *Listener) startPruningCycle (){
 				select {
 				case <-l.ticker.C:
 					l.droplet.CheckCacheDroplet()
+					l.packages.CheckCachePackage()
 					l.buildpack.CheckCacheBuildpack()
+				case <-l.stopChan:
+					return
 				}
 			}
 		}()
@@ -81,7 +166,7 @@ func (l *Listener) startPruningCycle (){
 //监听应用打包成功消息
 func (l *Listener) subScribeStagingSuccess() {
 	l.logger.Infof("start sub-scribe topic: jae.staging.success")
-	l.messageBus.Subscribe("jae.staging.success", func(message *yagnats.Message) {
+	sid, err := l.messageBus.Subscribe("jae.staging.success", func(message *bus.Message) {
 	
 		start := time.Now()
 		payload := message.Payload
@@ -97,46 +182,95 @@ func (l *Listener) subScribeStagingSuccess() {
 		guid := msg.Guid
 		l.logger.Infof("process jae.staging.success app guid:%v",guid)
 		
+		//每次重新打包都需要删除 package,消息中没有区分不同打包的字段,不去重
 		if guid == "" {
 			return
 		}
 		
-		//删除本地缓存文件
+		//删除 package(本地缓存和jss),清除 droplet 的本地缓存信息
 		l.packages.DestoryPackage(guid)
-		l.droplet.DestoryDroplet(guid)
+		l.droplet.EvictDroplet(guid)
+		l.publishDeleted(events.ArtifactPackage, guid, events.SourceStagingSuccess)
 		
-		//删除jss
-		l.packageJss.Remove(guid)
+		//在 dea 启动应用之前准备好 droplet 缓存,不阻塞消息处理
+		if l.prewarm {
+			select {
+			case l.prewarmQueue <- guid:
+			default:
+				l.logger.Warnf("prewarm queue full, skip prewarm droplet,guid:%v", guid)
+			}
+		}
 		
 		end := time.Now()
 		l.logger.Infof("应用打包成功 清空jss,cache(app packages) 耗时:%v",end.Sub(start))
 	})
+	l.addSubscription("jae.staging.success", sid, err)
 }
 
 //监听删除应用的消息,删除应用需要同时删除 jss,本地缓存的 droplet / app package
 func (l *Listener) subScribeDelApp(){
 
 	l.logger.Infof("start sub-scribe topic: jae.deleted")
-	l.messageBus.Subscribe("jae.deleted", func(message *yagnats.Message) {
+	sid, err := l.messageBus.Subscribe("jae.deleted", func(message *bus.Message) {
 	
 		start := time.Now()
 		guid := string(message.Payload)
 		l.logger.Infof("process jae delete app guid:%v",guid)
 		
-		if guid == "" {
+		if guid == "" || l.duplicated("jae.deleted", guid) {
 			return
 		}
 		
-		//删除本地缓存文件
+		//删除本地缓存文件和jss(droplet/package 按引用计数删除)
 		l.packages.DestoryPackage(guid)
 		l.droplet.DestoryDroplet(guid)
 		l.buildpack.DestoryBuildpack(guid)
-		
-		//删除jss
-		l.dropletJss.Remove(guid)
-		l.packageJss.Remove(guid)
+		l.publishDeleted(events.ArtifactPackage, guid, events.SourceAppDeleted)
+		l.publishDeleted(events.ArtifactDroplet, guid, events.SourceAppDeleted)
+		l.publishDeleted(events.ArtifactBuildpackCache, guid, events.SourceAppDeleted)
 		
 		end := time.Now()
 		l.logger.Infof("删除应用app 清空jss,cache 耗时:%v",end.Sub(start))
 	})
+	l.addSubscription("jae.deleted", sid, err)
+}
+
+//dedupeWindow 内已经处理过相同 guid 的消息时返回 true
+func (l *Listener) duplicated(subject string, guid string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	for key, t := range l.processed {
+		if now.Sub(t) > l.dedupeWindow {
+			delete(l.processed, key)
+		}
+	}
+
+	key := subject + ":" + guid
+	if _, found := l.processed[key]; found {
+		l.logger.Infof("ignore duplicated %v message, guid:%v", subject, guid)
+		return true
+	}
+	l.processed[key] = now
+	return false
+}
+
+//发布删除事件,jss 数据还在删除日志中等待删除时 pending 为 true
+func (l *Listener) publishDeleted(artifact string, guid string, source string) {
+	pending := false
+	switch artifact {
+	case events.ArtifactDroplet:
+		pending = len(l.droplet.Deletions().PendingFor(guid)) > 0
+	case events.ArtifactPackage:
+		pending = len(l.packages.Deletions().PendingFor(guid)) > 0
+	}
+
+	l.publisher.Publish(events.ArtifactDeleted, &events.ArtifactDeletedEvent{
+		Type:		artifact,
+		Guid:		guid,
+		Source:		source,
+		Pending:	pending,
+		Time:		time.Now(),
+	})
 }
@@ -0,0 +1,390 @@
+//==============================================================
+// scheduler 节点发现和缓存共享:节点通过 nats 心跳互相发现,
+// 按 guid 一致性 hash 确定 owner,本地缓存未命中时先从 owner 下载
+//==============================================================
+
+package peer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	steno "github.com/cloudfoundry/gosteno"
+	"scheduler/bus"
+	"scheduler/config"
+	"scheduler/util"
+)
+
+const (
+	//节点心跳
+	SubjectHeartbeat		= "scheduler.peer.heartbeat"
+	//节点退出
+	SubjectLeave			= "scheduler.peer.leave"
+	//超过该心跳间隔倍数没有心跳的节点被移除
+	expireIntervals			= 3
+	//数据摘要 header,请求方用来校验下载的数据
+	HeaderDigest			= "X-Artifact-Digest"
+)
+
+//scheduler 节点
+type Peer struct {
+	Id					string				`json:"id"`
+	Url					string				`json:"url"`
+	LastSeen			time.Time			`json:"last_seen"`
+}
+
+//心跳消息,使用 peer.token 签名,防止其他 nats 客户端伪造节点地址骗取 token
+type heartbeat struct {
+	Id					string				`json:"id"`
+	Url					string				`json:"url"`
+	//发送时间(unix 秒)
+	Time				int64				`json:"time"`
+	Signature			string				`json:"signature"`
+}
+
+type Cluster struct {
+	enabled				bool
+	self				*Peer
+	token				string
+	interval			time.Duration
+	replicas			int
+	client				*http.Client
+	messageBus			bus.MessageBus
+
+	lock				sync.Mutex
+	peers				map[string]*Peer
+	ring				*Ring
+	sids				[]int64
+	stopChan			chan struct{}
+	stopped				bool
+	logger				*steno.Logger
+}
+
+func NewCluster(c *config.Config, mbus bus.MessageBus) *Cluster {
+	id := c.Peer.Id
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	cluster := &Cluster{
+		enabled:		c.Peer.Enabled,
+		self:			&Peer{Id: id, Url: c.Peer.Url},
+		token:			c.Peer.Token,
+		interval:		time.Duration(c.Peer.HeartbeatIntervalSecond) * time.Second,
+		replicas:		c.Peer.VirtualNodes,
+		client:			&http.Client{Timeout: time.Duration(c.Peer.TimeoutSecond) * time.Second},
+		messageBus:		mbus,
+		peers:			make(map[string]*Peer),
+		stopChan:		make(chan struct{}),
+		logger:			steno.NewLogger("cc_helper"),
+	}
+	cluster.rebuild()
+	return cluster
+}
+
+//是否开启缓存共享
+func (c *Cluster) Enabled() bool {
+	return c.enabled
+}
+
+//订阅其他节点的心跳,定时发送本节点心跳
+func (c *Cluster) Start() {
+	if !c.enabled {
+		return
+	}
+	if c.token == "" {
+		c.logger.Error("peer.token is not configured, peer cache sharing disabled")
+		c.enabled = false
+		return
+	}
+	if c.self.Url == "" {
+		c.logger.Warn("peer.url is not configured, other schedulers will not fetch from this node")
+	}
+
+	sid, err := c.messageBus.Subscribe(SubjectHeartbeat, func(message *bus.Message) {
+		if p, ok := c.verify(SubjectHeartbeat, message.Payload); ok {
+			c.join(p)
+		}
+	})
+	if err != nil {
+		c.logger.Errorf("subscribe %v fail:%v", SubjectHeartbeat, err)
+	}else {
+		c.sids = append(c.sids, sid)
+	}
+
+	sid, err = c.messageBus.Subscribe(SubjectLeave, func(message *bus.Message) {
+		if p, ok := c.verify(SubjectLeave, message.Payload); ok {
+			c.leave(p.Id)
+		}
+	})
+	if err != nil {
+		c.logger.Errorf("subscribe %v fail:%v", SubjectLeave, err)
+	}else {
+		c.sids = append(c.sids, sid)
+	}
+
+	c.heartbeat()
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stopChan:
+				return
+			case <-ticker.C:
+				c.heartbeat()
+				c.expire()
+			}
+		}
+	}()
+}
+
+//停止心跳并通知其他节点本节点退出
+func (c *Cluster) Stop() {
+	if !c.enabled {
+		return
+	}
+
+	c.lock.Lock()
+	if c.stopped {
+		c.lock.Unlock()
+		return
+	}
+	c.stopped = true
+	close(c.stopChan)
+	sids := c.sids
+	c.sids = nil
+	c.lock.Unlock()
+
+	for _, sid := range sids {
+		c.messageBus.Unsubscribe(sid)
+	}
+	if c.self.Url != "" {
+		c.publish(SubjectLeave)
+	}
+}
+
+func (c *Cluster) heartbeat() {
+	if c.self.Url != "" {
+		c.publish(SubjectHeartbeat)
+	}
+}
+
+func (c *Cluster) publish(subject string) {
+	hb := &heartbeat{Id: c.self.Id, Url: c.self.Url, Time: time.Now().Unix()}
+	hb.Signature = c.sign(subject, hb)
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return
+	}
+	if err := c.messageBus.Publish(subject, data); err != nil {
+		c.logger.Warnf("publish %v fail:%v", subject, err)
+	}
+}
+
+//签名内容: subject id url time
+func (c *Cluster) sign(subject string, hb *heartbeat) string {
+	h := hmac.New(sha256.New, []byte(c.token))
+	h.Write([]byte(subject + "\n" + hb.Id + "\n" + hb.Url + "\n" + strconv.FormatInt(hb.Time, 10)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//校验心跳签名和发送时间,签名错误或者超过节点过期时间的消息直接忽略
+func (c *Cluster) verify(subject string, payload []byte) (*Peer, bool) {
+	var hb heartbeat
+	if err := json.Unmarshal(payload, &hb); err != nil {
+		c.logger.Warnf("%v, invalid payload:%s", subject, payload)
+		return nil, false
+	}
+	if !hmac.Equal([]byte(hb.Signature), []byte(c.sign(subject, &hb))) {
+		c.logger.Warnf("%v, invalid signature, id:%v, url:%v", subject, hb.Id, hb.Url)
+		return nil, false
+	}
+	skew := time.Since(time.Unix(hb.Time, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > expireIntervals * c.interval {
+		c.logger.Warnf("%v, expired message, id:%v, url:%v, time:%v", subject, hb.Id, hb.Url, hb.Time)
+		return nil, false
+	}
+	return &Peer{Id: hb.Id, Url: hb.Url}, true
+}
+
+//收到心跳,新节点或者地址变化时重建 hash 环
+func (c *Cluster) join(p *Peer) {
+	if p.Id == "" || p.Url == "" || p.Id == c.self.Id {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	old, found := c.peers[p.Id]
+	c.peers[p.Id] = &Peer{Id: p.Id, Url: p.Url, LastSeen: time.Now()}
+	if !found || old.Url != p.Url {
+		c.logger.Infof("peer joined, id:%v, url:%v", p.Id, p.Url)
+		c.rebuildLocked()
+	}
+}
+
+func (c *Cluster) leave(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.peers[id]; found {
+		c.logger.Infof("peer left, id:%v", id)
+		delete(c.peers, id)
+		c.rebuildLocked()
+	}
+}
+
+//移除心跳超时的节点
+func (c *Cluster) expire() {
+	deadline := time.Now().Add(-expireIntervals * c.interval)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	changed := false
+	for id, p := range c.peers {
+		if p.LastSeen.Before(deadline) {
+			c.logger.Warnf("peer expired, id:%v, url:%v, last seen:%v", id, p.Url, p.LastSeen)
+			delete(c.peers, id)
+			changed = true
+		}
+	}
+	if changed {
+		c.rebuildLocked()
+	}
+}
+
+func (c *Cluster) rebuild() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rebuildLocked()
+}
+
+//重建 hash 环,本节点没有配置 url 时不参与分配
+func (c *Cluster) rebuildLocked() {
+	ids := []string{}
+	if c.self.Url != "" {
+		ids = append(ids, c.self.Id)
+	}
+	for id := range c.peers {
+		ids = append(ids, id)
+	}
+	c.ring = NewRing(c.replicas, ids)
+}
+
+//返回 guid 的 owner,owner 为本节点或者没有其他节点时返回 false
+func (c *Cluster) Owner(guid string) (*Peer, bool) {
+	if !c.enabled {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	p, found := c.peers[c.ring.Get(guid)]
+	if !found {
+		return nil, false
+	}
+	owner := *p
+	return &owner, true
+}
+
+//返回所有节点(包括本节点),按 id 排序
+func (c *Cluster) Peers() []*Peer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	peers := []*Peer{{Id: c.self.Id, Url: c.self.Url, LastSeen: time.Now()}}
+	for _, p := range c.peers {
+		copied := *p
+		peers = append(peers, &copied)
+	}
+	sort.Sort(peersById(peers))
+	return peers
+}
+
+type peersById []*Peer
+
+func (p peersById) Len() int           { return len(p) }
+func (p peersById) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p peersById) Less(i, j int) bool { return p[i].Id < p[j].Id }
+
+/**
+	从 guid 的 owner 下载摘要对应的数据到 path
+	1:下载的是 owner 本地缓存中的原始数据(压缩/加密),所有节点需要使用相同的 storage 配置
+	2:先写临时文件,完成后 rename,调用方负责校验内容摘要
+	3:owner 为本节点或者下载失败时返回错误,调用方从 jss 下载
+**/
+func (c *Cluster) Fetch(kind string, guid string, digest string, path string) error {
+	owner, found := c.Owner(guid)
+	if !found {
+		return util.NewNotFoundError("no peer owns %v, guid:%v", kind, guid)
+	}
+
+	transfer := util.BeginTransfer(kind, util.TransferPeerDownload, guid)
+	size, err := c.fetch(owner, kind, digest, path)
+	transfer.End(size, err)
+	if err != nil {
+		c.logger.Warnf("fetch %v from peer %v fail, guid:%v, digest:%v, err:%v", kind, owner.Id, guid, digest, err)
+		return err
+	}
+	c.logger.Infof("fetch %v from peer %v success, guid:%v, digest:%v, size:%v", kind, owner.Id, guid, digest, size)
+	return nil
+}
+
+func (c *Cluster) fetch(owner *Peer, kind string, digest string, path string) (int64, error) {
+	request, err := http.NewRequest("GET", owner.Url+"/scheduler/peer/"+kind+"/"+digest, nil)
+	if err != nil {
+		return 0, util.NewInternalError("fetch %v from peer %v fail:%v", kind, owner.Id, err)
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return 0, util.NewBackendUnavailableError("fetch %v from peer %v fail:%v", kind, owner.Id, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == 404 {
+		return 0, util.NewNotFoundError("%v not found on peer %v, digest:%v", kind, owner.Id, digest)
+	}
+	if response.StatusCode != 200 {
+		return 0, util.NewBackendUnavailableError("fetch %v from peer %v fail, status:%v", kind, owner.Id, response.StatusCode)
+	}
+	if d := response.Header.Get(HeaderDigest); d != "" && d != digest {
+		return 0, util.NewBackendUnavailableError("fetch %v from peer %v, digest mismatch, expected:%v, actual:%v", kind, owner.Id, digest, d)
+	}
+
+	tmp := path + ".peer"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, util.CacheFileMode)
+	if err != nil {
+		return 0, util.NewInternalError("fetch %v from peer %v, create cache file fail:%v", kind, owner.Id, err)
+	}
+	size, err := io.Copy(file, response.Body)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, util.NewBackendUnavailableError("fetch %v from peer %v fail:%v", kind, owner.Id, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,147 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+	"scheduler/bus"
+	"scheduler/config"
+)
+
+func newTestCluster(mbus bus.MessageBus, id string, url string) *Cluster {
+	c := config.DefaultConfig()
+	c.Peer.Enabled = true
+	c.Peer.Id = id
+	c.Peer.Url = url
+	c.Peer.Token = "secret"
+	return NewCluster(c, mbus)
+}
+
+//找到 owner 为 id 的 guid
+func ownedBy(t *testing.T, c *Cluster, id string) string {
+	for i := 0; i < 1000; i++ {
+		guid := fmt.Sprintf("guid-%d", i)
+		if p, found := c.Owner(guid); found && p.Id == id {
+			return guid
+		}
+	}
+	t.Fatalf("no guid owned by %v", id)
+	return ""
+}
+
+func TestClusterDiscovery(t *testing.T) {
+	mbus := bus.NewMemoryBus()
+	a := newTestCluster(mbus, "a", "http://a")
+	b := newTestCluster(mbus, "b", "http://b")
+	a.Start()
+	b.Start()
+	defer b.Stop()
+	a.heartbeat()
+
+	if len(a.Peers()) != 2 || len(b.Peers()) != 2 {
+		t.Fatalf("peers not discovered, a:%v, b:%v", len(a.Peers()), len(b.Peers()))
+	}
+
+	//每个 guid 只有一个 owner
+	for i := 0; i < 100; i++ {
+		guid := fmt.Sprintf("guid-%d", i)
+		_, ownedByB := a.Owner(guid)
+		_, ownedByA := b.Owner(guid)
+		if ownedByA == ownedByB {
+			t.Fatalf("guid %v owned by both or neither", guid)
+		}
+	}
+
+	a.Stop()
+	if len(b.Peers()) != 1 {
+		t.Fatalf("peer not removed after leave: %v", len(b.Peers()))
+	}
+}
+
+func TestClusterRejectsForgedHeartbeat(t *testing.T) {
+	mbus := bus.NewMemoryBus()
+	a := newTestCluster(mbus, "a", "http://a")
+	a.Start()
+	defer a.Stop()
+
+	forged, _ := json.Marshal(&heartbeat{Id: "evil", Url: "http://evil", Time: time.Now().Unix(), Signature: "00"})
+	mbus.Publish(SubjectHeartbeat, forged)
+
+	other := newTestCluster(bus.NewMemoryBus(), "x", "")
+	other.token = "wrong"
+	hb := &heartbeat{Id: "evil", Url: "http://evil", Time: time.Now().Unix()}
+	hb.Signature = other.sign(SubjectHeartbeat, hb)
+	data, _ := json.Marshal(hb)
+	mbus.Publish(SubjectHeartbeat, data)
+
+	stale := &heartbeat{Id: "old", Url: "http://old", Time: time.Now().Add(-time.Hour).Unix()}
+	stale.Signature = a.sign(SubjectHeartbeat, stale)
+	data, _ = json.Marshal(stale)
+	mbus.Publish(SubjectHeartbeat, data)
+
+	if len(a.Peers()) != 1 {
+		t.Fatalf("forged heartbeat accepted: %v", a.Peers())
+	}
+}
+
+func TestClusterFetch(t *testing.T) {
+	var gotPath, gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		if r.URL.Path == "/scheduler/peer/droplet/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(HeaderDigest, "abcd")
+		w.Write([]byte("payload"))
+	}))
+	defer srv.Close()
+
+	mbus := bus.NewMemoryBus()
+	owner := newTestCluster(mbus, "owner", srv.URL)
+	local := newTestCluster(mbus, "local", "http://local")
+	owner.Start()
+	local.Start()
+	defer owner.Stop()
+	defer local.Stop()
+	owner.heartbeat()
+
+	dir, err := ioutil.TempDir("", "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "abcd")
+	guid := ownedBy(t, local, "owner")
+
+	if err := local.Fetch("droplet", guid, "abcd", path); err != nil {
+		t.Fatalf("fetch fail: %v", err)
+	}
+	if gotPath != "/scheduler/peer/droplet/abcd" || gotAuth != "Bearer secret" {
+		t.Fatalf("unexpected request, path:%v, auth:%v", gotPath, gotAuth)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "payload" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+
+	if err := local.Fetch("droplet", guid, "other", filepath.Join(dir, "other")); err == nil {
+		t.Fatal("digest mismatch not detected")
+	}
+	if err := local.Fetch("droplet", guid, "missing", filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("missing artifact not reported")
+	}
+
+	//owner 为本节点时不请求其他节点
+	self := ownedBy(t, owner, "local")
+	if _, found := owner.Owner(self); !found {
+		t.Fatal("owner should see local as owner")
+	}
+	if _, found := local.Owner(self); found {
+		t.Fatal("local should own guid itself")
+	}
+}
@@ -0,0 +1,52 @@
+package peer
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+//一致性 hash 环,每个节点对应多个虚拟节点,节点增减时只有少量 guid 更换 owner
+type Ring struct {
+	replicas			int
+	hashes				[]uint32
+	nodes				map[uint32]string
+}
+
+func NewRing(replicas int, nodes []string) *Ring {
+	if replicas <= 0 {
+		replicas = 1
+	}
+	r := &Ring{replicas: replicas, nodes: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + node))
+			if _, found := r.nodes[h]; found {
+				continue
+			}
+			r.nodes[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Sort(uint32s(r.hashes))
+	return r
+}
+
+//返回 key 对应的节点,环为空时返回空字符串
+func (r *Ring) Get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+type uint32s []uint32
+
+func (u uint32s) Len() int           { return len(u) }
+func (u uint32s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint32s) Less(i, j int) bool { return u[i] < u[j] }
@@ -0,0 +1,46 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingEmpty(t *testing.T) {
+	r := NewRing(10, nil)
+	if node := r.Get("guid"); node != "" {
+		t.Fatalf("empty ring returned %q", node)
+	}
+}
+
+func TestRingDistribution(t *testing.T) {
+	r := NewRing(100, []string{"a", "b", "c"})
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[r.Get(fmt.Sprintf("guid-%d", i))]++
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if counts[node] < 500 {
+			t.Fatalf("node %v owns only %v of 3000 keys: %v", node, counts[node], counts)
+		}
+	}
+}
+
+func TestRingStable(t *testing.T) {
+	before := NewRing(100, []string{"a", "b", "c"})
+	after := NewRing(100, []string{"c", "a", "b", "d"})
+
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("guid-%d", i)
+		if before.Get(key) != after.Get(key) {
+			if after.Get(key) != "d" {
+				t.Fatalf("key %v moved between existing nodes", key)
+			}
+			moved++
+		}
+	}
+	//新增一个节点时只有约 1/4 的 key 迁移到新节点
+	if moved == 0 || moved > 1500 {
+		t.Fatalf("unexpected moved keys: %v", moved)
+	}
+}
@@ -0,0 +1,374 @@
+//==============================================================
+// jss 孤儿数据清理:列举 jss 中的 droplet/app package,向平台查询
+// guid 是否存在,报告或删除已经不存在的应用的数据
+//==============================================================
+
+package reconcile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	steno "github.com/cloudfoundry/gosteno"
+	"scheduler/apppackage"
+	"scheduler/config"
+	"scheduler/droplet"
+	"scheduler/util"
+)
+
+//已经有清理任务在执行
+var ErrRunning = util.NewConflictError("reconcile already running")
+
+//一种数据(droplet/app package)的清理结果
+type Report struct {
+	Kind				string				`json:"kind"`
+	DryRun				bool				`json:"dry_run"`
+	Started				time.Time			`json:"started"`
+	Finished			time.Time			`json:"finished"`
+	//jss 中的对象个数
+	Objects				int					`json:"objects"`
+	//向平台查询的 guid 个数
+	Guids				int					`json:"guids"`
+	Live				int					`json:"live"`
+	//平台没有返回结果的 guid,不做处理
+	Unknown				int					`json:"unknown"`
+	//上传时间不足 min_age_second 的对象,不做处理
+	SkippedRecent		int					`json:"skipped_recent"`
+	OrphanGuids			[]string			`json:"orphan_guids"`
+	OrphanDigests		[]string			`json:"orphan_digests"`
+	//提交到删除日志的个数
+	Deleted				int					`json:"deleted"`
+	Error				string				`json:"error,omitempty"`
+}
+
+//清理任务状态
+type Status struct {
+	Running				bool				`json:"running"`
+	Reports				[]*Report			`json:"reports"`
+}
+
+//需要清理的一种数据
+type target struct {
+	backend				*util.JssUtil
+	deletions			*util.DeleteJournal
+	//删除 guid 的本地缓存、引用和数据
+	destroy				func(guid string)
+}
+
+type Reconciler struct {
+	source				*Source
+	configured			bool
+	interval			time.Duration
+	dryRun				bool
+	minAge				time.Duration
+	batchSize			int
+	maxDeletes			int
+	targets				[]*target
+
+	lock				sync.Mutex
+	running				bool
+	reports				[]*Report
+	stopChan			chan struct{}
+	stopped				bool
+	logger				*steno.Logger
+}
+
+//batch_size 未配置或配置错误时每次查询的 guid 个数
+const defaultBatchSize = 500
+
+func NewReconciler(c *config.Config, dropletMgm *droplet.DropletMgm, packageMgm *apppackage.PackageMgm) *Reconciler {
+	batchSize := c.Reconcile.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	return &Reconciler{
+		source:			NewSource(c),
+		configured:		c.Reconcile.SourceUrl != "",
+		interval:		time.Duration(c.Reconcile.IntervalSecond) * time.Second,
+		dryRun:			c.Reconcile.DryRun,
+		minAge:			time.Duration(c.Reconcile.MinAgeSecond) * time.Second,
+		batchSize:		batchSize,
+		maxDeletes:		c.Reconcile.MaxDeletes,
+		targets:		[]*target{
+			{backend: dropletMgm.Backend(), deletions: dropletMgm.Deletions(), destroy: dropletMgm.DestoryDroplet},
+			{backend: packageMgm.Backend(), deletions: packageMgm.Deletions(), destroy: packageMgm.DestoryPackage},
+		},
+		reports:		[]*Report{},
+		stopChan:		make(chan struct{}),
+		logger:			steno.NewLogger("cc_helper"),
+	}
+}
+
+//配置了 source_url 和 interval_second 时定时执行
+func (r *Reconciler) Start() {
+	if !r.configured || r.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stopChan:
+				return
+			case <-ticker.C:
+				if err := r.Run(r.dryRun); err != nil {
+					r.logger.Warnf("reconcile fail:%v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *Reconciler) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.stopped {
+		r.stopped = true
+		close(r.stopChan)
+	}
+}
+
+//在后台执行一次清理,已经在执行时返回 ErrRunning
+func (r *Reconciler) RunAsync(dryRun bool) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	go r.run(dryRun)
+	return nil
+}
+
+//执行一次清理
+func (r *Reconciler) Run(dryRun bool) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	r.run(dryRun)
+	return nil
+}
+
+func (r *Reconciler) begin() error {
+	if !r.configured {
+		return util.NewBadRequestError("reconcile.source_url is not configured")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.running {
+		return ErrRunning
+	}
+	r.running = true
+	return nil
+}
+
+func (r *Reconciler) run(dryRun bool) {
+	reports := []*Report{}
+	for _, t := range r.targets {
+		report := r.reconcile(t, dryRun)
+		r.logger.Infof("reconcile %v finished, dry_run:%v, objects:%v, guids:%v, orphan guids:%v, orphan digests:%v, deleted:%v, error:%v",
+			report.Kind, dryRun, report.Objects, report.Guids, len(report.OrphanGuids), len(report.OrphanDigests), report.Deleted, report.Error)
+		reports = append(reports, report)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.running = false
+	r.reports = reports
+}
+
+//返回最近一次清理结果
+func (r *Reconciler) Status() *Status {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return &Status{Running: r.running, Reports: r.reports}
+}
+
+/**
+	清理一种数据
+	1:列举 jss 中的对象,按 key 分为旧版本按 guid 保存的数据、guid 引用对象(refs/)、按摘要保存的数据(sha256/)
+	2:向平台查询 guid 是否存在,平台明确返回不存在的 guid 为孤儿
+	3:没有被任何非孤儿 guid 引用的摘要数据为孤儿
+	4:非 dry run 时通过删除日志删除孤儿数据
+**/
+func (r *Reconciler) reconcile(t *target, dryRun bool) *Report {
+	report := &Report{
+		Kind:			t.backend.Desc(),
+		DryRun:			dryRun,
+		Started:		time.Now(),
+		OrphanGuids:	[]string{},
+		OrphanDigests:	[]string{},
+	}
+	defer func() {
+		report.Finished = time.Now()
+	}()
+
+	//guid -> 是否所有对象都超过 minAge
+	guids := make(map[string]bool)
+	refs := make(map[string]bool)
+	legacy := make(map[string]bool)
+	digests := make(map[string]bool)
+	expire := report.Started.Add(-r.minAge)
+
+	err := t.backend.List("", func(objects []*util.JssObject) error {
+		for _, o := range objects {
+			report.Objects++
+			old := !o.LastModified.IsZero() && o.LastModified.Before(expire)
+
+			switch {
+			case strings.HasPrefix(o.Key, util.JssDigestPrefix):
+				digests[strings.TrimPrefix(o.Key, util.JssDigestPrefix)] = old
+			case strings.HasPrefix(o.Key, util.JssRefPrefix):
+				guid := strings.TrimPrefix(o.Key, util.JssRefPrefix)
+				refs[guid] = true
+				guids[guid] = guidOld(guids, guid, old)
+			case !strings.Contains(o.Key, "/"):
+				legacy[o.Key] = true
+				guids[o.Key] = guidOld(guids, o.Key, old)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	//查询超过 minAge 的 guid 是否存在
+	candidates := []string{}
+	for guid, old := range guids {
+		if old {
+			candidates = append(candidates, guid)
+		} else {
+			report.SkippedRecent++
+		}
+	}
+	sort.Strings(candidates)
+	report.Guids = len(candidates)
+
+	orphans := make(map[string]bool)
+	for i := 0; i < len(candidates); i += r.batchSize {
+		end := i + r.batchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		live, err := r.source.Live(candidates[i:end])
+		if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+		for _, guid := range candidates[i:end] {
+			exists, found := live[guid]
+			switch {
+			case !found:
+				report.Unknown++
+			case exists:
+				report.Live++
+			default:
+				orphans[guid] = true
+				report.OrphanGuids = append(report.OrphanGuids, guid)
+			}
+		}
+	}
+
+	//非孤儿 guid 引用的摘要,读取引用失败时无法判断摘要是否孤儿,跳过摘要清理
+	referenced := make(map[string]bool)
+	refsComplete := true
+	for guid := range refs {
+		if orphans[guid] {
+			continue
+		}
+		digest, found, err := t.backend.LookupRef(guid)
+		if err != nil {
+			refsComplete = false
+			continue
+		}
+		//列举之后被删除的引用不再引用任何摘要
+		if found {
+			referenced[digest] = true
+		}
+	}
+
+	if refsComplete {
+		for digest, old := range digests {
+			if !old {
+				report.SkippedRecent++
+			} else if !referenced[digest] {
+				report.OrphanDigests = append(report.OrphanDigests, digest)
+			}
+		}
+		sort.Strings(report.OrphanDigests)
+	} else {
+		report.Error = "read refs from jss fail, skip orphan digests"
+	}
+
+	if dryRun {
+		return report
+	}
+
+	total := len(report.OrphanGuids) + len(report.OrphanDigests)
+	if total > r.maxDeletes {
+		report.Error = fmt.Sprintf("%v orphans exceeds max_deletes %v, nothing deleted", total, r.maxDeletes)
+		return report
+	}
+
+	//删除前再次确认 guid 仍然不存在(列举和查询期间可能重新创建了应用)
+	confirmed, err := r.confirmOrphans(report.OrphanGuids)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	for _, guid := range report.OrphanGuids {
+		if !confirmed[guid] {
+			r.logger.Infof("reconcile %v, guid:%v no longer orphan, skip", report.Kind, guid)
+			continue
+		}
+		t.destroy(guid)
+		//destroy 在 guid 有引用对象时只删除引用,旧版本数据需要单独删除
+		if legacy[guid] && refs[guid] {
+			t.deletions.Delete(util.DeleteObject, guid, guid)
+		}
+		report.Deleted++
+	}
+	//删除日志在真正删除摘要数据前会再次检查 jss 中的引用和本地索引,列举之后重新引用的摘要不会被删除
+	for _, digest := range report.OrphanDigests {
+		t.deletions.Delete(util.DeleteDigest, digest, "")
+		report.Deleted++
+	}
+	return report
+}
+
+//再次查询 guid 是否存在,返回平台仍然明确返回不存在的 guid
+func (r *Reconciler) confirmOrphans(guids []string) (map[string]bool, error) {
+	confirmed := make(map[string]bool)
+	for i := 0; i < len(guids); i += r.batchSize {
+		end := i + r.batchSize
+		if end > len(guids) {
+			end = len(guids)
+		}
+		live, err := r.source.Live(guids[i:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, guid := range guids[i:end] {
+			if exists, found := live[guid]; found && !exists {
+				confirmed[guid] = true
+			}
+		}
+	}
+	return confirmed, nil
+}
+
+//guid 的所有对象都超过 minAge 时才处理
+func guidOld(guids map[string]bool, guid string, old bool) bool {
+	if prev, found := guids[guid]; found {
+		return prev && old
+	}
+	return old
+}
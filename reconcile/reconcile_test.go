@@ -0,0 +1,58 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"scheduler/apppackage"
+	"scheduler/config"
+	"scheduler/droplet"
+)
+
+//所有 guid 都返回不存在的 source
+func newTestSource() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req liveRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		resp := liveResponse{Guids: make(map[string]bool)}
+		for _, guid := range req.Guids {
+			resp.Guids[guid] = false
+		}
+		json.NewEncoder(w).Encode(&resp)
+	}))
+}
+
+func newTestReconciler(t *testing.T, sourceUrl string, batchSize int) (*Reconciler, string) {
+	dir, err := ioutil.TempDir("", "reconcile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.DefaultConfig()
+	c.Droplet.CacheBaseDir = dir
+	c.Package.CacheBaseDir = dir
+	c.Reconcile.SourceUrl = sourceUrl
+	c.Reconcile.BatchSize = batchSize
+	return NewReconciler(c, droplet.NewDropletMgm(c), apppackage.NewPackageMgm(c)), dir
+}
+
+//batch_size 配置为 0 或负数时使用默认值,不会死循环
+func TestReconcilerDefaultsBatchSize(t *testing.T) {
+	source := newTestSource()
+	defer source.Close()
+
+	for _, batchSize := range []int{0, -1} {
+		r, dir := newTestReconciler(t, source.URL, batchSize)
+		defer os.RemoveAll(dir)
+		if r.batchSize != defaultBatchSize {
+			t.Fatalf("batch_size %v: batchSize = %v", batchSize, r.batchSize)
+		}
+
+		confirmed, err := r.confirmOrphans([]string{"a", "b", "c"})
+		if err != nil || len(confirmed) != 3 {
+			t.Fatalf("batch_size %v: confirmed = %v, err:%v", batchSize, confirmed, err)
+		}
+	}
+}
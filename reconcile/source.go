@@ -0,0 +1,76 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+	"scheduler/config"
+)
+
+//查询 guid 是否存在的请求
+type liveRequest struct {
+	Guids				[]string			`json:"guids"`
+}
+
+//查询 guid 是否存在的返回值,没有返回的 guid 视为未知,不会被删除
+type liveResponse struct {
+	Guids				map[string]bool		`json:"guids"`
+}
+
+//应用是否存在以平台(cloud controller)为准,通过 http 接口查询
+type Source struct {
+	url					string
+	token				string
+	client				*http.Client
+}
+
+func NewSource(c *config.Config) *Source {
+	return &Source{
+		url:		c.Reconcile.SourceUrl,
+		token:		c.Reconcile.SourceToken,
+		client:		&http.Client{Timeout: time.Duration(c.Reconcile.TimeoutSecond) * time.Second},
+	}
+}
+
+//查询 guid 是否存在,返回 guid -> 是否存在
+func (s *Source) Live(guids []string) (map[string]bool, error) {
+	data, err := json.Marshal(&liveRequest{Guids: guids})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		request.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("source %v status %v: %s", s.url, response.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var result liveResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("source %v invalid response: %v", s.url, err)
+	}
+	if result.Guids == nil {
+		result.Guids = make(map[string]bool)
+	}
+	return result.Guids, nil
+}
@@ -11,7 +11,7 @@ package main
 
 import (
 
- "github.com/cloudfoundry/yagnats"
+ "scheduler/bus"
  steno "github.com/cloudfoundry/gosteno"
  "scheduler/codec"
  "scheduler/config"
@@ -20,15 +20,22 @@ import (
  "scheduler/controller"
  "flag"
  "strings"
- "fmt"
  "time"
  "scheduler/apppackage"
  "scheduler/buildpackcache"
  "scheduler/listener"
+ "scheduler/peer"
+ "scheduler/reconcile"
+ "os"
+ "os/signal"
+ "syscall"
 )
 
 var configFile string
 
+//日志输出,退出时需要 flush
+var logSinks []steno.Sink
+
 func init(){
 	flag.StringVar(&configFile, "c", "", "Configuration File")
 	
@@ -54,31 +61,35 @@ func main() {
 	
 	logger.Info("logger config: file:"+c.Logging.File+", level:"+c.Logging.Level+"")
 	
-	//初始化nats 客户端
-	logger.Info("logger config: Host:"+c.Nats.Host+",User:"+c.Nats.User+",pass:"+c.Nats.Pass+"")
-	natsClient := yagnats.NewClient()
-	addr := c.Nats.Host
-	
-	if !strings.HasPrefix(addr, "zk://") {
-		addr = fmt.Sprintf("%s:%d", c.Nats.Host, c.Nats.Port)
+	if err := c.Validate(); err != nil {
+		logger.Errorf("invalid config: %v", err)
+		os.Exit(1)
 	}
 	
-	natsInfo := &yagnats.ConnectionInfo{
-		Addr:     addr,
-		Username: c.Nats.User,
-		Password: c.Nats.Pass,
+	//单机开发模式,使用进程内消息总线
+	if c.Nats.InMemory {
+		logger.Info("nats in_memory enabled, using in-process message bus")
+		logger.Infof("helper config:%v",c)
+		Run(c, bus.NewMemoryBus())
+		return
 	}
 	
-	err = natsClient.Connect(natsInfo)
+	//初始化nats 客户端,连接失败时退避重试
+	logger.Info("logger config: Host:"+c.Nats.Host+",Servers:"+strings.Join(bus.NatsServers(c), ",")+",User:"+c.Nats.User+",pass:"+c.Nats.Pass+"")
+	natsBus, err := bus.NewNatsClusterBus(c)
+	if err != nil {
+		logger.Errorf("invalid nats config: %v", err)
+		os.Exit(1)
+	}
 	
-	for ; err != nil; {
-		err = natsClient.Connect(natsInfo)
-		logger.Errorf("Could not connect to NATS: ", err.Error())
-		time.Sleep(500 * time.Millisecond)
+	err = natsBus.Connect()
+	if err != nil {
+		logger.Errorf("Could not connect to NATS: %v", err)
+		os.Exit(1)
 	}
 	
 	logger.Infof("helper config:%v",c)
-	Run(c, natsClient)
+	Run(c, natsBus)
 }
 
 //初始化日志信息
@@ -91,6 +102,7 @@ func InitLoggerFromConfig(c *config.Config){
 
 	s := make([]steno.Sink, 0, 3)
 	s = append(s, steno.NewFileSink(c.Logging.File))
+	logSinks = s
 
 	stenoConfig := &steno.Config{
 		Sinks: s,
@@ -102,16 +114,64 @@ func InitLoggerFromConfig(c *config.Config){
 }
 
 //启动实例
-func Run(c *config.Config, mbus yagnats.NATSClient){
+func Run(c *config.Config, mbus bus.MessageBus){
+	logger := steno.NewLogger("cc_helper")
+	
 	deaPool := deapool.NewPool(c, mbus)
 	droplet := droplet.NewDropletMgm(c)
 	packages := apppackage.NewPackageMgm(c)
 	buildpack := buildpackcache.NewBuildpackMgm(c)
 	listener := listener.NewListener(c, mbus, droplet, packages, buildpack)
+	reconciler := reconcile.NewReconciler(c, droplet, packages)
+	peers := peer.NewCluster(c, mbus)
+	droplet.UsePeers(peers)
 	
-	controller := controller.NewController(c, deaPool, droplet, packages, buildpack)
+	controller := controller.NewController(c, mbus, deaPool, droplet, packages, buildpack, reconciler, peers)
 	
 	deaPool.Start()
 	listener.Start()
-	controller.Start()
+	reconciler.Start()
+	peers.Start()
+	
+	//监听退出信号
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		logger.Infof("receive signal:%v, shutting down", sig)
+		
+		Shutdown(c, mbus, deaPool, listener, reconciler, peers, controller)
+		close(stopped)
+	}()
+	
+	if err := controller.Start(); err != nil {
+		Shutdown(c, mbus, deaPool, listener, reconciler, peers, controller)
+		os.Exit(1)
+	}
+	<-stopped
+}
+
+/**
+	优雅退出
+	1:不再响应 FindDea 请求,取消 nats 订阅,停止 dea 资源超时检测
+	2:停止缓存检测和孤儿数据清理,通知其他 scheduler 本节点退出
+	3:不再接受新的http请求,等待正在处理的上传下载完成(最多等待 shutdown_timeout_second)
+	4:断开 nats 连接,flush 日志
+**/
+func Shutdown(c *config.Config, mbus bus.MessageBus, deaPool *deapool.DeaPool, listener *listener.Listener, reconciler *reconcile.Reconciler, peers *peer.Cluster, controller *controller.Controller){
+	logger := steno.NewLogger("cc_helper")
+	start := time.Now()
+	
+	deaPool.Stop()
+	listener.Stop()
+	reconciler.Stop()
+	peers.Stop()
+	controller.Stop(time.Duration(c.ShutdownTimeoutSecond) * time.Second)
+	mbus.Disconnect()
+	
+	logger.Infof("shutdown complete, 耗时:%v", time.Now().Sub(start))
+	for _, sink := range logSinks {
+		sink.Flush()
+	}
 }
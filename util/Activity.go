@@ -0,0 +1,117 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+//保留的最近传输记录个数
+const activityHistorySize = 200
+
+//传输类型
+const (
+	//dea 上传到 scheduler
+	TransferUpload			= "upload"
+	//dea 从 scheduler 下载
+	TransferDownload		= "download"
+	//scheduler 上传到 jss
+	TransferJssUpload		= "jss_upload"
+	//scheduler 从 jss 下载
+	TransferJssDownload		= "jss_download"
+	//scheduler 从其他 scheduler 下载
+	TransferPeerDownload	= "peer_download"
+)
+
+//一次数据传输
+type Transfer struct {
+	Id					uint64				`json:"id"`
+	//droplet/app package/buildpackCache
+	Kind				string				`json:"kind"`
+	Op					string				`json:"op"`
+	Guid				string				`json:"guid"`
+	Bytes				int64				`json:"bytes"`
+	Start				time.Time			`json:"start"`
+	DurationMs			int64				`json:"duration_ms"`
+	Done				bool				`json:"done"`
+	Error				string				`json:"error,omitempty"`
+	activity			*Activity
+}
+
+//传输记录,包括正在进行的传输和最近完成的传输
+type Activity struct {
+	lock				sync.Mutex
+	seq					uint64
+	active				map[uint64]*Transfer
+	recent				[]*Transfer
+}
+
+//传输记录快照
+type ActivitySnapshot struct {
+	Active				[]*Transfer			`json:"active"`
+	Recent				[]*Transfer			`json:"recent"`
+}
+
+//所有 droplet/package/buildpackCache 的传输记录
+var transfers = &Activity{active: make(map[uint64]*Transfer)}
+
+//开始一次传输
+func BeginTransfer(kind string, op string, guid string) *Transfer {
+	return transfers.Begin(kind, op, guid)
+}
+
+//返回所有传输记录
+func Transfers() *ActivitySnapshot {
+	return transfers.Snapshot()
+}
+
+//开始一次传输
+func (a *Activity) Begin(kind string, op string, guid string) *Transfer {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.seq++
+	t := &Transfer{Id: a.seq, Kind: kind, Op: op, Guid: guid, Start: time.Now(), activity: a}
+	a.active[t.Id] = t
+	return t
+}
+
+//传输结束,记录传输的字节数和错误
+func (t *Transfer) End(bytes int64, err error) {
+	a := t.activity
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if t.Done {
+		return
+	}
+	t.Done = true
+	t.Bytes = bytes
+	t.DurationMs = time.Since(t.Start).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		t.Error = err.Error()
+	}
+
+	delete(a.active, t.Id)
+	a.recent = append(a.recent, t)
+	if len(a.recent) > activityHistorySize {
+		a.recent = a.recent[len(a.recent)-activityHistorySize:]
+	}
+}
+
+//返回传输记录快照,最近完成的传输按完成时间倒序
+func (a *Activity) Snapshot() *ActivitySnapshot {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	s := &ActivitySnapshot{Active: []*Transfer{}, Recent: []*Transfer{}}
+	for _, t := range a.active {
+		c := *t
+		c.DurationMs = time.Since(t.Start).Nanoseconds() / int64(time.Millisecond)
+		s.Active = append(s.Active, &c)
+	}
+	for i := len(a.recent) - 1; i >= 0; i-- {
+		c := *a.recent[i]
+		s.Recent = append(s.Recent, &c)
+	}
+	return s
+}
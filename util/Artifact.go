@@ -0,0 +1,72 @@
+package util
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+//数据所在位置
+const (
+	//本地缓存盘
+	LocationLocal		= "local"
+	//云存储(jss)
+	LocationBackend		= "backend"
+)
+
+//droplet/package/buildpackCache 的存储信息
+type ArtifactInfo struct {
+	Guid				string				`json:"guid"`
+	//sha256 摘要,旧版本按guid保存的数据没有摘要
+	Digest				string				`json:"digest"`
+	//保存的数据大小(压缩/加密后)
+	Size				int64				`json:"size"`
+	Location			string				`json:"location"`
+	//本地缓存文件路径,只在 Location 为 local 时有值
+	Path				string				`json:"path,omitempty"`
+}
+
+//返回路由中的 guid,兼容旧版本通过 :guid 查询参数传递的 guid
+func RouteGuid(req *http.Request, vars map[string]string) string {
+	if guid := vars["guid"]; guid != "" {
+		return guid
+	}
+	return req.URL.Query().Get(":guid")
+}
+
+//缓存目录磁盘使用情况
+type CacheUsage struct {
+	Type				string				`json:"type"`
+	Path				string				`json:"path"`
+	Files				int					`json:"files"`
+	Bytes				int64				`json:"bytes"`
+	DiskTotal			uint64				`json:"disk_total"`
+	DiskFree			uint64				`json:"disk_free"`
+	DiskUsedPercent		int64				`json:"disk_used_percent"`
+	//统计时间,运维页面查询的结果会缓存一段时间
+	Time				time.Time			`json:"time"`
+}
+
+//统计缓存目录下的文件个数、大小以及所在磁盘的使用情况
+func DirCacheUsage(kind string, path string) *CacheUsage {
+	usage := &CacheUsage{Type: kind, Path: path, Time: time.Now()}
+
+	filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		usage.Files++
+		usage.Bytes += fi.Size()
+		return nil
+	})
+
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &fs); err == nil && fs.Blocks > 0 {
+		usage.DiskTotal = fs.Blocks * uint64(fs.Bsize)
+		usage.DiskFree = fs.Bfree * uint64(fs.Bsize)
+		usage.DiskUsedPercent = int64(float64(usage.DiskTotal-usage.DiskFree) / float64(usage.DiskTotal) * 100)
+	}
+	return usage
+}
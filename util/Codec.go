@@ -0,0 +1,629 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"scheduler/config"
+	steno "github.com/cloudfoundry/gosteno"
+)
+
+//缓存目录和缓存文件的权限
+const (
+	CacheDirMode	os.FileMode = 0750
+	CacheFileMode	os.FileMode = 0640
+)
+
+/**
+	缓存数据编码格式
+	magic(4) | version(1) | flags(1) | [keyIdLen(1) | keyId | noncePrefix(7)]
+	flags: bit0 压缩(gzip), bit1 加密(AES-GCM)
+	加密时数据按 64KB 分段,每段: length(4, 最高位表示最后一段) | ciphertext
+	每段 nonce = noncePrefix(7) | counter(4) | last(1),头部作为附加数据,防止分段被截断/重排/篡改
+	没有 magic 的文件按明文处理(兼容已有的缓存和云存储数据)
+	开启加密时,按摘要保存的明文数据需要校验摘要,没有摘要可以校验的明文缓存文件直接拒绝
+**/
+const (
+	codecVersion		= 1
+	codecFlagCompress	= 1
+	codecFlagEncrypt	= 2
+	codecSegmentSize	= 64 * 1024
+	codecNoncePrefix	= 7
+	codecLastSegment	= 1 << 31
+)
+
+var codecMagic = []byte("JAEA")
+
+//开启加密时读取到没有编码头的缓存文件
+var errPlainArtifact = errors.New("artifact is not encoded while storage encrypt is enabled")
+
+//缓存数据编码对象(压缩/加密),对上传下载处理透明
+type ArtifactCodec struct {
+	compress		bool
+	encrypt			bool
+	keys			*KeyRing
+	logger			*steno.Logger
+}
+
+//创建编码对象
+func NewArtifactCodec(c *config.Config) *ArtifactCodec {
+	return &ArtifactCodec{
+		compress:	c.Storage.Compress,
+		encrypt:	c.Storage.Encrypt,
+		keys:		NewKeyRing(c.Storage.KeyFile),
+		logger:		steno.NewLogger("cc_helper"),
+	}
+}
+
+//是否需要对写入的数据编码
+func (a *ArtifactCodec) Enabled() bool {
+	return a.compress || a.encrypt
+}
+
+//返回编码 writer,写入明文,输出编码后的数据,必须调用 Close 写入最后的数据
+func (a *ArtifactCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if !a.Enabled() {
+		return nopWriteCloser{w}, nil
+	}
+
+	var flags byte
+	if a.compress {
+		flags |= codecFlagCompress
+	}
+	if a.encrypt {
+		flags |= codecFlagEncrypt
+	}
+
+	header := append([]byte{}, codecMagic...)
+	header = append(header, codecVersion, flags)
+
+	cw := &codecWriter{}
+	var out io.Writer = w
+
+	if a.encrypt {
+		keyId, key, err := a.keys.Current()
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		prefix := make([]byte, codecNoncePrefix)
+		if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+			return nil, err
+		}
+		header = append(header, byte(len(keyId)))
+		header = append(header, keyId...)
+		header = append(header, prefix...)
+
+		sw := &sealWriter{aead: aead, w: w, prefix: prefix, ad: header}
+		out = sw
+		cw.closers = append(cw.closers, sw)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	if a.compress {
+		gw := gzip.NewWriter(out)
+		out = gw
+		cw.closers = append([]io.Closer{gw}, cw.closers...)
+	}
+
+	cw.w = out
+	return cw, nil
+}
+
+//返回解码 reader,没有编码头的数据按明文返回
+func (a *ArtifactCodec) NewReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	encoded, err := isEncoded(br)
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return br, nil
+	}
+
+	header := make([]byte, len(codecMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[len(codecMagic)] != codecVersion {
+		return nil, errors.New(fmt.Sprintf("unsupported artifact codec version:%v", header[len(codecMagic)]))
+	}
+	flags := header[len(codecMagic)+1]
+
+	var in io.Reader = br
+
+	if flags&codecFlagEncrypt != 0 {
+		idLen, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		rest := make([]byte, int(idLen)+codecNoncePrefix)
+		if _, err := io.ReadFull(br, rest); err != nil {
+			return nil, err
+		}
+		keyId := string(rest[:idLen])
+		key, err := a.keys.Key(keyId)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		header = append(header, idLen)
+		header = append(header, rest...)
+		in = &openReader{aead: aead, r: br, prefix: rest[idLen:], ad: header}
+	}
+
+	if flags&codecFlagCompress != 0 {
+		gr, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		in = gr
+	}
+
+	return in, nil
+}
+
+//将明文文件编码后保存到目标路径,并删除明文文件;未开启编码时直接移动文件
+func (a *ArtifactCodec) StoreFile(src string, dest string) error {
+	if !a.Enabled() {
+		return os.Rename(src, dest)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dest + ".encoding"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, CacheFileMode)
+	if err != nil {
+		return err
+	}
+
+	err = a.encodeTo(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func (a *ArtifactCodec) encodeTo(out io.Writer, in io.Reader) error {
+	w, err := a.NewWriter(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+/**
+	返回按摘要保存的数据的解码 reader
+	开启加密时没有编码头的数据(开启加密前写入,或者被替换的数据)读取完时校验摘要,不一致时返回错误
+	digest 为空时与 NewReader 相同(旧版本按 guid 保存的数据)
+**/
+func (a *ArtifactCodec) NewDigestReader(r io.Reader, digest string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if digest == "" || !a.encrypt {
+		return a.NewReader(br)
+	}
+
+	encoded, err := isEncoded(br)
+	if err != nil {
+		return nil, err
+	}
+	if encoded {
+		return a.NewReader(br)
+	}
+	a.logger.Warnf("artifact digest:%v is not encoded while storage encrypt is enabled, verify digest", digest)
+	return &digestReader{r: br, h: NewDigestHash(), digest: digest}, nil
+}
+
+//打开缓存文件,返回解码后的 reader,开启加密时拒绝没有编码头的文件
+func (a *ArtifactCodec) OpenFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	if a.encrypt {
+		encoded, err := isEncoded(br)
+		if err == nil && !encoded {
+			err = errPlainArtifact
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	r, err := a.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{r, f}, nil
+}
+
+//打开按摘要保存的缓存文件,返回解码后的 reader,明文文件的校验同 NewDigestReader
+func (a *ArtifactCodec) OpenDigestFile(path string, digest string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := a.NewDigestReader(f, digest)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{r, f}, nil
+}
+
+/**
+	发送缓存文件,明文文件直接使用 http.ServeFile(支持 Range 等),编码过的文件解码后发送
+	开启加密时明文文件先校验摘要再发送,digest 为空时(旧版本按 guid 保存的数据)不校验
+**/
+func (a *ArtifactCodec) ServeFile(rw http.ResponseWriter, req *http.Request, path string, digest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	encoded, err := isEncoded(br)
+	if err != nil {
+		return err
+	}
+	if !encoded {
+		if a.encrypt && digest != "" {
+			if err := a.verifyPlainFile(path, digest); err != nil {
+				return err
+			}
+		}
+		http.ServeFile(rw, req, path)
+		return nil
+	}
+
+	r, err := a.NewReader(br)
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	_, err = io.Copy(rw, r)
+	return err
+}
+
+//校验明文文件的摘要
+func (a *ArtifactCodec) verifyPlainFile(path string, digest string) error {
+	r, err := a.OpenDigestFile(path, digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+//读取完时校验摘要的 reader,不一致时返回错误代替 io.EOF
+type digestReader struct {
+	r			io.Reader
+	h			hash.Hash
+	digest		string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := DigestString(d.h); actual != d.digest {
+			return n, errors.New(fmt.Sprintf("artifact digest mismatch, expected:%v, actual:%v", d.digest, actual))
+		}
+	}
+	return n, err
+}
+
+//检测数据是否有编码头
+func isEncoded(br *bufio.Reader) (bool, error) {
+	magic, err := br.Peek(len(codecMagic))
+	if err == io.EOF || err == bufio.ErrBufferFull {
+		return false, nil
+	}
+	if err != nil {
+		if len(magic) < len(codecMagic) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(magic, codecMagic), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//计算每个分段的 nonce
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, codecNoncePrefix+5)
+	nonce = append(nonce, prefix...)
+	c := make([]byte, 4)
+	binary.BigEndian.PutUint32(c, counter)
+	nonce = append(nonce, c...)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+//分段加密 writer
+type sealWriter struct {
+	aead		cipher.AEAD
+	w			io.Writer
+	prefix		[]byte
+	ad			[]byte
+	buf			[]byte
+	counter		uint32
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for len(s.buf) > codecSegmentSize {
+		if err := s.seal(s.buf[:codecSegmentSize], false); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[codecSegmentSize:]
+	}
+	return len(p), nil
+}
+
+func (s *sealWriter) Close() error {
+	err := s.seal(s.buf, true)
+	s.buf = nil
+	return err
+}
+
+func (s *sealWriter) seal(plain []byte, last bool) error {
+	ct := s.aead.Seal(nil, segmentNonce(s.prefix, s.counter, last), plain, s.ad)
+	s.counter++
+
+	length := uint32(len(ct))
+	if last {
+		length |= codecLastSegment
+	}
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, length)
+	if _, err := s.w.Write(l); err != nil {
+		return err
+	}
+	_, err := s.w.Write(ct)
+	return err
+}
+
+//分段解密 reader
+type openReader struct {
+	aead		cipher.AEAD
+	r			io.Reader
+	prefix		[]byte
+	ad			[]byte
+	buf			[]byte
+	counter		uint32
+	done		bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openReader) open() error {
+	l := make([]byte, 4)
+	if _, err := io.ReadFull(o.r, l); err != nil {
+		//没有读到最后一段,数据被截断
+		return io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint32(l)
+	last := length&codecLastSegment != 0
+	length &^= codecLastSegment
+	if length > codecSegmentSize+uint32(o.aead.Overhead()) {
+		return errors.New("artifact segment too large")
+	}
+
+	ct := make([]byte, length)
+	if _, err := io.ReadFull(o.r, ct); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	plain, err := o.aead.Open(nil, segmentNonce(o.prefix, o.counter, last), ct, o.ad)
+	if err != nil {
+		return errors.New("artifact segment authentication fail")
+	}
+	o.counter++
+	o.buf = plain
+	o.done = last
+	return nil
+}
+
+//依次关闭 gzip 和加密 writer
+type codecWriter struct {
+	w			io.Writer
+	closers		[]io.Closer
+}
+
+func (c *codecWriter) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *codecWriter) Close() error {
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+//加密密钥,支持密钥轮换:密钥文件修改后自动重新加载
+//新数据使用第一个密钥加密,旧数据根据编码头中的 key id 找到对应的密钥解密
+type KeyRing struct {
+	path			string
+	lock			sync.Mutex
+	modTime			time.Time
+	current			string
+	keys			map[string][]byte
+	logger			*steno.Logger
+}
+
+//创建密钥对象
+func NewKeyRing(path string) *KeyRing {
+	return &KeyRing{
+		path:		path,
+		keys:		make(map[string][]byte),
+		logger:		steno.NewLogger("cc_helper"),
+	}
+}
+
+//返回当前加密使用的密钥
+func (k *KeyRing) Current() (string, []byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if err := k.reload(); err != nil {
+		return "", nil, err
+	}
+	if k.current == "" {
+		return "", nil, errors.New("no encryption key in key file:" + k.path)
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+//根据 key id 返回密钥
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	key, found := k.keys[id]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("encryption key:%v not found in key file:%v", id, k.path))
+	}
+	return key, nil
+}
+
+//密钥文件修改时间变化时重新加载,调用方需要持有锁
+func (k *KeyRing) reload() error {
+	if k.path == "" {
+		return errors.New("key file is not configured")
+	}
+
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(k.modTime) && len(k.keys) > 0 {
+		return nil
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		k.logger.Warnf("key file:%v is accessible by other users, mode:%v", k.path, fi.Mode().Perm())
+	}
+
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	current := ""
+	keys := make(map[string][]byte)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return errors.New("invalid key file line, expect: key_id base64(key)")
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid key:%v, %v", fields[0], err))
+		}
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return errors.New(fmt.Sprintf("invalid key:%v, length must be 16, 24 or 32 bytes", fields[0]))
+		}
+		if current == "" {
+			current = fields[0]
+		}
+		keys[fields[0]] = key
+	}
+
+	k.current = current
+	k.keys = keys
+	k.modTime = fi.ModTime()
+	k.logger.Infof("load key file:%v, current key:%v, key count:%v", k.path, current, len(keys))
+	return nil
+}
@@ -0,0 +1,223 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"scheduler/config"
+)
+
+//生成测试密钥文件,第一行为当前密钥,相同 id 的密钥内容相同
+func writeKeyFile(t *testing.T, dir string, ids ...string) string {
+	content := ""
+	for _, id := range ids {
+		key := bytes.Repeat([]byte(id), 32)[:32]
+		content += id + " " + base64.StdEncoding.EncodeToString(key) + "\n"
+	}
+	path := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestCodec(compress bool, encrypt bool, keyFile string) *ArtifactCodec {
+	c := config.DefaultConfig()
+	c.Storage.Compress = compress
+	c.Storage.Encrypt = encrypt
+	c.Storage.KeyFile = keyFile
+	return NewArtifactCodec(c)
+}
+
+func encodeBytes(t *testing.T, a *ArtifactCodec, plain []byte) []byte {
+	var buf bytes.Buffer
+	w, err := a.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeBytes(a *ArtifactCodec, data []byte) ([]byte, error) {
+	r, err := a.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := writeKeyFile(t, dir, "k1")
+
+	//跨越多个加密分段
+	plain := bytes.Repeat([]byte("droplet content "), 3*codecSegmentSize/16+7)
+
+	for _, c := range []struct{ compress, encrypt bool }{{false, false}, {true, false}, {false, true}, {true, true}} {
+		a := newTestCodec(c.compress, c.encrypt, keyFile)
+		encoded := encodeBytes(t, a, plain)
+		if c.encrypt && bytes.Contains(encoded, []byte("droplet content droplet content")) {
+			t.Fatalf("compress:%v encrypt:%v, plain text found in encoded data", c.compress, c.encrypt)
+		}
+		decoded, err := decodeBytes(a, encoded)
+		if err != nil {
+			t.Fatalf("compress:%v encrypt:%v, decode: %v", c.compress, c.encrypt, err)
+		}
+		if !bytes.Equal(decoded, plain) {
+			t.Fatalf("compress:%v encrypt:%v, round trip mismatch", c.compress, c.encrypt)
+		}
+	}
+}
+
+func TestCodecReadsPlainData(t *testing.T) {
+	a := newTestCodec(true, false, "")
+	for _, plain := range [][]byte{{}, []byte("ab"), []byte("plain droplet data")} {
+		decoded, err := decodeBytes(a, plain)
+		if err != nil {
+			t.Fatalf("decode plain %q: %v", plain, err)
+		}
+		if !bytes.Equal(decoded, plain) {
+			t.Fatalf("decode plain %q = %q", plain, decoded)
+		}
+	}
+}
+
+func TestCodecDetectsTampering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := newTestCodec(false, true, writeKeyFile(t, dir, "k1"))
+
+	encoded := encodeBytes(t, a, bytes.Repeat([]byte("x"), 2*codecSegmentSize))
+	tampered := append([]byte{}, encoded...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := decodeBytes(a, tampered); err == nil {
+		t.Fatal("tampered data decoded without error")
+	}
+
+	//去掉最后一段
+	truncated := encoded[:len(encoded)-100]
+	if _, err := decodeBytes(a, truncated); err == nil {
+		t.Fatal("truncated data decoded without error")
+	}
+}
+
+func TestCodecKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := writeKeyFile(t, dir, "old")
+
+	encoded := encodeBytes(t, newTestCodec(false, true, keyFile), []byte("secret"))
+
+	//新密钥成为当前密钥,旧数据仍然可以用旧密钥解密
+	writeKeyFile(t, dir, "new", "old")
+	rotated := newTestCodec(false, true, keyFile)
+	decoded, err := decodeBytes(rotated, encoded)
+	if err != nil || string(decoded) != "secret" {
+		t.Fatalf("decode with rotated keys = %q, %v", decoded, err)
+	}
+
+	//旧密钥被删除后无法解密
+	writeKeyFile(t, dir, "new")
+	if _, err := decodeBytes(newTestCodec(false, true, keyFile), encoded); err == nil {
+		t.Fatal("decoded without the key")
+	}
+}
+
+func TestCodecStoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := newTestCodec(true, false, "")
+
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	ioutil.WriteFile(src, []byte("package content"), CacheFileMode)
+	if err := a.StoreFile(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatal("source file not removed")
+	}
+
+	r, err := a.OpenFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, _ := ioutil.ReadAll(r)
+	if string(data) != "package content" {
+		t.Fatalf("OpenFile = %q", data)
+	}
+}
+
+//开启加密时明文缓存文件只有摘要校验通过才能读取
+func TestCodecPlainFileWithEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := newTestCodec(false, true, writeKeyFile(t, dir, "k1"))
+
+	path := filepath.Join(dir, "plain")
+	ioutil.WriteFile(path, []byte("plain droplet"), CacheFileMode)
+	h := NewDigestHash()
+	h.Write([]byte("plain droplet"))
+	digest := DigestString(h)
+
+	if _, err := a.OpenFile(path); err == nil {
+		t.Fatal("plain file opened with encrypt enabled")
+	}
+
+	r, err := a.OpenDigestFile(path, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "plain droplet" {
+		t.Fatalf("OpenDigestFile = %q, %v", data, err)
+	}
+
+	r, err = a.OpenDigestFile(path, strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	if err == nil {
+		t.Fatal("plain file with wrong digest accepted")
+	}
+
+	w := httptest.NewRecorder()
+	if err := a.ServeFile(w, httptest.NewRequest("GET", "/", nil), path, strings.Repeat("0", 64)); err == nil {
+		t.Fatal("plain file with wrong digest served")
+	}
+	w = httptest.NewRecorder()
+	if err := a.ServeFile(w, httptest.NewRequest("GET", "/", nil), path, digest); err != nil || w.Body.String() != "plain droplet" {
+		t.Fatalf("ServeFile = %q, %v", w.Body.String(), err)
+	}
+}
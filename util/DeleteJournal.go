@@ -0,0 +1,430 @@
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	steno "github.com/cloudfoundry/gosteno"
+	"scheduler/config"
+)
+
+//jss 删除操作类型
+const (
+	//按 guid 保存的数据(旧版本)
+	DeleteObject		= "object"
+	//guid 到摘要的引用对象
+	DeleteRef			= "ref"
+	//按摘要保存的数据
+	DeleteDigest		= "digest"
+)
+
+//删除任务状态
+const (
+	DeletePending		= "pending"
+	//超过最大重试次数,仍然按最大间隔继续重试
+	DeleteFailed		= "failed"
+)
+
+//一个 jss 删除任务
+type DeleteTask struct {
+	//droplet/app package
+	Kind				string				`json:"kind"`
+	Op					string				`json:"op"`
+	//guid 或者摘要
+	Target				string				`json:"target"`
+	//触发删除的应用 guid
+	Guid				string				`json:"guid"`
+	State				string				`json:"state"`
+	Attempts			int					`json:"attempts"`
+	LastError			string				`json:"last_error,omitempty"`
+	Created				time.Time			`json:"created"`
+	LastAttempt			time.Time			`json:"last_attempt"`
+	NextAttempt			time.Time			`json:"next_attempt"`
+	running				bool
+}
+
+/**
+	jss 删除日志
+	1:删除前先记录到本地文件,删除成功后移除,进程重启后继续删除
+	2:删除由后台执行,失败时按指数退避重试,直到 jss 确认删除(不存在也视为删除成功)
+	3:相同的删除操作(op+target)只保留一个任务
+	4:上传通过 Guard 与相同数据的删除互斥,持有 Guard 时取消的任务不会再执行
+**/
+type DeleteJournal struct {
+	path				string
+	jss					*JssUtil
+	minBackoff			time.Duration
+	maxBackoff			time.Duration
+	maxAttempts			int
+	//本地仍然引用摘要时返回 true,删除摘要数据前检查
+	protect				func(digest string) bool
+	//已有引用的反向索引补写完成前不删除摘要数据
+	refsIndexed			bool
+	lock				sync.Mutex
+	Tasks				map[string]*DeleteTask		`json:"tasks"`
+	//op:target -> 互斥锁,删除和上传相同数据时互斥
+	guardLock			sync.Mutex
+	guards				map[string]*targetGuard
+	//有新任务时通知后台立即执行
+	kick				chan struct{}
+	stopChan			chan struct{}
+	stopped				bool
+	logger				*steno.Logger
+}
+
+//创建删除日志,日志文件已经存在时加载未完成的删除任务
+func NewDeleteJournal(c *config.Config, path string, jss *JssUtil) *DeleteJournal {
+	j := &DeleteJournal{
+		path:			path,
+		jss:			jss,
+		minBackoff:		time.Duration(c.Deletion.RetryMinSecond) * time.Second,
+		maxBackoff:		time.Duration(c.Deletion.RetryMaxSecond) * time.Second,
+		maxAttempts:	c.Deletion.MaxAttempts,
+		Tasks:			make(map[string]*DeleteTask),
+		guards:			make(map[string]*targetGuard),
+		kick:			make(chan struct{}, 1),
+		stopChan:		make(chan struct{}),
+		logger:			steno.NewLogger("cc_helper"),
+	}
+	j.load()
+	return j
+}
+
+//设置本地引用检查,本地索引仍然引用的摘要不删除
+func (j *DeleteJournal) Protect(protect func(digest string) bool) {
+	j.protect = protect
+}
+
+//返回日志文件路径
+func (j *DeleteJournal) Path() string {
+	return j.path
+}
+
+//op:target 的互斥锁,refs 为等待或持有该锁的个数,为 0 时移除
+type targetGuard struct {
+	lock				sync.Mutex
+	refs				int
+}
+
+/**
+	获取 op:target 的互斥锁,返回释放函数
+	上传数据前持有相同数据的锁:正在执行的删除完成后才能继续,持有期间取消的删除任务不会再执行
+**/
+func (j *DeleteJournal) Guard(op string, target string) func() {
+	id := op + ":" + target
+	j.guardLock.Lock()
+	g, found := j.guards[id]
+	if !found {
+		g = &targetGuard{}
+		j.guards[id] = g
+	}
+	g.refs++
+	j.guardLock.Unlock()
+
+	g.lock.Lock()
+	return func() {
+		g.lock.Unlock()
+		j.guardLock.Lock()
+		g.refs--
+		if g.refs == 0 {
+			delete(j.guards, id)
+		}
+		j.guardLock.Unlock()
+	}
+}
+
+//记录删除任务,由后台执行,失败后按退避时间重试
+func (j *DeleteJournal) Delete(op string, target string, guid string) {
+	if target == "" {
+		return
+	}
+
+	id := op + ":" + target
+	j.lock.Lock()
+	if _, found := j.Tasks[id]; found {
+		j.lock.Unlock()
+		j.logger.Infof("delete %v %v:%v already pending, guid:%v", j.jss.desc, op, target, guid)
+		return
+	}
+	now := time.Now()
+	j.Tasks[id] = &DeleteTask{
+		Kind:			j.jss.desc,
+		Op:				op,
+		Target:			target,
+		Guid:			guid,
+		State:			DeletePending,
+		Created:		now,
+		NextAttempt:	now,
+	}
+	j.save()
+	j.lock.Unlock()
+
+	select {
+	case j.kick <- struct{}{}:
+	default:
+	}
+}
+
+//取消删除任务(重新上传了相同的数据),调用方需要持有 Guard(op, target)
+func (j *DeleteJournal) Cancel(op string, target string) {
+	id := op + ":" + target
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if task, found := j.Tasks[id]; found {
+		j.logger.Infof("cancel pending delete %v %v:%v", task.Kind, op, target)
+		delete(j.Tasks, id)
+		j.save()
+	}
+}
+
+//执行一次删除,调用方已经将 task.running 置为 true
+func (j *DeleteJournal) attempt(id string, task *DeleteTask) {
+	unlock := j.Guard(task.Op, task.Target)
+	defer unlock()
+
+	//等待 Guard 期间任务可能已经被取消
+	j.lock.Lock()
+	current, found := j.Tasks[id]
+	j.lock.Unlock()
+	if !found || current != task {
+		return
+	}
+
+	err := j.remove(task.Op, task.Target)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	task.running = false
+	task.Attempts++
+	task.LastAttempt = time.Now()
+	if err == nil {
+		if j.Tasks[id] == task {
+			delete(j.Tasks, id)
+			j.save()
+		}
+		return
+	}
+
+	task.LastError = err.Error()
+	if task.Attempts >= j.maxAttempts {
+		task.State = DeleteFailed
+	}
+	task.NextAttempt = task.LastAttempt.Add(j.backoff(task.Attempts))
+	j.logger.Warnf("delete %v %v:%v fail, attempts:%v, next attempt:%v, err:%v", task.Kind, task.Op, task.Target, task.Attempts, task.NextAttempt, err)
+	j.save()
+}
+
+func (j *DeleteJournal) remove(op string, target string) error {
+	switch op {
+	case DeleteRef:
+		return j.jss.removeRef(target)
+	case DeleteDigest:
+		return j.removeDigest(target)
+	default:
+		return j.jss.deleteResource(target, j.jss.getResource(target))
+	}
+}
+
+/**
+	删除摘要数据前确认云存储中没有其他 guid 引用
+	1:本地索引仍然引用时不删除,等待删除的引用不计算在内
+	2:仍然被引用时不删除,任务直接完成
+	3:无法确认时(列举或读取引用失败)按删除失败处理,稍后重试
+**/
+func (j *DeleteJournal) removeDigest(digest string) error {
+	if j.protect != nil && j.protect(digest) {
+		j.logger.Infof("delete %v digest:%v skipped, still referenced locally", j.jss.desc, digest)
+		return nil
+	}
+	referenced, err := j.jss.DigestReferenced(digest, j.pendingRefs())
+	if err != nil {
+		return err
+	}
+	if referenced {
+		j.logger.Infof("delete %v digest:%v skipped, still referenced in jss", j.jss.desc, digest)
+		return nil
+	}
+	return j.jss.deleteResource(digest, j.jss.getDigestResource(digest))
+}
+
+//等待删除的引用对应的 guid
+func (j *DeleteJournal) pendingRefs() map[string]bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	guids := make(map[string]bool)
+	for _, task := range j.Tasks {
+		if task.Op == DeleteRef {
+			guids[task.Target] = true
+		}
+	}
+	return guids
+}
+
+//第 n 次失败后的重试间隔
+func (j *DeleteJournal) backoff(attempts int) time.Duration {
+	d := j.minBackoff
+	for i := 1; i < attempts && d < j.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > j.maxBackoff {
+		d = j.maxBackoff
+	}
+	return d
+}
+
+//启动后台删除和重试
+func (j *DeleteJournal) Start() {
+	go j.indexRefs()
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.stopChan:
+				return
+			case <-ticker.C:
+				j.retry()
+			case <-j.kick:
+				j.retry()
+			}
+		}
+	}()
+}
+
+//补写已有引用的反向索引,失败时按最大退避时间重试
+func (j *DeleteJournal) indexRefs() {
+	for {
+		err := j.jss.IndexRefs(func(guid string) func() {
+			return j.Guard(DeleteRef, guid)
+		})
+		if err == nil {
+			j.lock.Lock()
+			j.refsIndexed = true
+			j.lock.Unlock()
+			j.logger.Infof("index %v refs by digest finished", j.jss.desc)
+			return
+		}
+		j.logger.Warnf("index %v refs by digest fail, retry after %v, err:%v", j.jss.desc, j.maxBackoff, err)
+		select {
+		case <-j.stopChan:
+			return
+		case <-time.After(j.maxBackoff):
+		}
+	}
+}
+
+//停止后台重试,未完成的任务保留在日志文件中
+func (j *DeleteJournal) Stop() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if !j.stopped {
+		j.stopped = true
+		close(j.stopChan)
+	}
+}
+
+//执行到期的任务
+func (j *DeleteJournal) retry() {
+	now := time.Now()
+	due := make(map[string]*DeleteTask)
+
+	j.lock.Lock()
+	for id, task := range j.Tasks {
+		if task.Op == DeleteDigest && !j.refsIndexed {
+			continue
+		}
+		if !task.running && !task.NextAttempt.After(now) {
+			task.running = true
+			due[id] = task
+		}
+	}
+	j.lock.Unlock()
+
+	for id, task := range due {
+		j.attempt(id, task)
+	}
+}
+
+//返回所有未完成的删除任务,按创建时间排序
+func (j *DeleteJournal) List() []*DeleteTask {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	tasks := make([]*DeleteTask, 0, len(j.Tasks))
+	for _, task := range j.Tasks {
+		c := *task
+		tasks = append(tasks, &c)
+	}
+	sort.Sort(deleteTasksByCreated(tasks))
+	return tasks
+}
+
+//返回 guid 触发的未完成删除任务
+func (j *DeleteJournal) PendingFor(guid string) []*DeleteTask {
+	tasks := []*DeleteTask{}
+	for _, task := range j.List() {
+		if task.Guid == guid {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
+
+type deleteTasksByCreated []*DeleteTask
+
+func (t deleteTasksByCreated) Len() int           { return len(t) }
+func (t deleteTasksByCreated) Swap(i, k int)      { t[i], t[k] = t[k], t[i] }
+func (t deleteTasksByCreated) Less(i, k int) bool { return t[i].Created.Before(t[k].Created) }
+
+//从磁盘加载未完成的任务,重启后立即重试
+func (j *DeleteJournal) load() {
+	data, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			j.logger.Errorf("load delete journal:%v fail,%v", j.path, err)
+		}
+		return
+	}
+
+	if err := json.Unmarshal(data, j); err != nil {
+		j.logger.Errorf("load delete journal:%v fail,%v", j.path, err)
+	}
+	if j.Tasks == nil {
+		j.Tasks = make(map[string]*DeleteTask)
+	}
+	for _, task := range j.Tasks {
+		task.NextAttempt = time.Now()
+	}
+}
+
+//将任务写入磁盘(先写临时文件再 rename),调用方需要持有锁
+func (j *DeleteJournal) save() {
+	data, err := json.Marshal(j)
+	if err != nil {
+		j.logger.Errorf("save delete journal:%v fail,%v", j.path, err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), CacheDirMode); err != nil {
+		j.logger.Errorf("save delete journal:%v fail,%v", j.path, err)
+		return
+	}
+
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, CacheFileMode); err != nil {
+		j.logger.Errorf("save delete journal:%v fail,%v", j.path, err)
+		return
+	}
+
+	if err := os.Rename(tmp, j.path); err != nil {
+		j.logger.Errorf("save delete journal:%v fail,%v", j.path, err)
+	}
+}
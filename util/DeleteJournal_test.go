@@ -0,0 +1,173 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestJournal(t *testing.T, f *fakeJss) (*DeleteJournal, string) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := f.config()
+	c.Deletion.RetryMinSecond = 1
+	c.Deletion.RetryMaxSecond = 4
+	c.Deletion.MaxAttempts = 2
+	path := filepath.Join(dir, "deletions.json")
+	return NewDeleteJournal(c, path, NewJssUtil(c, true)), dir
+}
+
+//等待条件成立,超时返回 false
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestDeleteJournalBackoff(t *testing.T) {
+	j := &DeleteJournal{minBackoff: 5 * time.Second, maxBackoff: 60 * time.Second}
+	expected := []time.Duration{5, 10, 20, 40, 60, 60}
+	for i, e := range expected {
+		if d := j.backoff(i + 1); d != e*time.Second {
+			t.Fatalf("backoff(%v) = %v, expected %v", i+1, d, e*time.Second)
+		}
+	}
+}
+
+func TestDeleteJournalDeletesInBackground(t *testing.T) {
+	f := newFakeJss()
+	defer f.Close()
+	f.put("/jae-droplets/refs/guid", "abc")
+	j, dir := newTestJournal(t, f)
+	defer os.RemoveAll(dir)
+
+	j.Delete(DeleteRef, "guid", "guid")
+	if !f.exists("/jae-droplets/refs/guid") {
+		t.Fatal("delete should not run before Start")
+	}
+	if len(j.List()) != 1 {
+		t.Fatal("task not recorded")
+	}
+
+	j.Start()
+	defer j.Stop()
+	if !waitFor(func() bool { return len(j.List()) == 0 }) {
+		t.Fatalf("task not finished: %+v", j.List()[0])
+	}
+	if f.exists("/jae-droplets/refs/guid") {
+		t.Fatal("ref not deleted")
+	}
+}
+
+func TestDeleteJournalRetryAndPersist(t *testing.T) {
+	f := newFakeJss()
+	defer f.Close()
+	f.failDelete = true
+	j, dir := newTestJournal(t, f)
+	defer os.RemoveAll(dir)
+
+	j.Delete(DeleteObject, "guid", "guid")
+	j.Start()
+	if !waitFor(func() bool { tasks := j.List(); return len(tasks) == 1 && tasks[0].Attempts >= 2 }) {
+		t.Fatalf("task not retried: %+v", j.List())
+	}
+	j.Stop()
+	if task := j.List()[0]; task.State != DeleteFailed || task.LastError == "" {
+		t.Fatalf("unexpected task state: %+v", task)
+	}
+
+	//重启后继续删除
+	f.lock.Lock()
+	f.failDelete = false
+	f.lock.Unlock()
+	reloaded := NewDeleteJournal(f.config(), j.Path(), j.jss)
+	if len(reloaded.List()) != 1 {
+		t.Fatal("task not persisted")
+	}
+	reloaded.Start()
+	defer reloaded.Stop()
+	if !waitFor(func() bool { return len(reloaded.List()) == 0 }) {
+		t.Fatal("reloaded task not finished")
+	}
+}
+
+func TestDeleteJournalKeepsReferencedDigest(t *testing.T) {
+	f := newFakeJss()
+	defer f.Close()
+	f.put("/jae-droplets/sha256/d1", "data")
+	f.put("/jae-droplets/refs/other", "d1")
+	f.put("/jae-droplets/refs/deleted", "d1")
+	j, dir := newTestJournal(t, f)
+	defer os.RemoveAll(dir)
+	j.Start()
+	defer j.Stop()
+
+	//其他 scheduler 上传的 guid 仍然引用摘要,不删除
+	j.Delete(DeleteRef, "deleted", "deleted")
+	j.Delete(DeleteDigest, "d1", "deleted")
+	if !waitFor(func() bool { return len(j.List()) == 0 }) {
+		t.Fatal("tasks not finished")
+	}
+	if !f.exists("/jae-droplets/sha256/d1") {
+		t.Fatal("referenced digest deleted")
+	}
+
+	//启动时为已有的引用补写了反向索引,删除引用时一起删除
+	if f.exists("/jae-droplets/refs-by-digest/d1/deleted") || !f.exists("/jae-droplets/refs-by-digest/d1/other") {
+		t.Fatal("ref index not maintained")
+	}
+
+	//本地索引仍然引用时不删除
+	j.jss.PutRef("other", "d2")
+	j.Protect(func(digest string) bool { return true })
+	j.Delete(DeleteDigest, "d1", "")
+	if !waitFor(func() bool { return len(j.List()) == 0 }) {
+		t.Fatal("task not finished")
+	}
+	if !f.exists("/jae-droplets/sha256/d1") {
+		t.Fatal("locally referenced digest deleted")
+	}
+
+	j.Protect(nil)
+	j.Delete(DeleteDigest, "d1", "")
+	if !waitFor(func() bool { return !f.exists("/jae-droplets/sha256/d1") }) {
+		t.Fatal("unreferenced digest not deleted")
+	}
+}
+
+func TestDeleteJournalGuardCancel(t *testing.T) {
+	f := newFakeJss()
+	defer f.Close()
+	f.put("/jae-droplets/sha256/d1", "data")
+	j, dir := newTestJournal(t, f)
+	defer os.RemoveAll(dir)
+
+	//上传持有 Guard 时删除不会执行,取消后不再执行
+	unlock := j.Guard(DeleteDigest, "d1")
+	j.Delete(DeleteDigest, "d1", "")
+	j.Start()
+	defer j.Stop()
+	time.Sleep(1500 * time.Millisecond)
+	if !f.exists("/jae-droplets/sha256/d1") {
+		t.Fatal("delete ran while guarded")
+	}
+	j.Cancel(DeleteDigest, "d1")
+	unlock()
+
+	time.Sleep(1500 * time.Millisecond)
+	if !f.exists("/jae-droplets/sha256/d1") {
+		t.Fatal("cancelled delete ran")
+	}
+	if len(j.List()) != 0 {
+		t.Fatal("cancelled task still listed")
+	}
+}
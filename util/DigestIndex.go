@@ -0,0 +1,171 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	steno "github.com/cloudfoundry/gosteno"
+)
+
+//内容寻址索引
+//相同内容的 droplet/package 只按 sha256 摘要保存一份,guid 只保存到摘要的引用
+//并对每个摘要做引用计数,引用计数为0时才真正删除数据
+type DigestIndex struct {
+	path			string
+	lock			sync.Mutex
+	logger			*steno.Logger
+	//guid -> 摘要
+	Refs			map[string]string	`json:"refs"`
+	//摘要 -> 引用计数
+	Counts			map[string]int		`json:"counts"`
+}
+
+//创建索引对象,如果索引文件已经存在则从文件加载
+func NewDigestIndex(path string) *DigestIndex {
+	d := &DigestIndex{
+		path:		path,
+		logger:		steno.NewLogger("cc_helper"),
+		Refs:		make(map[string]string),
+		Counts:		make(map[string]int),
+	}
+	d.load()
+	return d
+}
+
+//创建计算 sha256 摘要的 hash 对象
+func NewDigestHash() hash.Hash {
+	return sha256.New()
+}
+
+//返回 hash 对象计算出的摘要字符串
+func DigestString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//返回索引文件路径
+func (d *DigestIndex) Path() string {
+	return d.path
+}
+
+//根据guid 返回对应的摘要
+func (d *DigestIndex) Digest(guid string) (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	digest, found := d.Refs[guid]
+	return digest, found
+}
+
+//返回摘要当前的引用计数
+func (d *DigestIndex) RefCount(digest string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.Counts[digest]
+}
+
+//增加 guid 到摘要的引用
+//如果 guid 之前引用了其他摘要,返回旧的摘要,以及旧摘要是否已经没有任何引用
+func (d *DigestIndex) AddRef(guid string, digest string) (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	old, found := d.Refs[guid]
+	if found && old == digest {
+		return "", false
+	}
+
+	orphan := false
+	if found {
+		orphan = d.release(old)
+	}
+
+	d.Refs[guid] = digest
+	d.Counts[digest] = d.Counts[digest] + 1
+	d.save()
+
+	if !found {
+		return "", false
+	}
+	return old, orphan
+}
+
+//释放 guid 的引用,返回 guid 对应的摘要,以及该摘要是否已经没有任何引用
+func (d *DigestIndex) Release(guid string) (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	digest, found := d.Refs[guid]
+	if !found {
+		return "", false
+	}
+
+	delete(d.Refs, guid)
+	orphan := d.release(digest)
+	d.save()
+
+	return digest, orphan
+}
+
+//摘要引用计数减一,调用方需要持有锁
+func (d *DigestIndex) release(digest string) bool {
+	count := d.Counts[digest] - 1
+	if count > 0 {
+		d.Counts[digest] = count
+		return false
+	}
+	delete(d.Counts, digest)
+	return true
+}
+
+//从磁盘加载索引
+func (d *DigestIndex) load() {
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			d.logger.Errorf("load digest index:%v fail,%v", d.path, err)
+		}
+		return
+	}
+
+	if err := json.Unmarshal(data, d); err != nil {
+		d.logger.Errorf("load digest index:%v fail,%v", d.path, err)
+		return
+	}
+
+	if d.Refs == nil {
+		d.Refs = make(map[string]string)
+	}
+	if d.Counts == nil {
+		d.Counts = make(map[string]int)
+	}
+}
+
+//将索引写入磁盘(先写临时文件再 rename,避免写入一半的索引文件),调用方需要持有锁
+func (d *DigestIndex) save() {
+	data, err := json.Marshal(d)
+	if err != nil {
+		d.logger.Errorf("save digest index:%v fail,%v", d.path, err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.path), CacheDirMode); err != nil {
+		d.logger.Errorf("save digest index:%v fail,%v", d.path, err)
+		return
+	}
+
+	tmp := d.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, CacheFileMode); err != nil {
+		d.logger.Errorf("save digest index:%v fail,%v", d.path, err)
+		return
+	}
+
+	if err := os.Rename(tmp, d.path); err != nil {
+		d.logger.Errorf("save digest index:%v fail,%v", d.path, err)
+	}
+}
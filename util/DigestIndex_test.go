@@ -0,0 +1,89 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestIndex(t *testing.T) (*DigestIndex, string) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDigestIndex(filepath.Join(dir, "index", "digests.json")), dir
+}
+
+func TestDigestIndexRefCount(t *testing.T) {
+	d, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+
+	d.AddRef("a", "d1")
+	d.AddRef("b", "d1")
+	if n := d.RefCount("d1"); n != 2 {
+		t.Fatalf("RefCount = %v, expected 2", n)
+	}
+
+	//重复引用同一个摘要不增加计数
+	if old, orphan := d.AddRef("a", "d1"); old != "" || orphan {
+		t.Fatalf("AddRef same digest = %q, %v", old, orphan)
+	}
+	if n := d.RefCount("d1"); n != 2 {
+		t.Fatalf("RefCount after duplicated AddRef = %v, expected 2", n)
+	}
+
+	if digest, orphan := d.Release("a"); digest != "d1" || orphan {
+		t.Fatalf("Release(a) = %q, %v", digest, orphan)
+	}
+	if digest, orphan := d.Release("b"); digest != "d1" || !orphan {
+		t.Fatalf("Release(b) = %q, %v", digest, orphan)
+	}
+	if n := d.RefCount("d1"); n != 0 {
+		t.Fatalf("RefCount after release = %v", n)
+	}
+	if _, found := d.Release("b"); found {
+		t.Fatal("release unknown guid reported a digest")
+	}
+}
+
+func TestDigestIndexReplaceRef(t *testing.T) {
+	d, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+
+	d.AddRef("a", "d1")
+	d.AddRef("b", "d1")
+	if old, orphan := d.AddRef("a", "d2"); old != "d1" || orphan {
+		t.Fatalf("AddRef(a, d2) = %q, %v", old, orphan)
+	}
+	if old, orphan := d.AddRef("b", "d2"); old != "d1" || !orphan {
+		t.Fatalf("AddRef(b, d2) = %q, %v", old, orphan)
+	}
+	if digest, _ := d.Digest("a"); digest != "d2" {
+		t.Fatalf("Digest(a) = %q", digest)
+	}
+	if d.RefCount("d1") != 0 || d.RefCount("d2") != 2 {
+		t.Fatalf("counts = %v", d.Counts)
+	}
+}
+
+func TestDigestIndexPersist(t *testing.T) {
+	d, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+
+	d.AddRef("a", "d1")
+	d.AddRef("b", "d1")
+	d.AddRef("c", "d2")
+	d.Release("c")
+
+	loaded := NewDigestIndex(d.Path())
+	if digest, found := loaded.Digest("a"); !found || digest != "d1" {
+		t.Fatalf("Digest(a) after reload = %q, %v", digest, found)
+	}
+	if n := loaded.RefCount("d1"); n != 2 {
+		t.Fatalf("RefCount after reload = %v", n)
+	}
+	if _, found := loaded.Digest("c"); found {
+		t.Fatal("released guid found after reload")
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"fmt"
+)
+
+//错误类型
+const (
+	ErrorBadRequest			= "bad_request"
+	ErrorUnauthorized		= "unauthorized"
+	ErrorForbidden			= "forbidden"
+	ErrorNotFound			= "not_found"
+	ErrorConflict			= "conflict"
+	ErrorInvalidArgument	= "invalid_argument"
+	ErrorBackendUnavailable	= "backend_unavailable"
+	ErrorInternal			= "internal"
+	ErrorTooBusy			= "too_busy"
+)
+
+//错误类型对应的 http 状态码
+var errorStatus = map[string]int{
+	ErrorBadRequest:			400,
+	ErrorUnauthorized:			401,
+	ErrorForbidden:				403,
+	ErrorNotFound:				404,
+	ErrorConflict:				409,
+	ErrorInvalidArgument:		422,
+	ErrorBackendUnavailable:	502,
+	ErrorInternal:				500,
+	ErrorTooBusy:				503,
+}
+
+//接口错误,controller 根据错误类型返回对应的状态码和 json 格式的错误信息
+type ApiError struct {
+	Kind				string
+	Message				string
+	//附加信息,比如参数校验失败的字段
+	Details				interface{}
+	//大于 0 时通过 Retry-After 告诉客户端多少秒后重试
+	RetryAfter			int
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+//返回错误对应的 http 状态码
+func (e *ApiError) Status() int {
+	status, found := errorStatus[e.Kind]
+	if !found {
+		return 500
+	}
+	return status
+}
+
+//创建指定类型的错误
+func NewApiError(kind string, format string, args ...interface{}) *ApiError {
+	return &ApiError{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+//请求格式错误(400)
+func NewBadRequestError(format string, args ...interface{}) error {
+	return NewApiError(ErrorBadRequest, format, args...)
+}
+
+//没有鉴权信息或鉴权失败(401)
+func NewUnauthorizedError(format string, args ...interface{}) error {
+	return NewApiError(ErrorUnauthorized, format, args...)
+}
+
+//没有权限(403)
+func NewForbiddenError(format string, args ...interface{}) error {
+	return NewApiError(ErrorForbidden, format, args...)
+}
+
+//数据不存在(404)
+func NewNotFoundError(format string, args ...interface{}) error {
+	return NewApiError(ErrorNotFound, format, args...)
+}
+
+//数据状态冲突(409)
+func NewConflictError(format string, args ...interface{}) error {
+	return NewApiError(ErrorConflict, format, args...)
+}
+
+//参数不合法(422)
+func NewInvalidArgumentError(format string, args ...interface{}) error {
+	return NewApiError(ErrorInvalidArgument, format, args...)
+}
+
+//后端存储(jss)不可用(502)
+func NewBackendUnavailableError(format string, args ...interface{}) error {
+	return NewApiError(ErrorBackendUnavailable, format, args...)
+}
+
+//并发传输数超过限制(503)
+func NewTooBusyError(retryAfter int, format string, args ...interface{}) error {
+	e := NewApiError(ErrorTooBusy, format, args...)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+//服务内部错误(500)
+func NewInternalError(format string, args ...interface{}) error {
+	return NewApiError(ErrorInternal, format, args...)
+}
+
+//转换成 ApiError,其他错误按内部错误处理
+func ToApiError(err error) *ApiError {
+	if e, ok := err.(*ApiError); ok {
+		return e
+	}
+	return &ApiError{Kind: ErrorInternal, Message: err.Error()}
+}
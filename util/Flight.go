@@ -0,0 +1,41 @@
+package util
+
+import (
+	"sync"
+)
+
+//相同 key 的并发调用只执行一次,其他调用等待并共享结果
+type FlightGroup struct {
+	lock				sync.Mutex
+	calls				map[string]*flightCall
+}
+
+type flightCall struct {
+	done				chan struct{}
+	value				string
+	err					error
+}
+
+//执行 fn,相同 key 正在执行时等待其结果
+func (g *FlightGroup) Do(key string, fn func() (string, error)) (string, error) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, found := g.calls[key]; found {
+		g.lock.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	call.value, call.err = fn()
+
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	close(call.done)
+	return call.value, call.err
+}
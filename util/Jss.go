@@ -5,13 +5,16 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"os"
 	"io/ioutil"
+	"path/filepath"
 	"time"
 	"strings"
 	"net/http"
 	"net"
+	"sync"
 	steno "github.com/cloudfoundry/gosteno"
 )
 
@@ -31,12 +34,19 @@ func (t *JssToken) expires() string{
 //根据参数生成token 
 func (t *JssToken) token(method string, md5 string, contentType string, expires string, resource string) string{
 	
+	sign := t.Sign(method, md5, contentType, expires, resource)
+	
+	return "jingdong "+t.AccessKey+":"+sign
+}
+
+//根据参数生成签名
+func (t *JssToken) Sign(method string, md5 string, contentType string, expires string, resource string) string{
+	
 	h := hmac.New(sha1.New, []byte(t.SecretKey))
 	param := []string{method,md5,contentType,expires,resource}
 	io.WriteString(h, strings.Join(param,"\n"))
-	sign := base64.StdEncoding.EncodeToString(h.Sum(nil))
 	
-	return "jingdong "+t.AccessKey+":"+sign
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
 
@@ -45,10 +55,32 @@ type JssUtil struct {
 	jssConfig    config.JssConfig
 	droplet	   bool
 	jssToken	   *JssToken
-	logger       *steno.Logger
+	logger       Logger
 	//jss中key的后缀
 	keySuffix	  string
 	desc		  string
+	//数据压缩/加密
+	codec		  *ArtifactCodec
+	//与 jss 之间传输的并发数和带宽限制,所有 JssUtil 共享
+	slots		  *Slots
+	rate		  *RateLimiter
+	//排队等待的最长时间,超时返回 503
+	queueTimeout  time.Duration
+	retryAfter	  int
+}
+
+var (
+	jssLimitsOnce		sync.Once
+	jssSlots			*Slots
+	jssRate				*RateLimiter
+)
+
+//与 jss 之间传输的并发数使用情况
+func JssSlotsUsage() *SlotsUsage {
+	if jssSlots == nil {
+		return &SlotsUsage{}
+	}
+	return jssSlots.Usage()
 }
 
 //创建一个JSS util对象
@@ -61,6 +93,11 @@ func NewJssUtil(c *config.Config, isDroplet bool) *JssUtil{
 		des = "app package"
 	}
 	
+	jssLimitsOnce.Do(func() {
+		jssSlots = NewSlots(c.Transfer.JssMaxConcurrent)
+		jssRate = NewRateLimiter(c.Transfer.JssBytesPerSecond)
+	})
+	
 	return &JssUtil{
 		jssConfig: c.Jss,
 		droplet:	isDroplet,
@@ -71,7 +108,28 @@ func NewJssUtil(c *config.Config, isDroplet bool) *JssUtil{
 		logger:   steno.NewLogger("cc_helper"),
 		keySuffix:	"",
 		desc:		des,
+		codec:		NewArtifactCodec(c),
+		slots:		jssSlots,
+		rate:		jssRate,
+		queueTimeout:	time.Duration(c.Transfer.JssQueueTimeoutSecond) * time.Second,
+		retryAfter:	c.Transfer.RetryAfterSecond,
+	}
+}
+
+//申请与 jss 之间的传输位置,等待超过 jss_queue_timeout_second 时返回 503
+func (j *JssUtil) acquire(guid string) error {
+	if !j.slots.Acquire(j.queueTimeout) {
+		j.logger.Warnf("too many jss transfers, %v guid:%v wait timeout", j.desc, guid)
+		return NewTooBusyError(j.retryAfter, "too many concurrent jss transfers, retry later")
 	}
+	return nil
+}
+
+//返回使用请求日志的 JssUtil,日志中带上请求 id
+func (j *JssUtil) ForRequest(req *http.Request) *JssUtil {
+	r := *j
+	r.logger = RequestLogger(req, j.logger)
+	return &r
 }
 
 //根据guid计算jss对应的 resource key
@@ -100,6 +158,20 @@ func (j *JssUtil) Upload(guid string ,filePath string) bool{
 		return false
 	}
 	
+	return j.uploadResource(guid, j.getResource(guid), filePath) == nil
+}
+
+//上传文件到云存储的指定 resource
+func (j *JssUtil) uploadResource(guid string, resource string, filePath string) error{
+	transfer := BeginTransfer(j.desc, TransferJssUpload, guid)
+	size, err := j.putResource(guid, resource, filePath)
+	transfer.End(size, err)
+	return err
+}
+
+//上传文件到云存储,返回上传的字节数
+func (j *JssUtil) putResource(guid string, resource string, filePath string) (int64, error) {
+
 	start := time.Now()
 	j.logger.Infof("upload %v from jss ,guid:%v",j.desc, guid)
 	
@@ -109,23 +181,29 @@ func (j *JssUtil) Upload(guid string ,filePath string) bool{
 	
 	if err !=nil {
 		j.logger.Infof("upload %v from jss ,guid:%v, fail,%v",j.desc, guid, err)
-		return false
+		return 0, err
 	}
 	finfo, err := reader.Stat()
 	
 	if err != nil {
 		j.logger.Infof("upload %v from jss ,guid:%v, fail,%v",j.desc, guid, err)
-		return false
+		return 0, err
 	}
 	
 	fileSize := finfo.Size()
 	j.logger.Infof("----------->size:%v,path:%v",fileSize, filePath)
-	resource := j.getResource(guid)
+	
+	//超过并发数时排队等待,获取到位置后再签名,避免排队时间过长导致签名过期
+	if err := j.acquire(guid); err != nil {
+		return 0, err
+	}
+	defer j.slots.Release()
+	
 	expires := j.jssToken.expires()
 	token   := j.jssToken.token("PUT", "", "application/octet-stream", expires, resource)
 	
 	client := j.getHttpClient()//http.DefaultClient
-	request,_ := http.NewRequest("PUT", j.getRequestUrl(resource), reader)
+	request,_ := http.NewRequest("PUT", j.getRequestUrl(resource), NewLimitedReader(reader, j.rate))
 	request.Header.Set("authorization",token)
 	request.Header.Set("date",expires)
 	request.Header.Set("Content-Type","application/octet-stream")
@@ -137,36 +215,60 @@ func (j *JssUtil) Upload(guid string ,filePath string) bool{
 	
 	if err !=nil {
 		j.logger.Errorf("upload %v to jss ,guid:%v fail:%v",j.desc, guid , err)
-		return false
+		return 0, err
 	}
+	defer response.Body.Close()
 	end := time.Now()
 	
 	if response.StatusCode == 200 {
 		body, _ := ioutil.ReadAll(response.Body)
 		bodyStr := string(body)
 		j.logger.Infof("upload %v to jss ,guid:%v ,result:%v , success ,耗时:%v",j.desc, guid ,bodyStr, end.Sub(start))
-		return true
+		return fileSize, nil
 	}else{
 		body, _ := ioutil.ReadAll(response.Body)
 		bodyStr := string(body)
 		j.logger.Errorf("upload %v to jss ,guid:%v ,result:%v , fail ,耗时:%v",j.desc, guid ,bodyStr, end.Sub(start))
-		return false
+		return 0, fmt.Errorf("jss status:%v", response.StatusCode)
 	}
 }
 
 //从jss中下载文件到指定路径
-func (j *JssUtil) Download(guid string,filePath string , rw http.ResponseWriter) bool {
+func (j *JssUtil) Download(guid string,filePath string , rw io.Writer) error {
 
 	if guid == "" {
 		j.logger.Errorf("download %v from jss fail ,guid:%v is empty ",j.desc, guid)
-		return false
+		return NewInvalidArgumentError("download %v from jss fail ,guid is empty", j.desc)
 	}
 	
+	return j.downloadResource(guid, j.getResource(guid), "", filePath, rw)
+}
+
+//从jss中下载指定 resource 到指定路径,digest 不为空时为按摘要保存的数据
+//jss 中不存在时返回 not found 错误,其他失败返回 backend unavailable 错误
+func (j *JssUtil) downloadResource(guid string, resource string, digest string, filePath string , rw io.Writer) error {
+	transfer := BeginTransfer(j.desc, TransferJssDownload, guid)
+	err := j.fetchResource(guid, resource, digest, filePath, rw)
+	
+	var size int64
+	if fi, e := os.Stat(filePath); err == nil && e == nil {
+		size = fi.Size()
+	}
+	transfer.End(size, err)
+	return err
+}
+
+//从jss中下载指定 resource,原始数据保存到指定路径,解码后的数据写入 rw
+func (j *JssUtil) fetchResource(guid string, resource string, digest string, filePath string , rw io.Writer) error {
+
 	start := time.Now()
 	j.logger.Infof("download %v from jss ,guid:%v",j.desc, guid)
 	
-	resource := j.getResource(guid)
-
+	//超过并发数时排队等待,获取到位置后再签名,避免排队时间过长导致签名过期
+	if err := j.acquire(guid); err != nil {
+		return err
+	}
+	defer j.slots.Release()
 	
 	expires := j.jssToken.expires()
 	token   := j.jssToken.token("GET", "", "application/octet-stream", expires, resource)
@@ -183,57 +285,64 @@ func (j *JssUtil) Download(guid string,filePath string , rw http.ResponseWriter)
 	
 	if err !=nil {
 		j.logger.Errorf("download %v to jss ,guid:%v fail:%v",j.desc, guid , err)
-		return false
+		return NewBackendUnavailableError("download %v from jss ,guid:%v fail:%v", j.desc, guid, err)
 	}
+	defer response.Body.Close()
 	
 	end := time.Now()
 	
-	if response.StatusCode == 200 {
-		file, err := os.Create(filePath)
-		
-		defer file.Close()
-		defer response.Body.Close()
-		
-		if err !=nil {
-			j.logger.Infof("download %v from jss ,guid:%v ,result:%v , fail ,%v",j.desc, guid , err)
-			return false
-		}
-		//io.Copy(file, response.Body)
-//		file.Write(bodyByte)
-//		rw.Write(bodyByte)
-//		io.Copy(rw, response.Body)
-		reader := response.Body
- 		buf := make([]byte, 32*1024)
-		for {
-			nr, er := reader.Read(buf)
-			if nr > 0 {
-				nw, ew := rw.Write(buf[0:nr])
-				file.Write(buf[0:nr])
-				
-				if ew != nil {
-					err = ew
-					break
-				}
-				if nr != nw {
-					break
-				}
-			}
-			if er == io.EOF {
-				break
-			}
-			if er != nil {
-				j.logger.Infof("download %v from jss ,guid:%v , fail",j.desc, guid , er)
-				break
-			}
-		}
-		j.logger.Infof("download %v from jss ,guid:%v , success ,耗时:%v",j.desc, guid , end.Sub(start))
-		return true
-	}else{
+	if response.StatusCode == 404 {
+		j.logger.Errorf("download %v from jss ,guid:%v , not found ,耗时:%v",j.desc, guid , end.Sub(start))
+		return NewNotFoundError("%v not found, guid:%v", j.desc, guid)
+	}
+	
+	if response.StatusCode != 200 {
 		body, _ := ioutil.ReadAll(response.Body)
 		bodyStr := string(body)
 		j.logger.Errorf("download %v from jss ,guid:%v ,result:%v , fail ,耗时:%v",j.desc, guid ,bodyStr, end.Sub(start))
-		return false
+		return NewBackendUnavailableError("download %v from jss ,guid:%v fail, status:%v", j.desc, guid, response.StatusCode)
 	}
+	
+	//先写临时文件,完成后 rename,其他请求不会读到不完整的缓存文件
+	file, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".download-")
+	if err == nil {
+		if err = file.Chmod(CacheFileMode); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
+	if err !=nil {
+		j.logger.Infof("download %v from jss ,guid:%v , fail ,%v",j.desc, guid , err)
+		return NewInternalError("download %v from jss ,guid:%v, create cache file fail:%v", j.desc, guid, err)
+	}
+	
+	//本地缓存保存云存储中的原始数据(压缩/加密),返回给dea的是解码后的数据
+	tee := io.TeeReader(NewLimitedReader(response.Body, j.rate), file)
+	reader, err := j.codec.NewDigestReader(tee, digest)
+	if err == nil {
+		_, err = io.Copy(rw, reader)
+	}
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, tee)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+	
+	//下载失败时删除不完整的临时文件
+	if err != nil {
+		os.Remove(file.Name())
+		j.logger.Errorf("download %v from jss ,guid:%v , fail,%v",j.desc, guid , err)
+		return NewBackendUnavailableError("download %v from jss ,guid:%v fail:%v", j.desc, guid, err)
+	}
+	
+	j.logger.Infof("download %v from jss ,guid:%v , success ,耗时:%v",j.desc, guid , time.Now().Sub(start))
+	return nil
 }
 
 //根据guid从云存储删除对应的资源
@@ -244,12 +353,20 @@ func (j *JssUtil) Remove(guid string) bool{
 		return false
 	}
 	
+	return j.removeResource(guid, j.getResource(guid))
+}
+
+//从云存储删除指定的 resource
+func (j *JssUtil) removeResource(guid string, resource string) bool{
+	return j.deleteResource(guid, resource) == nil
+}
+
+//从云存储删除指定的 resource,resource 不存在时视为删除成功
+func (j *JssUtil) deleteResource(guid string, resource string) error{
+
 	start := time.Now()
 	j.logger.Infof("remove %v from jss ,guid:%v",j.desc, guid)
 	
-	resource := j.getResource(guid)
-
-	
 	expires := j.jssToken.expires()
 	token   := j.jssToken.token("DELETE", "", "application/octet-stream", expires, resource)
 	
@@ -265,21 +382,21 @@ func (j *JssUtil) Remove(guid string) bool{
 	
 	if err !=nil {
 		j.logger.Errorf("remove %v to jss ,guid:%v fail:%v",j.desc, guid , err)
-		return false
+		return err
 	}
+	defer response.Body.Close()
 	
 	end := time.Now()
+	body, _ := ioutil.ReadAll(response.Body)
+	bodyStr := string(body)
 	
-	if response.StatusCode == 200 {
-		body, _ := ioutil.ReadAll(response.Body)
-		bodyStr := string(body)
-		j.logger.Infof("remove %v from jss ,guid:%v ,result:%v , success ,耗时:%v",j.desc, guid ,bodyStr, end.Sub(start))
-		return true
-	}else{
-		body, _ := ioutil.ReadAll(response.Body)
-		bodyStr := string(body)
-		j.logger.Errorf("remove %v from jss ,guid:%v ,result:%v , fail ,耗时:%v",j.desc, guid ,bodyStr, end.Sub(start))
-		return false
+	switch response.StatusCode {
+	case 200, 204, 404:
+		j.logger.Infof("remove %v from jss ,guid:%v ,status:%v ,result:%v , success ,耗时:%v",j.desc, guid ,response.StatusCode, bodyStr, end.Sub(start))
+		return nil
+	default:
+		j.logger.Errorf("remove %v from jss ,guid:%v ,status:%v ,result:%v , fail ,耗时:%v",j.desc, guid ,response.StatusCode, bodyStr, end.Sub(start))
+		return fmt.Errorf("jss status %v: %v", response.StatusCode, strings.TrimSpace(bodyStr))
 	}
 }
 
@@ -302,4 +419,310 @@ func (j *JssUtil) getHttpClient() *http.Client{
         }
         
     return client
-}
\ No newline at end of file
+}
+
+//返回当前对象对应的 bucket
+func (j *JssUtil) getBucket() string {
+	if j.droplet {
+		return j.jssConfig.DropletBucket
+	}
+	return j.jssConfig.AppPackageBucket
+}
+
+//jss 中按摘要保存的数据和 guid 引用对象的 key 前缀
+const (
+	JssDigestPrefix		= "sha256/"
+	JssRefPrefix		= "refs/"
+	//摘要->guid 的反向索引,key 为 refs-by-digest/<digest>/<guid>
+	JssRefIndexPrefix	= "refs-by-digest/"
+)
+
+//根据 sha256 摘要计算jss对应的 resource key(相同内容只保存一份)
+func (j *JssUtil) getDigestResource(digest string) string {
+	return "/"+j.getBucket()+"/"+JssDigestPrefix+digest
+}
+
+//根据guid计算 guid->摘要 引用对象的 resource key
+func (j *JssUtil) getRefResource(guid string) string {
+	return "/"+j.getBucket()+"/"+JssRefPrefix+guid
+}
+
+//根据摘要和guid计算反向索引的 resource key
+func (j *JssUtil) getRefIndexResource(digest string, guid string) string {
+	return "/"+j.getBucket()+"/"+JssRefIndexPrefix+digest+"/"+guid
+}
+
+//返回数据类型描述(droplet/app package)
+func (j *JssUtil) Desc() string {
+	return j.desc
+}
+
+//创建请求jss的http请求,并设置签名信息
+func (j *JssUtil) newRequest(method string, resource string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, j.getRequestUrl(resource), body)
+	if err != nil {
+		return nil, err
+	}
+	
+	expires := j.jssToken.expires()
+	token   := j.jssToken.token(method, "", "application/octet-stream", expires, resource)
+	request.Header.Set("authorization",token)
+	request.Header.Set("date",expires)
+	request.Header.Set("Content-Type","application/octet-stream")
+	request.Header.Set("host",j.jssConfig.Host)
+	request.Header.Set("accept","application/json")
+	
+	return request, nil
+}
+
+//检测云存储中 resource 是否存在
+func (j *JssUtil) existsResource(resource string) bool {
+	_, err := j.statResource(resource)
+	return err == nil
+}
+
+//返回云存储中 resource 的大小,不存在时返回 not found 错误
+func (j *JssUtil) statResource(resource string) (int64, error) {
+	request, err := j.newRequest("HEAD", resource, nil)
+	if err != nil {
+		j.logger.Errorf("head %v from jss ,resource:%v fail:%v",j.desc, resource, err)
+		return 0, NewInternalError("head %v from jss ,resource:%v fail:%v", j.desc, resource, err)
+	}
+	
+	response, err := j.getHttpClient().Do(request)
+	if err != nil {
+		j.logger.Errorf("head %v from jss ,resource:%v fail:%v",j.desc, resource, err)
+		return 0, NewBackendUnavailableError("head %v from jss ,resource:%v fail:%v", j.desc, resource, err)
+	}
+	response.Body.Close()
+	
+	switch response.StatusCode {
+	case 200:
+		return response.ContentLength, nil
+	case 404:
+		return 0, NewNotFoundError("%v not found in jss, resource:%v", j.desc, resource)
+	}
+	return 0, NewBackendUnavailableError("head %v from jss ,resource:%v fail, status:%v", j.desc, resource, response.StatusCode)
+}
+
+//返回云存储中 guid 对应数据(旧版本按guid保存)的大小
+func (j *JssUtil) Stat(guid string) (int64, error) {
+	return j.statResource(j.getResource(guid))
+}
+
+//返回云存储中摘要对应数据的大小
+func (j *JssUtil) StatDigest(digest string) (int64, error) {
+	return j.statResource(j.getDigestResource(digest))
+}
+
+//按摘要上传文件到云存储,云存储中已经存在相同摘要的数据时不再重复上传
+func (j *JssUtil) UploadDigest(digest string, filePath string) error {
+	if digest == "" {
+		j.logger.Errorf("upload %v to jss fail ,digest is empty ",j.desc)
+		return NewInvalidArgumentError("upload %v to jss fail ,digest is empty", j.desc)
+	}
+	
+	resource := j.getDigestResource(digest)
+	if j.existsResource(resource) {
+		j.logger.Infof("upload %v to jss ,digest:%v already exists, skip upload",j.desc, digest)
+		return nil
+	}
+	
+	return j.uploadResource(digest, resource, filePath)
+}
+
+//按摘要从云存储下载文件到指定路径
+func (j *JssUtil) DownloadDigest(digest string, filePath string, rw io.Writer) error {
+	if digest == "" {
+		j.logger.Errorf("download %v from jss fail ,digest is empty ",j.desc)
+		return NewInvalidArgumentError("download %v from jss fail ,digest is empty", j.desc)
+	}
+	
+	return j.downloadResource(digest, j.getDigestResource(digest), digest, filePath, rw)
+}
+
+//按摘要从云存储删除数据
+func (j *JssUtil) RemoveDigest(digest string) bool {
+	if digest == "" {
+		j.logger.Errorf("remove %v from jss fail ,digest is empty ",j.desc)
+		return false
+	}
+	
+	return j.removeResource(digest, j.getDigestResource(digest))
+}
+
+/**
+	保存 guid->摘要 的引用对象到云存储(多个scheduler 共享同一个云存储时可以互相解析)
+	先写入摘要->guid 的反向索引再写入引用,guid 之前引用其他摘要时移除旧的反向索引
+**/
+func (j *JssUtil) PutRef(guid string, digest string) bool {
+	if guid == "" || digest == "" {
+		j.logger.Errorf("put %v ref to jss fail ,guid:%v, digest:%v",j.desc, guid, digest)
+		return false
+	}
+	
+	//读取失败时保留旧的反向索引,只会推迟旧摘要数据的删除
+	old, _, _ := j.getRef(guid)
+	if err := j.putData(guid, j.getRefIndexResource(digest, guid), ""); err != nil {
+		return false
+	}
+	if err := j.putData(guid, j.getRefResource(guid), digest); err != nil {
+		return false
+	}
+	if old != "" && old != digest {
+		j.deleteResource(guid, j.getRefIndexResource(old, guid))
+	}
+	return true
+}
+
+//保存内容较小的对象(引用和反向索引)到云存储
+func (j *JssUtil) putData(guid string, resource string, data string) error {
+	request, err := j.newRequest("PUT", resource, strings.NewReader(data))
+	if err != nil {
+		j.logger.Errorf("put %v ref to jss ,guid:%v fail:%v",j.desc, guid, err)
+		return err
+	}
+	request.ContentLength = int64(len(data))
+	
+	response, err := j.getHttpClient().Do(request)
+	if err != nil {
+		j.logger.Errorf("put %v ref to jss ,guid:%v fail:%v",j.desc, guid, err)
+		return err
+	}
+	defer response.Body.Close()
+	
+	if response.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(response.Body)
+		j.logger.Errorf("put %v ref to jss ,guid:%v ,result:%v , fail",j.desc, guid, string(body))
+		return fmt.Errorf("jss status %v: %v", response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+//从云存储读取 guid 对应的摘要
+func (j *JssUtil) GetRef(guid string) (string, bool) {
+	digest, found, _ := j.getRef(guid)
+	return digest, found
+}
+
+//与 GetRef 相同,区分引用不存在(found 为 false)和请求失败(返回错误)
+func (j *JssUtil) LookupRef(guid string) (string, bool, error) {
+	return j.getRef(guid)
+}
+
+//从云存储读取 guid 对应的摘要,引用不存在时 found 为 false,请求失败时返回错误
+func (j *JssUtil) getRef(guid string) (string, bool, error) {
+	if guid == "" {
+		return "", false, nil
+	}
+	
+	request, err := j.newRequest("GET", j.getRefResource(guid), nil)
+	if err != nil {
+		j.logger.Errorf("get %v ref from jss ,guid:%v fail:%v",j.desc, guid, err)
+		return "", false, NewInternalError("get %v ref from jss ,guid:%v fail:%v", j.desc, guid, err)
+	}
+	
+	response, err := j.getHttpClient().Do(request)
+	if err != nil {
+		j.logger.Errorf("get %v ref from jss ,guid:%v fail:%v",j.desc, guid, err)
+		return "", false, NewBackendUnavailableError("get %v ref from jss ,guid:%v fail:%v", j.desc, guid, err)
+	}
+	defer response.Body.Close()
+	
+	if response.StatusCode == 404 {
+		return "", false, nil
+	}
+	if response.StatusCode != 200 {
+		return "", false, NewBackendUnavailableError("get %v ref from jss ,guid:%v fail, status:%v", j.desc, guid, response.StatusCode)
+	}
+	
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		j.logger.Errorf("get %v ref from jss ,guid:%v fail:%v",j.desc, guid, err)
+		return "", false, NewBackendUnavailableError("get %v ref from jss ,guid:%v fail:%v", j.desc, guid, err)
+	}
+	
+	digest := strings.TrimSpace(string(body))
+	return digest, digest != "", nil
+}
+
+//找到引用后停止列举
+var errDigestReferenced = NewConflictError("digest referenced")
+
+/**
+	检查云存储中是否还有 guid 引用该摘要
+	多个 scheduler 共享同一个云存储,本地引用计数为 0 不代表其他 scheduler 上传的 guid 没有引用
+	只列举该摘要的反向索引,exclude 中的 guid(正在删除的引用)不计算在内,无法确认时返回错误
+**/
+func (j *JssUtil) DigestReferenced(digest string, exclude map[string]bool) (bool, error) {
+	prefix := JssRefIndexPrefix + digest + "/"
+	err := j.List(prefix, func(objects []*JssObject) error {
+		for _, o := range objects {
+			guid := strings.TrimPrefix(o.Key, prefix)
+			if !exclude[guid] {
+				j.logger.Infof("%v digest:%v still referenced by guid:%v", j.desc, digest, guid)
+				return errDigestReferenced
+			}
+		}
+		return nil
+	})
+	if err == errDigestReferenced {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+/**
+	为已有的引用补写反向索引
+	反向索引之前写入的引用没有对应的索引,删除摘要数据前需要先执行一次
+	guard 不为空时每个 guid 在持有 guard 返回的锁时处理,避免与引用的更新和删除交错
+**/
+func (j *JssUtil) IndexRefs(guard func(guid string) func()) error {
+	return j.List(JssRefPrefix, func(objects []*JssObject) error {
+		for _, o := range objects {
+			if err := j.indexRef(strings.TrimPrefix(o.Key, JssRefPrefix), guard); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (j *JssUtil) indexRef(guid string, guard func(guid string) func()) error {
+	if guard != nil {
+		unlock := guard(guid)
+		defer unlock()
+	}
+	digest, found, err := j.getRef(guid)
+	if err != nil || !found {
+		return err
+	}
+	return j.putData(guid, j.getRefIndexResource(digest, guid), "")
+}
+
+//从云存储删除 guid 的引用对象
+func (j *JssUtil) RemoveRef(guid string) bool {
+	if guid == "" {
+		j.logger.Errorf("remove %v ref from jss fail ,guid is empty ",j.desc)
+		return false
+	}
+	
+	return j.removeRef(guid) == nil
+}
+
+//先删除反向索引再删除引用,反向索引删除失败时引用仍然存在,重试时可以找到摘要
+func (j *JssUtil) removeRef(guid string) error {
+	digest, found, err := j.getRef(guid)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := j.deleteResource(guid, j.getRefIndexResource(digest, guid)); err != nil {
+			return err
+		}
+	}
+	return j.deleteResource(guid, j.getRefResource(guid))
+}
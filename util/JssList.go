@@ -0,0 +1,112 @@
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//每次列举的最大对象数
+const jssListPageSize = 1000
+
+//jss 中的对象
+type JssObject struct {
+	//bucket 内的 key
+	Key					string				`json:"key"`
+	Size				int64				`json:"size"`
+	LastModified		time.Time			`json:"last_modified"`
+}
+
+//jss 列举对象的返回值
+type jssListResult struct {
+	Marker				string
+	HasNext				bool
+	Contents			[]struct {
+		Key				string
+		Size			int64
+		LastModified	string
+	}
+}
+
+//列举 bucket 中以 prefix 开头的对象,每页调用一次 fn,fn 返回错误时停止列举
+func (j *JssUtil) List(prefix string, fn func([]*JssObject) error) error {
+	marker := ""
+	for {
+		objects, next, err := j.listPage(prefix, marker)
+		if err != nil {
+			return err
+		}
+		if err := fn(objects); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		marker = next
+	}
+}
+
+//列举一页对象,返回下一页的 marker,没有下一页时为空
+func (j *JssUtil) listPage(prefix string, marker string) ([]*JssObject, string, error) {
+	resource := "/" + j.getBucket()
+	request, err := j.newRequest("GET", resource, nil)
+	if err != nil {
+		return nil, "", NewInternalError("list %v from jss fail:%v", j.desc, err)
+	}
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("marker", marker)
+	query.Set("max-keys", strconv.Itoa(jssListPageSize))
+	request.URL.RawQuery = query.Encode()
+
+	response, err := j.getHttpClient().Do(request)
+	if err != nil {
+		j.logger.Errorf("list %v from jss ,prefix:%v ,marker:%v fail:%v", j.desc, prefix, marker, err)
+		return nil, "", NewBackendUnavailableError("list %v from jss fail:%v", j.desc, err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", NewBackendUnavailableError("list %v from jss fail:%v", j.desc, err)
+	}
+	if response.StatusCode != 200 {
+		j.logger.Errorf("list %v from jss ,prefix:%v ,marker:%v fail, status:%v ,result:%s", j.desc, prefix, marker, response.StatusCode, body)
+		return nil, "", NewBackendUnavailableError("list %v from jss fail, status:%v", j.desc, response.StatusCode)
+	}
+
+	var result jssListResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, "", NewBackendUnavailableError("list %v from jss, invalid response:%v", j.desc, err)
+	}
+
+	objects := make([]*JssObject, 0, len(result.Contents))
+	for _, c := range result.Contents {
+		objects = append(objects, &JssObject{
+			Key:			c.Key,
+			Size:			c.Size,
+			LastModified:	parseJssTime(c.LastModified),
+		})
+	}
+
+	next := ""
+	if result.HasNext && len(objects) > 0 {
+		next = objects[len(objects)-1].Key
+	}
+	return objects, next, nil
+}
+
+//jss 返回的时间为 RFC1123 格式,兼容 RFC3339,解析失败时返回零值
+func parseJssTime(s string) time.Time {
+	if t, err := http.ParseTime(s); err == nil {
+		return t
+	}
+	if t, err := time.Parse(time.RFC3339, strings.TrimSpace(s)); err == nil {
+		return t
+	}
+	return time.Time{}
+}
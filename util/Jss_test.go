@@ -0,0 +1,63 @@
+package util
+
+import (
+	"testing"
+)
+
+//LookupRef 区分引用不存在和请求失败
+func TestJssLookupRef(t *testing.T) {
+	f := newFakeJss()
+	j := NewJssUtil(f.config(), true)
+	f.put("/jae-droplets/refs/guid", "d1")
+
+	if digest, found, err := j.LookupRef("guid"); err != nil || !found || digest != "d1" {
+		t.Fatalf("lookup existing ref = %q, %v, %v", digest, found, err)
+	}
+	if _, found, err := j.LookupRef("missing"); err != nil || found {
+		t.Fatalf("lookup missing ref = %v, %v", found, err)
+	}
+
+	f.Close()
+	if _, found, err := j.LookupRef("guid"); err == nil || found {
+		t.Fatalf("lookup with jss down = %v, %v", found, err)
+	}
+}
+
+//引用变化时维护摘要->guid 的反向索引
+func TestJssRefIndex(t *testing.T) {
+	f := newFakeJss()
+	defer f.Close()
+	j := NewJssUtil(f.config(), true)
+
+	if !j.PutRef("a", "d1") || !j.PutRef("b", "d1") {
+		t.Fatal("put ref fail")
+	}
+	if referenced, err := j.DigestReferenced("d1", map[string]bool{"a": true}); err != nil || !referenced {
+		t.Fatalf("d1 referenced = %v, %v", referenced, err)
+	}
+
+	//b 改为引用 d2,d1 只剩正在删除的 a 引用
+	j.PutRef("b", "d2")
+	if f.exists("/jae-droplets/refs-by-digest/d1/b") || !f.exists("/jae-droplets/refs-by-digest/d2/b") {
+		t.Fatal("ref index not moved")
+	}
+	if referenced, err := j.DigestReferenced("d1", map[string]bool{"a": true}); err != nil || referenced {
+		t.Fatalf("d1 referenced = %v, %v", referenced, err)
+	}
+
+	if !j.RemoveRef("a") || f.exists("/jae-droplets/refs/a") || f.exists("/jae-droplets/refs-by-digest/d1/a") {
+		t.Fatal("ref or ref index not removed")
+	}
+
+	//反向索引之前写入的引用
+	f.put("/jae-droplets/refs/old", "d3")
+	if referenced, _ := j.DigestReferenced("d3", nil); referenced {
+		t.Fatal("unindexed ref found")
+	}
+	if err := j.IndexRefs(nil); err != nil {
+		t.Fatal(err)
+	}
+	if referenced, err := j.DigestReferenced("d3", nil); err != nil || !referenced {
+		t.Fatalf("d3 referenced = %v, %v", referenced, err)
+	}
+}
@@ -0,0 +1,210 @@
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+//令牌桶限速,rate 为每秒字节数,最多积累 1 秒的令牌;nil 表示不限速
+type RateLimiter struct {
+	rate				float64
+	tokens				float64
+	last				time.Time
+	lock				sync.Mutex
+}
+
+//创建限速器,bytesPerSecond <= 0 时返回 nil(不限速)
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+//单次最多申请的字节数,避免大块数据一次等待过久
+func (l *RateLimiter) burst() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.rate)
+}
+
+//申请 n 个字节的令牌,不足时等待
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+//同时受多个限速器限制(比如全局限速和单个客户端限速)时,单次读写的最大字节数
+func chunkSize(limiters []*RateLimiter, n int) int {
+	for _, l := range limiters {
+		if b := l.burst(); b > 0 && b < n {
+			n = b
+		}
+	}
+	return n
+}
+
+func waitAll(limiters []*RateLimiter, n int) {
+	for _, l := range limiters {
+		l.WaitN(n)
+	}
+}
+
+//限速读
+type limitedReader struct {
+	reader				io.Reader
+	limiters			[]*RateLimiter
+}
+
+//返回按 limiters 限速的 reader,所有 limiter 为 nil 时直接返回 r
+func NewLimitedReader(r io.Reader, limiters ...*RateLimiter) io.Reader {
+	active := activeLimiters(limiters)
+	if len(active) == 0 {
+		return r
+	}
+	return &limitedReader{reader: r, limiters: active}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	p = p[:chunkSize(r.limiters, len(p))]
+	n, err := r.reader.Read(p)
+	waitAll(r.limiters, n)
+	return n, err
+}
+
+//限速写
+type limitedWriter struct {
+	writer				io.Writer
+	limiters			[]*RateLimiter
+}
+
+//返回按 limiters 限速的 writer,所有 limiter 为 nil 时直接返回 w
+func NewLimitedWriter(w io.Writer, limiters ...*RateLimiter) io.Writer {
+	active := activeLimiters(limiters)
+	if len(active) == 0 {
+		return w
+	}
+	return &limitedWriter{writer: w, limiters: active}
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:chunkSize(w.limiters, len(p))]
+		waitAll(w.limiters, len(chunk))
+		n, err := w.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func activeLimiters(limiters []*RateLimiter) []*RateLimiter {
+	active := []*RateLimiter{}
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	return active
+}
+
+//并发数限制,max <= 0 时不限制
+type Slots struct {
+	slots				chan struct{}
+	lock				sync.Mutex
+	waiting				int
+}
+
+func NewSlots(max int) *Slots {
+	s := &Slots{}
+	if max > 0 {
+		s.slots = make(chan struct{}, max)
+	}
+	return s
+}
+
+//申请一个并发位置,最多等待 timeout,超时返回 false;timeout < 0 时一直等待
+func (s *Slots) Acquire(timeout time.Duration) bool {
+	if s.slots == nil {
+		return true
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if timeout == 0 {
+		return false
+	}
+
+	s.lock.Lock()
+	s.waiting++
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.waiting--
+		s.lock.Unlock()
+	}()
+
+	if timeout < 0 {
+		s.slots <- struct{}{}
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+//释放 Acquire 成功申请的位置
+func (s *Slots) Release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+//并发数使用情况
+type SlotsUsage struct {
+	Max					int					`json:"max"`
+	Active				int					`json:"active"`
+	Waiting				int					`json:"waiting"`
+}
+
+func (s *Slots) Usage() *SlotsUsage {
+	if s.slots == nil {
+		return &SlotsUsage{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &SlotsUsage{Max: cap(s.slots), Active: len(s.slots), Waiting: s.waiting}
+}
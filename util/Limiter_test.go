@@ -0,0 +1,91 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterNil(t *testing.T) {
+	if l := NewRateLimiter(0); l != nil {
+		t.Fatal("limiter created for zero rate")
+	}
+	var l *RateLimiter
+	l.WaitN(1 << 30)
+
+	r := bytes.NewReader([]byte("abc"))
+	if NewLimitedReader(r, nil, nil) != r {
+		t.Fatal("reader wrapped without limiters")
+	}
+}
+
+func TestLimitedReaderRate(t *testing.T) {
+	//初始有 1 秒的令牌,再读 1 秒的数据至少需要等待约 1 秒
+	data := bytes.Repeat([]byte("x"), 20*1024)
+	start := time.Now()
+	out, err := ioutil.ReadAll(NewLimitedReader(bytes.NewReader(data), NewRateLimiter(10*1024)))
+	elapsed := time.Since(start)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("read %v bytes, err:%v", len(out), err)
+	}
+	if elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("read took %v, expected about 1s", elapsed)
+	}
+}
+
+func TestLimitedWriterChunks(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLimitedWriter(&buf, NewRateLimiter(1024*1024), NewRateLimiter(4096))
+	data := bytes.Repeat([]byte("y"), 6000)
+	n, err := w.Write(data)
+	if err != nil || n != len(data) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("write = %v, %v", n, err)
+	}
+}
+
+func TestSlots(t *testing.T) {
+	s := NewSlots(2)
+	if !s.Acquire(0) || !s.Acquire(0) {
+		t.Fatal("acquire within limit failed")
+	}
+	if s.Acquire(0) {
+		t.Fatal("acquire beyond limit without wait succeeded")
+	}
+
+	start := time.Now()
+	if s.Acquire(50 * time.Millisecond) {
+		t.Fatal("acquire beyond limit succeeded")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("acquire returned before timeout")
+	}
+
+	done := make(chan bool)
+	go func() { done <- s.Acquire(-1) }()
+	if !waitFor(func() bool { return s.Usage().Waiting == 1 }) {
+		t.Fatalf("usage = %+v, expected one waiter", s.Usage())
+	}
+	s.Release()
+	if !<-done {
+		t.Fatal("waiting acquire failed")
+	}
+
+	usage := s.Usage()
+	if usage.Max != 2 || usage.Active != 2 || usage.Waiting != 0 {
+		t.Fatalf("usage = %+v", usage)
+	}
+}
+
+func TestSlotsUnlimited(t *testing.T) {
+	s := NewSlots(0)
+	for i := 0; i < 100; i++ {
+		if !s.Acquire(0) {
+			t.Fatal("unlimited slots refused")
+		}
+	}
+	s.Release()
+	if usage := s.Usage(); usage.Max != 0 {
+		t.Fatalf("usage = %+v", usage)
+	}
+}
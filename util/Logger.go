@@ -0,0 +1,79 @@
+package util
+
+import (
+	"context"
+	"net/http"
+)
+
+//日志接口,*steno.Logger 和请求日志都实现了该接口
+//请求日志只在 steno 日志基础上加前缀,不能再次包装
+type Logger interface {
+	Debug(m string)
+	Info(m string)
+	Warn(m string)
+	Error(m string)
+	Debugf(f string, a ...interface{})
+	Infof(f string, a ...interface{})
+	Warnf(f string, a ...interface{})
+	Errorf(f string, a ...interface{})
+}
+
+type requestIdKey struct{}
+
+//在 context 中保存请求 id
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+//返回 context 中的请求 id,没有时返回空字符串
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+//返回请求对应的日志对象,每条日志都带上请求 id,请求中没有 id 时返回 base
+func RequestLogger(req *http.Request, base Logger) Logger {
+	id := RequestId(req.Context())
+	if id == "" {
+		return base
+	}
+	return &requestLogger{logger: base, prefix: "request:" + id + " "}
+}
+
+//请求日志,在日志内容前加上请求 id
+type requestLogger struct {
+	logger			Logger
+	prefix			string
+}
+
+func (l *requestLogger) Debug(m string) {
+	l.logger.Debug(l.prefix + m)
+}
+
+func (l *requestLogger) Info(m string) {
+	l.logger.Info(l.prefix + m)
+}
+
+func (l *requestLogger) Warn(m string) {
+	l.logger.Warn(l.prefix + m)
+}
+
+func (l *requestLogger) Error(m string) {
+	l.logger.Error(l.prefix + m)
+}
+
+func (l *requestLogger) Debugf(f string, a ...interface{}) {
+	l.logger.Debugf(l.prefix + f, a...)
+}
+
+func (l *requestLogger) Infof(f string, a ...interface{}) {
+	l.logger.Infof(l.prefix + f, a...)
+}
+
+func (l *requestLogger) Warnf(f string, a ...interface{}) {
+	l.logger.Warnf(l.prefix + f, a...)
+}
+
+func (l *requestLogger) Errorf(f string, a ...interface{}) {
+	l.logger.Errorf(l.prefix + f, a...)
+}
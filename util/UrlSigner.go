@@ -0,0 +1,90 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"scheduler/config"
+)
+
+//下载链接签名工具(签名方式与 JssToken 一致: HMAC-SHA1 + base64)
+type UrlSigner struct {
+	secretKey			string
+	expires				time.Duration
+	required			bool
+}
+
+//创建签名工具
+func NewUrlSigner(c *config.Config) *UrlSigner {
+	return &UrlSigner{
+		secretKey:	c.SignedUrl.SecretKey,
+		expires:	time.Duration(c.SignedUrl.ExpiresSecond) * time.Second,
+		required:	c.SignedUrl.Required,
+	}
+}
+
+//下载接口是否必须带签名
+func (s *UrlSigner) Required() bool {
+	return s.required
+}
+
+//根据参数生成签名
+func (s *UrlSigner) sign(method string, path string, expires string) string {
+	h := hmac.New(sha1.New, []byte(s.secretKey))
+	param := []string{method, expires, path}
+	io.WriteString(h, strings.Join(param, "\n"))
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+//生成带签名的下载链接,返回链接和过期时间(unix 秒)
+func (s *UrlSigner) SignedUrl(path string) (string, int64, error) {
+	if s.secretKey == "" {
+		return "", 0, errors.New("signed url secret key is not configured")
+	}
+
+	expires := time.Now().Add(s.expires).Unix()
+	expiresStr := strconv.FormatInt(expires, 10)
+
+	params := url.Values{}
+	params.Set("expires", expiresStr)
+	params.Set("signature", s.sign("GET", path, expiresStr))
+
+	return path + "?" + params.Encode(), expires, nil
+}
+
+//校验请求的签名和有效期
+func (s *UrlSigner) Verify(method string, path string, params url.Values) error {
+	if s.secretKey == "" {
+		return errors.New("signed url secret key is not configured")
+	}
+
+	expiresStr := params.Get("expires")
+	signature := params.Get("signature")
+	if expiresStr == "" || signature == "" {
+		return errors.New("url is not signed")
+	}
+
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return errors.New("invalid expires:" + expiresStr)
+	}
+	if time.Now().Unix() > expires {
+		return errors.New("signed url expired")
+	}
+
+	//HEAD 请求使用 GET 的签名
+	if method == "HEAD" {
+		method = "GET"
+	}
+	expected := s.sign(method, path, expiresStr)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
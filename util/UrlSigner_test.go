@@ -0,0 +1,87 @@
+package util
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"scheduler/config"
+)
+
+func newTestSigner(secret string) *UrlSigner {
+	c := config.DefaultConfig()
+	c.SignedUrl.SecretKey = secret
+	c.SignedUrl.ExpiresSecond = 60
+	return NewUrlSigner(c)
+}
+
+func signedParams(t *testing.T, s *UrlSigner, path string) url.Values {
+	signed, _, err := s.SignedUrl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != path {
+		t.Fatalf("signed url path = %q", u.Path)
+	}
+	return u.Query()
+}
+
+func TestUrlSignerVerify(t *testing.T) {
+	s := newTestSigner("secret")
+	path := "/scheduler/droplet/guid/download"
+	params := signedParams(t, s, path)
+
+	if err := s.Verify("GET", path, params); err != nil {
+		t.Fatalf("verify GET: %v", err)
+	}
+	if err := s.Verify("HEAD", path, params); err != nil {
+		t.Fatalf("verify HEAD: %v", err)
+	}
+	if err := s.Verify("PUT", path, params); err == nil {
+		t.Fatal("signature accepted for another method")
+	}
+	if err := s.Verify("GET", strings.Replace(path, "guid", "other", 1), params); err == nil {
+		t.Fatal("signature accepted for another path")
+	}
+	if err := newTestSigner("other").Verify("GET", path, params); err == nil {
+		t.Fatal("signature accepted with another secret")
+	}
+}
+
+func TestUrlSignerRejects(t *testing.T) {
+	s := newTestSigner("secret")
+	path := "/scheduler/droplet/guid/download"
+
+	if err := s.Verify("GET", path, url.Values{}); err == nil {
+		t.Fatal("unsigned url accepted")
+	}
+
+	params := signedParams(t, s, path)
+	params.Set("expires", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	if err := s.Verify("GET", path, params); err == nil {
+		t.Fatal("signature accepted with modified expires")
+	}
+
+	expired := url.Values{}
+	expiresStr := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	expired.Set("expires", expiresStr)
+	expired.Set("signature", s.sign("GET", path, expiresStr))
+	if err := s.Verify("GET", path, expired); err == nil {
+		t.Fatal("expired signature accepted")
+	}
+}
+
+func TestUrlSignerWithoutSecret(t *testing.T) {
+	s := newTestSigner("")
+	if _, _, err := s.SignedUrl("/scheduler/droplet/guid/download"); err == nil {
+		t.Fatal("signed url without secret key")
+	}
+	if err := s.Verify("GET", "/", url.Values{"expires": {"1"}, "signature": {"x"}}); err == nil {
+		t.Fatal("verified without secret key")
+	}
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"scheduler/config"
+)
+
+//测试用的 jss,对象按 url path(/bucket/key)保存在内存中
+type fakeJss struct {
+	*httptest.Server
+	lock				sync.Mutex
+	objects				map[string][]byte
+	//为 true 时删除返回 500
+	failDelete			bool
+	deletes				[]string
+}
+
+func newFakeJss() *fakeJss {
+	f := &fakeJss{objects: make(map[string][]byte)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeJss) put(key string, data string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.objects[key] = []byte(data)
+}
+
+func (f *fakeJss) exists(key string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, found := f.objects[key]
+	return found
+}
+
+func (f *fakeJss) serve(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := r.URL.Path
+	switch r.Method {
+	case "GET":
+		if strings.Count(path, "/") == 1 {
+			f.list(w, path, r.URL.Query().Get("prefix"))
+			return
+		}
+		data, found := f.objects[path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case "HEAD":
+		if _, found := f.objects[path]; !found {
+			w.WriteHeader(404)
+		}
+	case "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[path] = data
+	case "DELETE":
+		if f.failDelete {
+			w.WriteHeader(500)
+			return
+		}
+		f.deletes = append(f.deletes, path)
+		delete(f.objects, path)
+		w.WriteHeader(204)
+	}
+}
+
+func (f *fakeJss) list(w http.ResponseWriter, bucket string, prefix string) {
+	result := jssListResult{}
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, bucket+"/"+prefix) {
+			keys = append(keys, strings.TrimPrefix(key, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key				string
+			Size			int64
+			LastModified	string
+		}{Key: key, Size: int64(len(f.objects[bucket+"/"+key])), LastModified: time.Now().Format(time.RFC1123)})
+	}
+	data, _ := json.Marshal(&result)
+	w.Write(data)
+}
+
+//返回使用 fake jss 的配置
+func (f *fakeJss) config() *config.Config {
+	c := config.DefaultConfig()
+	c.Jss.Domain = f.URL
+	return c
+}